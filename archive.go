@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"html/template"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// A plain old website, for people who want their conversations somewhere
+// public and searchable without running a wiki. Everything's re-rendered from
+// archive.json on every grab, so the templates can change whenever.
+const archiveDefaultPath = "archive"
+
+// Not in templates/, because LoadHTMLGlob would try to use these too
+const archiveTemplateGlob = "archive_templates/*.html"
+
+const archiveSiteTitle = "Grab Archive"
+
+// Only one grab at a time gets to rewrite the indexes
+var archiveLock sync.Mutex
+
+type ArchiveBridge struct {
+	path      string
+	baseURL   string
+	templates *template.Template
+
+	// generateTranscript hangs onto this for the indexes
+	thread Thread
+}
+
+// Everything we know about what's been archived, so the indexes can be rebuilt
+type ArchiveManifest struct {
+	Articles []ArchiveArticle `json:"articles"`
+}
+
+type ArchiveArticle struct {
+	Slug         string           `json:"slug"`
+	Title        string           `json:"title"`
+	Channel      string           `json:"channel"`
+	Date         time.Time        `json:"date"`
+	Updated      time.Time        `json:"updated"`
+	Participants []string         `json:"participants"`
+	Sections     []ArchiveSection `json:"sections"`
+}
+
+type ArchiveSection struct {
+	Title string        `json:"title"`
+	HTML  template.HTML `json:"html"`
+	Text  string        `json:"text"` // For searching
+}
+
+type ArchiveMessage struct {
+	Author    string
+	Timestamp time.Time
+	Body      template.HTML
+	Images    []string
+	Files     []string
+}
+
+type ArchiveSearchEntry struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Channel string `json:"channel"`
+	Date    string `json:"date"`
+	Text    string `json:"text"`
+}
+
+var archiveSlugRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// The only markup messages get to keep, and the only attributes on it
+var archiveAllowedTags = map[atom.Atom][]string{
+	atom.P: nil, atom.Br: nil, atom.Hr: nil, atom.Span: nil, atom.Div: nil,
+	atom.Em: nil, atom.Strong: nil, atom.Del: nil, atom.S: nil, atom.U: nil,
+	atom.Sub: nil, atom.Sup: nil, atom.Code: {"class"}, atom.Pre: {"class"},
+	atom.Blockquote: nil, atom.Ul: nil, atom.Ol: {"start"}, atom.Li: nil,
+	atom.Dl: nil, atom.Dt: nil, atom.Dd: nil,
+	atom.H1: nil, atom.H2: nil, atom.H3: nil, atom.H4: nil, atom.H5: nil, atom.H6: nil,
+	atom.Table: nil, atom.Thead: nil, atom.Tbody: nil, atom.Tr: nil, atom.Th: nil, atom.Td: nil,
+	atom.A: {"href", "title"}, atom.Img: {"src", "alt", "title"},
+}
+
+// Links and pictures can go anywhere, as long as it's not somewhere that runs
+// code. No scheme means it's relative, which is fine.
+var archiveAllowedSchemes = []string{"", "http", "https", "mailto"}
+
+// Where everybody's archives go. This is what gets served at /archive.
+func archiveRoot() string {
+	if root := os.Getenv("ARCHIVE_PATH"); root != "" {
+		return root
+	}
+	return archiveDefaultPath
+}
+
+func NewArchiveBridge(instance Instance) (wiki ArchiveBridge, err error) {
+	// Always in with everybody else's, whatever the install form said, and
+	// always served from there
+	publicID := publicGrabID(instance.GrabID)
+	wiki.path = filepath.Join(archiveRoot(), publicID)
+	wiki.baseURL = strings.TrimSuffix(os.Getenv("GRAB_URL"), "/") + "/archive/" + publicID + "/"
+
+	wiki.templates, err = template.ParseGlob(archiveTemplateGlob)
+	if err != nil {
+		return ArchiveBridge{}, err
+	}
+	for _, dir := range []string{"pages", "channels", "images"} {
+		err = os.MkdirAll(filepath.Join(wiki.path, dir), 0755)
+		if err != nil {
+			return ArchiveBridge{}, err
+		}
+	}
+	return wiki, nil
+}
+
+func (w *ArchiveBridge) generateTranscript(thread Thread) (transcript string) {
+	w.thread = thread
+
+	var messages []ArchiveMessage
+	for _, m := range thread.Messages {
+		message := ArchiveMessage{Author: m.Author, Timestamp: m.Timestamp}
+
+		// Whatever people said, it doesn't get to put HTML on a public site.
+		// Markdown can still make javascript: links and attributes, so
+		// whatever pandoc comes up with gets cleaned up too.
+		body, err := pandocConvert(m.Text, "markdown-raw_html", "html")
+		if err == nil {
+			body, err = w.sanitizeHTML(body)
+		}
+		if err != nil {
+			log.Println("Warning: Failed to convert to HTML: ", err)
+			body = "<p>" + html.EscapeString(m.Text) + "</p>"
+		}
+		message.Body = template.HTML(body)
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				filename, err := w.uploadImage(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				message.Images = append(message.Images, filename)
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				message.Files = append(message.Files, string(fileContents))
+			}
+		}
+		messages = append(messages, message)
+	}
+
+	var output bytes.Buffer
+	err := w.templates.ExecuteTemplate(&output, "transcript.html", map[string]interface{}{
+		"Generated": time.Now(),
+		"Begins":    thread.Timestamp,
+		"Messages":  messages,
+	})
+	if err != nil {
+		log.Println("Could not render transcript: ", err)
+	}
+	return output.String()
+}
+
+// Every article is a page. Sections work the same as they do on MediaWiki,
+// they're just kept separately instead of as headings.
+func (w *ArchiveBridge) uploadArticle(title string, section string, transcript string, clobber bool) (pageURL string, err error) {
+	archiveLock.Lock()
+	defer archiveLock.Unlock()
+
+	manifest, err := w.loadManifest()
+	if err != nil {
+		return "", err
+	}
+
+	slug := w.slugify(title)
+	var article *ArchiveArticle
+	for i := range manifest.Articles {
+		if manifest.Articles[i].Slug == slug {
+			article = &manifest.Articles[i]
+		}
+	}
+	if article == nil {
+		manifest.Articles = append(manifest.Articles, ArchiveArticle{
+			Slug:    slug,
+			Title:   title,
+			Channel: w.thread.Channel,
+			Date:    w.thread.Timestamp,
+		})
+		article = &manifest.Articles[len(manifest.Articles)-1]
+	}
+	article.Updated = time.Now()
+	article.Participants = mergeUnique(article.Participants, w.thread.getNames())
+
+	newSection := ArchiveSection{Title: section, HTML: template.HTML(transcript), Text: w.searchText()}
+	existing := -1
+	for i, s := range article.Sections {
+		if section != "" && s.Title == section {
+			existing = i
+		}
+	}
+	if section == "" && clobber {
+		article.Sections = []ArchiveSection{newSection}
+		article.Date = w.thread.Timestamp
+	} else if existing >= 0 && clobber {
+		article.Sections = append(article.Sections[:existing], article.Sections[existing+1:]...)
+		article.Sections = append(article.Sections, newSection)
+	} else if existing >= 0 /* && append */ {
+		article.Sections[existing].HTML += newSection.HTML
+		article.Sections[existing].Text += " " + newSection.Text
+	} else {
+		article.Sections = append(article.Sections, newSection)
+	}
+
+	err = w.saveManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	err = w.render(manifest)
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	return w.baseURL + "pages/" + slug + ".html", nil
+}
+
+// Just copy it in with the rest of the site
+func (w *ArchiveBridge) uploadImage(path string) (filename string, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	filename = filepath.Base(path)
+	err = os.WriteFile(filepath.Join(w.path, "images", filename), contents, 0644)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// Utility Functions
+
+// Rewrite every page, every channel index, the front page, and the search
+// index. It's a static site, so there's nothing else to keep up to date.
+func (w *ArchiveBridge) render(manifest ArchiveManifest) (err error) {
+	channels := map[string][]ArchiveArticle{}
+	var search []ArchiveSearchEntry
+	for _, article := range manifest.Articles {
+		channelSlug := w.slugify(article.Channel)
+		err = w.renderFile(filepath.Join("pages", article.Slug+".html"), "page.html", map[string]interface{}{
+			"PageTitle":   article.Title,
+			"SiteTitle":   archiveSiteTitle,
+			"Root":        "../",
+			"Article":     article,
+			"ChannelSlug": channelSlug,
+		})
+		if err != nil {
+			return err
+		}
+
+		if article.Channel != "" {
+			channels[article.Channel] = append(channels[article.Channel], article)
+		}
+
+		var text []string
+		for _, section := range article.Sections {
+			text = append(text, section.Title, section.Text)
+		}
+		search = append(search, ArchiveSearchEntry{
+			Title:   article.Title,
+			URL:     "pages/" + article.Slug + ".html",
+			Channel: article.Channel,
+			Date:    article.Date.Format("2006-01-02"),
+			Text:    strings.Join(text, " "),
+		})
+	}
+
+	type channelSummary struct {
+		Name  string
+		Slug  string
+		Count int
+	}
+	var summaries []channelSummary
+	for name, articles := range channels {
+		sort.Slice(articles, func(i, j int) bool { return articles[i].Date.After(articles[j].Date) })
+		err = w.renderFile(filepath.Join("channels", w.slugify(name)+".html"), "channel.html", map[string]interface{}{
+			"PageTitle": name,
+			"SiteTitle": archiveSiteTitle,
+			"Root":      "../",
+			"Channel":   name,
+			"Articles":  articles,
+		})
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, channelSummary{Name: name, Slug: w.slugify(name), Count: len(articles)})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+
+	recent := append([]ArchiveArticle{}, manifest.Articles...)
+	sort.Slice(recent, func(i, j int) bool { return recent[i].Updated.After(recent[j].Updated) })
+	if len(recent) > 20 {
+		recent = recent[:20]
+	}
+	err = w.renderFile("index.html", "index.html", map[string]interface{}{
+		"PageTitle": archiveSiteTitle,
+		"SiteTitle": archiveSiteTitle,
+		"Root":      "",
+		"Channels":  summaries,
+		"Articles":  recent,
+	})
+	if err != nil {
+		return err
+	}
+
+	searchBytes, err := json.Marshal(search)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(w.path, "search.json"), searchBytes, 0644)
+}
+
+func (w *ArchiveBridge) renderFile(path string, name string, data interface{}) (err error) {
+	var output bytes.Buffer
+	err = w.templates.ExecuteTemplate(&output, name, data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(w.path, path), output.Bytes(), 0644)
+}
+
+func (w *ArchiveBridge) loadManifest() (manifest ArchiveManifest, err error) {
+	manifestBytes, err := os.ReadFile(filepath.Join(w.path, "archive.json"))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(manifestBytes, &manifest)
+	return manifest, err
+}
+
+func (w *ArchiveBridge) saveManifest(manifest ArchiveManifest) (err error) {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(w.path, "archive.json"), manifestBytes, 0644)
+}
+
+// Anything not in archiveAllowedTags is dropped, keeping what's inside it
+// unless it's a script or a style.
+func (w *ArchiveBridge) sanitizeHTML(body string) (string, error) {
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(body), context)
+	if err != nil {
+		return "", err
+	}
+	var output bytes.Buffer
+	for _, node := range nodes {
+		for _, clean := range w.sanitizeNode(node) {
+			err = xhtml.Render(&output, clean)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return output.String(), nil
+}
+
+func (w *ArchiveBridge) sanitizeNode(node *xhtml.Node) (clean []*xhtml.Node) {
+	if node.Type == xhtml.TextNode {
+		return []*xhtml.Node{{Type: xhtml.TextNode, Data: node.Data}}
+	}
+	if node.Type != xhtml.ElementNode || node.DataAtom == atom.Script || node.DataAtom == atom.Style {
+		return nil
+	}
+
+	var children []*xhtml.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		children = append(children, w.sanitizeNode(child)...)
+	}
+	allowed, ok := archiveAllowedTags[node.DataAtom]
+	if !ok {
+		return children
+	}
+
+	element := &xhtml.Node{Type: xhtml.ElementNode, Data: node.Data, DataAtom: node.DataAtom}
+	for _, attr := range node.Attr {
+		if attr.Namespace != "" || !slices.Contains(allowed, attr.Key) {
+			continue
+		}
+		if (attr.Key == "href" || attr.Key == "src") && !w.safeURL(attr.Val) {
+			continue
+		}
+		element.Attr = append(element.Attr, xhtml.Attribute{Key: attr.Key, Val: attr.Val})
+	}
+	for _, child := range children {
+		element.AppendChild(child)
+	}
+	return []*xhtml.Node{element}
+}
+
+func (w *ArchiveBridge) safeURL(link string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return false
+	}
+	return slices.Contains(archiveAllowedSchemes, strings.ToLower(parsed.Scheme))
+}
+
+// What people said, without any markup, for the search index
+func (w *ArchiveBridge) searchText() string {
+	var text []string
+	for _, m := range w.thread.Messages {
+		text = append(text, m.Author+": "+m.Text)
+	}
+	return strings.Join(text, " ")
+}
+
+func (w *ArchiveBridge) slugify(name string) string {
+	slug := strings.Trim(archiveSlugRegex.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		// Nothing but emoji or whatever, so make something up that sticks
+		sum := sha256.Sum256([]byte(name))
+		slug = hex.EncodeToString(sum[:])[:12]
+	}
+	return slug
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// BookStack keeps pages in chapters in books, so titles are a path like
+// "Book > Chapter > Page" (or "Book > Page"). Pages are written in markdown.
+const bookStackTitleSeparator = " > "
+
+// Anything without a book goes in here
+const bookStackDefaultBook = "Grab"
+
+type BookStackBridge struct {
+	client      *http.Client
+	url         string
+	tokenID     string
+	tokenSecret string
+
+	// Images go in the gallery, which wants a page to hang them off of. So
+	// they wait here until uploadArticle has made one.
+	pendingImages []string
+}
+
+// Books, chapters, and pages all look about the same from the API
+type BookStackEntity struct {
+	ID        int    `json:"id"`
+	BookID    int    `json:"book_id"`
+	ChapterID int    `json:"chapter_id"`
+	Name      string `json:"name"`
+	Slug      string `json:"slug"`
+	BookSlug  string `json:"book_slug"`
+	Markdown  string `json:"markdown"`
+	HTML      string `json:"html"`
+}
+
+// Where the transcript links to an image that isn't in the gallery yet
+var bookStackPendingImageRegex = regexp.MustCompile(`!\[\]\(grab-pending:([^)]+)\)`)
+
+func NewBookStackBridge(instance Instance) (wiki BookStackBridge, err error) {
+	wiki.client = &http.Client{Timeout: time.Second * 30}
+	wiki.url = strings.TrimSuffix(instance.BookStackURL, "/")
+	wiki.tokenID = instance.BookStackTokenID
+	wiki.tokenSecret = instance.BookStackTokenSecret
+
+	// Make sure the token works before we go doing anything with it
+	var books struct {
+		Total int `json:"total"`
+	}
+	err = wiki.request(http.MethodGet, "/api/books?count=1", nil, &books)
+	if err != nil {
+		return BookStackBridge{}, err
+	}
+	return wiki, nil
+}
+
+func (w *BookStackBridge) generateTranscript(thread Thread) (transcript string) {
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "Transcript generated at " + currentTime + ".\n\n"
+	transcript += "Conversation begins at " + transcriptBegin + ".\n\n"
+
+	for _, m := range thread.Messages {
+		transcript += "**" + m.Author + "**: " + strings.TrimSpace(m.Text) + "\n\n"
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				filename, err := w.uploadImage(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				transcript += fmt.Sprintf("![](grab-pending:%s)\n\n", filename)
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				transcript += "```\n" + string(fileContents) + "\n```\n\n"
+			}
+		}
+	}
+
+	return transcript
+}
+
+// Books and chapters get made if they aren't there yet. Sections are markdown
+// headings, and work the same as they do on MediaWiki.
+func (w *BookStackBridge) uploadArticle(title string, section string, transcript string, clobber bool) (pageURL string, err error) {
+	bookName, chapterName, pageName := w.splitTitle(title)
+
+	book, err := w.findOrCreate("/api/books", url.Values{}, bookName)
+	if err != nil {
+		return "", err
+	}
+	parent := map[string]interface{}{"book_id": book.ID}
+	filter := url.Values{"filter[book_id]": {strconv.Itoa(book.ID)}}
+	if chapterName != "" {
+		chapter, err := w.findOrCreate("/api/chapters", filter, chapterName)
+		if err != nil {
+			return "", err
+		}
+		parent = map[string]interface{}{"chapter_id": chapter.ID}
+		filter.Set("filter[chapter_id]", strconv.Itoa(chapter.ID))
+	} else {
+		filter.Set("filter[chapter_id]", "0")
+	}
+
+	page, found, err := w.find("/api/pages", filter, pageName)
+	if err != nil {
+		return "", err
+	}
+	existing := ""
+	if found {
+		// The list doesn't have the content in it
+		err = w.request(http.MethodGet, fmt.Sprintf("/api/pages/%d", page.ID), nil, &page)
+		if err != nil {
+			return "", err
+		}
+		existing = page.Markdown
+		// Pages made in the WYSIWYG editor don't have any markdown
+		if existing == "" && page.HTML != "" {
+			existing, err = pandocConvert(page.HTML, "html", "gfm")
+			if err != nil {
+				return "", fmt.Errorf("page %s isn't markdown, and couldn't convert it: %s", pageName, err)
+			}
+		}
+	}
+
+	body := mergeMarkdownSection(existing, section, transcript, clobber)
+	page, err = w.savePage(page.ID, found, parent, pageName, body)
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	// Now that there's a page, the pictures have somewhere to go
+	if len(w.pendingImages) > 0 {
+		uploaded := map[string]string{}
+		for _, path := range w.pendingImages {
+			imageURL, err := w.uploadGalleryImage(page.ID, path)
+			if err != nil {
+				log.Println("Could not upload image: ", err)
+			} else {
+				uploaded[filepath.Base(path)] = imageURL
+			}
+			os.Remove(path)
+		}
+		w.pendingImages = nil
+
+		body = bookStackPendingImageRegex.ReplaceAllStringFunc(body, func(link string) string {
+			filename := bookStackPendingImageRegex.FindStringSubmatch(link)[1]
+			if imageURL, ok := uploaded[filename]; ok {
+				return "![](" + imageURL + ")"
+			}
+			return ""
+		})
+		page, err = w.savePage(page.ID, true, parent, pageName, body)
+		if err != nil {
+			log.Println("Failed to add images: ", err)
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%s/books/%s/page/%s", w.url, page.BookSlug, page.Slug), nil
+}
+
+// The page might not exist yet, so hang on to the file until it does
+func (w *BookStackBridge) uploadImage(path string) (filename string, err error) {
+	w.pendingImages = append(w.pendingImages, path)
+	return filepath.Base(path), nil
+}
+
+// Utility Functions
+
+// Everything before the page name is optional
+func (w *BookStackBridge) splitTitle(title string) (book string, chapter string, page string) {
+	parts := strings.Split(title, bookStackTitleSeparator)
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	switch len(parts) {
+	case 1:
+		return bookStackDefaultBook, "", parts[0]
+	case 2:
+		return parts[0], "", parts[1]
+	default:
+		return parts[0], parts[1], strings.Join(parts[2:], bookStackTitleSeparator)
+	}
+}
+
+// Turn a "bookID/chapterID" picked in a modal into a title uploadArticle
+// understands. Chapter 0 means straight in the book.
+func (w *BookStackBridge) locationTitle(location string, page string) (title string, err error) {
+	bookID, chapterID, _ := strings.Cut(location, "/")
+
+	var book, chapter BookStackEntity
+	err = w.request(http.MethodGet, "/api/books/"+url.PathEscape(bookID), nil, &book)
+	if err != nil {
+		return "", err
+	}
+	if chapterID == "" || chapterID == "0" {
+		return book.Name + bookStackTitleSeparator + page, nil
+	}
+	err = w.request(http.MethodGet, "/api/chapters/"+url.PathEscape(chapterID), nil, &chapter)
+	if err != nil {
+		return "", err
+	}
+	return book.Name + bookStackTitleSeparator + chapter.Name + bookStackTitleSeparator + page, nil
+}
+
+// Every book, and the chapters in it, for picking where a page goes
+func (w *BookStackBridge) listLocations() (books []BookStackEntity, chapters map[int][]BookStackEntity, err error) {
+	var bookList, chapterList struct {
+		Data []BookStackEntity `json:"data"`
+	}
+	err = w.request(http.MethodGet, "/api/books?count=100&sort=%2Bname", nil, &bookList)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = w.request(http.MethodGet, "/api/chapters?count=500&sort=%2Bname", nil, &chapterList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chapters = map[int][]BookStackEntity{}
+	for _, chapter := range chapterList.Data {
+		chapters[chapter.BookID] = append(chapters[chapter.BookID], chapter)
+	}
+	return bookList.Data, chapters, nil
+}
+
+func (w *BookStackBridge) find(endpoint string, filter url.Values, name string) (entity BookStackEntity, found bool, err error) {
+	query := url.Values{"filter[name]": {name}, "count": {"1"}}
+	for key, value := range filter {
+		query[key] = value
+	}
+	var results struct {
+		Data []BookStackEntity `json:"data"`
+	}
+	err = w.request(http.MethodGet, endpoint+"?"+query.Encode(), nil, &results)
+	if err != nil {
+		return entity, false, err
+	}
+	if len(results.Data) == 0 {
+		return entity, false, nil
+	}
+	return results.Data[0], true, nil
+}
+
+func (w *BookStackBridge) findOrCreate(endpoint string, filter url.Values, name string) (entity BookStackEntity, err error) {
+	entity, found, err := w.find(endpoint, filter, name)
+	if err != nil || found {
+		return entity, err
+	}
+
+	body := map[string]interface{}{"name": name}
+	if bookID := filter.Get("filter[book_id]"); bookID != "" {
+		body["book_id"], _ = strconv.Atoi(bookID)
+	}
+	err = w.request(http.MethodPost, endpoint, body, &entity)
+	return entity, err
+}
+
+func (w *BookStackBridge) savePage(pageID int, exists bool, parent map[string]interface{}, name string, markdown string) (page BookStackEntity, err error) {
+	body := map[string]interface{}{
+		"name":     name,
+		"markdown": markdown,
+	}
+	if exists {
+		err = w.request(http.MethodPut, fmt.Sprintf("/api/pages/%d", pageID), body, &page)
+		return page, err
+	}
+	for key, value := range parent {
+		body[key] = value
+	}
+	err = w.request(http.MethodPost, "/api/pages", body, &page)
+	return page, err
+}
+
+func (w *BookStackBridge) uploadGalleryImage(pageID int, path string) (imageURL string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("type", "gallery")
+	writer.WriteField("uploaded_to", strconv.Itoa(pageID))
+	writer.WriteField("name", filepath.Base(path))
+	fw, err := writer.CreateFormFile("image", filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(fw, file)
+	if err != nil {
+		return "", err
+	}
+	writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, w.url+"/api/image-gallery", body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var image struct {
+		URL string `json:"url"`
+	}
+	err = w.do(req, &image)
+	return image.URL, err
+}
+
+func (w *BookStackBridge) request(method string, endpoint string, body interface{}, result interface{}) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, w.url+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return w.do(req, result)
+}
+
+func (w *BookStackBridge) do(req *http.Request, result interface{}) (err error) {
+	req.Header.Set("Authorization", "Token "+w.tokenID+":"+w.tokenSecret)
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("bookstack returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, result)
+}
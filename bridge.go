@@ -1,16 +1,504 @@
 package main
 
-/*
-// FIXME: Can/should I create a ChatBridge interface? Methinkso, but menoknowhow?
-// Need variadic functions? This is probably a stupid idea.
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A ChatBridge is anywhere people talk. All we really need from one is a way
+// to turn a conversation into a Thread. Every platform has its own idea of
+// what a channel and a thread are, so the IDs are whatever that platform uses.
 type ChatBridge interface {
-	getThread() Thread
-	saveImage(url string)
+	getThread(channelID string, threadID string) (thread Thread, err error)
 }
-*/
 
 type WikiBridge interface {
 	generateTranscript(thread Thread) (transcript string)
 	uploadArticle(title string, section string, transcript string, clobber bool) (url string, err error)
 	uploadImage(path string) (filename string, err error)
 }
+
+// Figure out what kind of Wiki this org has
+func newWikiBridge(instance Instance) (w WikiBridge, err error) {
+	if len(instance.MediaWikiURL) > 0 {
+		wiki, err := NewMediaWikiBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil // Forgive me father for I have sinned
+	}
+	if len(instance.ConfluenceURL) > 0 {
+		wiki, err := NewConfluenceBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	if len(instance.DokuWikiURL) > 0 {
+		wiki, err := NewDokuWikiBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	if len(instance.BookStackURL) > 0 {
+		wiki, err := NewBookStackBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	if len(instance.WikiJSURL) > 0 {
+		wiki, err := NewWikiJSBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	if len(instance.OutlineURL) > 0 {
+		wiki, err := NewOutlineBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	if len(instance.GitRepoPath) > 0 {
+		wiki, err := NewGitBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	if len(instance.SharePointSiteURL) > 0 {
+		wiki, err := NewSharePointBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	if len(instance.ArchivePath) > 0 {
+		wiki, err := NewArchiveBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+
+	if len(instance.ObsidianVaultPath) > 0 {
+		wiki, err := NewObsidianBridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+	// Just a bucket is fine too, if all they want is the raw copies
+	if len(instance.S3Bucket) > 0 {
+		wiki, err := NewS3Bridge(instance)
+		if err != nil {
+			return nil, err
+		}
+		return &wiki, nil
+	}
+
+	// Nothing else set up, so notes go in a vault on this box. Good enough for
+	// trying Grab out.
+	wiki, err := NewObsidianBridge(instance)
+	if err != nil {
+		return nil, err
+	}
+	return &wiki, nil
+}
+
+// Every install form has the same wiki fields (see templates/wiki.html). They're
+// passwords, so they only ever come from c.PostForm, never a URL.
+func setWikiCredentials(instance *Instance, get func(key string) string) {
+	switch get("wikiType") {
+	case "confluence":
+		instance.ConfluenceURL = get("confluenceURL")
+		instance.ConfluenceSpaceKey = get("confluenceSpace")
+		instance.ConfluenceUsername = get("confluenceUsername")
+		instance.ConfluenceToken = get("confluenceToken")
+	case "dokuwiki":
+		instance.DokuWikiURL = get("dokuWikiURL")
+		instance.DokuWikiUsername = get("dokuWikiUsername")
+		instance.DokuWikiPassword = get("dokuWikiPassword")
+	case "bookstack":
+		instance.BookStackURL = get("bookStackURL")
+		instance.BookStackTokenID = get("bookStackTokenID")
+		instance.BookStackTokenSecret = get("bookStackTokenSecret")
+	case "wikijs":
+		instance.WikiJSURL = get("wikiJSURL")
+		instance.WikiJSToken = get("wikiJSToken")
+	case "outline":
+		instance.OutlineURL = get("outlineURL")
+		instance.OutlineToken = get("outlineToken")
+		instance.OutlineCollection = get("outlineCollection")
+	case "git":
+		instance.GitRepoPath = get("gitRepoPath")
+		instance.GitRemote = get("gitRemote")
+		instance.GitWebURL = get("gitWebURL")
+	case "sharepoint":
+		instance.SharePointSiteURL = get("sharePointSiteURL")
+		instance.SharePointTenantID = get("sharePointTenantID")
+		instance.SharePointClientID = get("sharePointClientID")
+		instance.SharePointClientSecret = get("sharePointClientSecret")
+	case "obsidian":
+		instance.ObsidianVaultPath = get("obsidianVaultPath")
+	case "archive":
+		// We serve it ourselves. The path is just so we know it's picked.
+		instance.ArchivePath = filepath.Join(archiveRoot(), publicGrabID(instance.GrabID))
+	case "s3":
+		// Nothing but the bucket below
+	default:
+		instance.MediaWikiUname = get("username")
+		instance.MediaWikiPword = get("password")
+		instance.MediaWikiURL = get("url")
+	}
+
+	// A bucket for raw copies can go with any of them
+	instance.S3Endpoint = get("s3Endpoint")
+	instance.S3Region = get("s3Region")
+	instance.S3Bucket = get("s3Bucket")
+	instance.S3AccessKeyID = get("s3AccessKeyID")
+	instance.S3SecretAccessKey = get("s3SecretAccessKey")
+
+	// So does a forge to grab issues from
+	instance.ForgeToken = get("forgeToken")
+	if instance.ForgeToken != "" {
+		instance.ForgeAPIURL = get("forgeAPIURL")
+		if instance.ForgeAPIURL == "" {
+			instance.ForgeAPIURL = forgeDefaultAPIURL
+		}
+	}
+}
+
+// Post a Thread to whatever wiki the instance has set up
+func publishThread(instance Instance, thread Thread, articleTitle string, sectionTitle string, clobber bool) (url string, err error) {
+	if len(thread.Messages) == 0 {
+		return "", errors.New("thread has no messages")
+	}
+
+	// If we didn't get a title, then grab and truncate the first message
+	if len(articleTitle) == 0 {
+		articleTitle = thread.getTitle()
+	}
+
+	// Keep track of how it went, for "/grab status"
+	defer func() {
+		grabLog := GrabLog{
+			GrabID:    instance.GrabID,
+			Channel:   thread.Channel,
+			Article:   articleTitle,
+			Section:   sectionTitle,
+			URL:       url,
+			CreatedAt: time.Now(),
+		}
+		if err != nil {
+			grabLog.Error = err.Error()
+		}
+		logErr := insertGrabLog(db, &grabLog)
+		if logErr != nil {
+			log.Println("Could not log grab: ", logErr)
+		}
+	}()
+
+	w, err := newWikiBridge(instance)
+	if err != nil {
+		return "", err
+	}
+
+	// If there's a bucket as well as a wiki, it gets a raw copy. It has to go
+	// first, since the wiki throws the files out when it's done with them.
+	var raw *S3Bridge
+	if _, bucketOnly := w.(*S3Bridge); len(instance.S3Bucket) > 0 && !bucketOnly {
+		bucket, err := NewS3Bridge(instance)
+		if err != nil {
+			return "", err
+		}
+		raw = &bucket
+		raw.keepFiles = true
+		raw.generateTranscript(thread)
+	}
+
+	transcript := w.generateTranscript(thread)
+	url, err = w.uploadArticle(articleTitle, sectionTitle, transcript, clobber)
+	if raw == nil {
+		return url, err
+	}
+
+	// The attachments are already in the bucket, so the record goes in even
+	// if the wiki didn't work out
+	wikiErr := err
+	raw.wikiURL = url
+	if wikiErr != nil {
+		raw.wikiError = wikiErr.Error()
+	}
+	_, err = raw.uploadArticle(articleTitle, sectionTitle, transcript, clobber)
+	if wikiErr != nil {
+		if err != nil {
+			log.Println("Could not keep a copy in the bucket: ", err)
+		}
+		return url, wikiErr
+	}
+	if err != nil {
+		return url, fmt.Errorf("saved to %s, but could not keep a copy in the bucket: %s", url, err)
+	}
+	return url, nil
+}
+
+// Grab a conversation from any chat platform and publish it
+func archiveThread(chat ChatBridge, instance Instance, channelID string, threadID string, articleTitle string, sectionTitle string, clobber bool) (url string, err error) {
+	thread, err := chat.getThread(channelID, threadID)
+	if err != nil {
+		return "", err
+	}
+	if len(thread.Channel) == 0 {
+		thread.Channel = channelID
+	}
+	return publishThread(instance, thread, articleTitle, sectionTitle, clobber)
+}
+
+// What to call the wiki, for telling people about it
+func wikiName(w WikiBridge) string {
+	switch w.(type) {
+	case *MediaWikiBridge:
+		return "MediaWiki"
+	case *ConfluenceBridge:
+		return "Confluence"
+	case *DokuWikiBridge:
+		return "DokuWiki"
+	case *BookStackBridge:
+		return "BookStack"
+	case *WikiJSBridge:
+		return "Wiki.js"
+	case *OutlineBridge:
+		return "Outline"
+	case *GitBridge:
+		return "a git repository"
+	case *SharePointBridge:
+		return "SharePoint"
+	case *ArchiveBridge:
+		return "a static HTML archive"
+	case *ObsidianBridge:
+		return "an Obsidian vault"
+	case *S3Bridge:
+		return "an S3 bucket"
+	default:
+		return "your wiki"
+	}
+}
+
+// The Grab ID is a password, so it can't go anywhere other people can see it,
+// like a URL or an object key. This can.
+func publicGrabID(grabID string) string {
+	sum := sha256.Sum256([]byte("grab-archive:" + grabID))
+	return hex.EncodeToString(sum[:])[:20]
+}
+
+// Somewhere under root, wherever path says. The install forms are open to
+// anybody, so nothing typed into one gets to pick where on the server we
+// write.
+func confinePath(root string, path string) (string, error) {
+	fullPath := filepath.Join(root, filepath.Clean("/"+path))
+	relPath, err := filepath.Rel(root, fullPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", path, root)
+	}
+	return fullPath, nil
+}
+
+// Dump a file from some chat platform into /tmp/grab so the wiki bridges can
+// find it later
+func saveTempFile(r io.Reader, extension string) (path string, err error) {
+	path = fmt.Sprintf("/tmp/grab/%s.%s", uuid.New(), extension)
+	tempFile, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+
+	_, err = io.Copy(tempFile, r)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// Pandoc knows how to turn just about anything into anything else
+func pandocConvert(input string, from string, to string) (output string, err error) {
+	// Create a buffer to store the command output
+	var outputBuffer bytes.Buffer
+
+	cmd := exec.Command("pandoc", "-f", from, "-t", to)
+	cmd.Stdin = bytes.NewBufferString(input)
+	cmd.Stdout = &outputBuffer
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("failed to run Pandoc: %v", err)
+	}
+
+	return outputBuffer.String(), nil
+}
+
+var markdownHeadingRegex = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+
+// Wikis that store markdown all do sections the same way as MediaWiki. No
+// section means the whole page, and clobbering a section moves it to the end.
+func mergeMarkdownSection(existing string, section string, transcript string, clobber bool) (body string) {
+	existing = strings.TrimRight(existing, "\n")
+	if section == "" {
+		if clobber || existing == "" {
+			return transcript
+		}
+		return existing + "\n\n" + transcript
+	}
+
+	heading := "## " + section + "\n\n"
+	start, end, exists := findMarkdownSection(existing, section)
+	if exists && clobber {
+		body = strings.TrimRight(existing[:start]+existing[end:], "\n")
+		return strings.TrimLeft(body+"\n\n"+heading+transcript, "\n")
+	} else if exists /* && append */ {
+		return strings.TrimRight(existing[:end], "\n") + "\n\n" + strings.TrimRight(transcript, "\n") + "\n\n" + strings.TrimLeft(existing[end:], "\n")
+	}
+	return strings.TrimLeft(existing+"\n\n"+heading+transcript, "\n")
+}
+
+// Find where a section starts and ends, by byte offset. It ends wherever the
+// next heading of the same level (or bigger) starts.
+func findMarkdownSection(text string, section string) (start int, end int, exists bool) {
+	offset := 0
+	level := 0
+	inCode := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineStart := offset
+		offset += len(line)
+
+		// A "# comment" in a code block isn't a heading
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+
+		match := markdownHeadingRegex.FindStringSubmatch(strings.TrimRight(line, "\n"))
+		if match == nil {
+			continue
+		}
+		if exists && len(match[1]) <= level {
+			return start, lineStart, true
+		}
+		if !exists && match[2] == section {
+			start = lineStart
+			level = len(match[1])
+			exists = true
+		}
+	}
+	return start, len(text), exists
+}
+
+// What goes at the top of markdown files, for the bridges that write files.
+// We only ever read back what we wrote, so this is nowhere near all of YAML.
+type FrontMatter struct {
+	Title        string
+	Channel      string
+	Date         string
+	Participants []string
+	Tags         []string
+}
+
+func parseFrontMatter(text string) (frontMatter FrontMatter, body string) {
+	if !strings.HasPrefix(text, "---\n") {
+		return frontMatter, text
+	}
+	header, body, found := strings.Cut(strings.TrimPrefix(text, "---\n"), "\n---\n")
+	if !found {
+		return frontMatter, text
+	}
+
+	list := ""
+	for _, line := range strings.Split(header, "\n") {
+		if strings.HasPrefix(line, "  - ") {
+			item := unquoteYAML(strings.TrimPrefix(line, "  - "))
+			switch list {
+			case "participants":
+				frontMatter.Participants = append(frontMatter.Participants, item)
+			case "tags":
+				frontMatter.Tags = append(frontMatter.Tags, item)
+			}
+			continue
+		}
+		key, value, _ := strings.Cut(line, ":")
+		value = unquoteYAML(strings.TrimSpace(value))
+		list = key
+		switch key {
+		case "title":
+			frontMatter.Title = value
+		case "channel":
+			frontMatter.Channel = value
+		case "date":
+			frontMatter.Date = value
+		}
+	}
+	return frontMatter, strings.TrimLeft(body, "\n")
+}
+
+func formatFrontMatter(frontMatter FrontMatter) string {
+	header := "---\n"
+	header += "title: " + strconv.Quote(frontMatter.Title) + "\n"
+	header += "channel: " + strconv.Quote(frontMatter.Channel) + "\n"
+	header += "date: " + frontMatter.Date + "\n"
+	header += "participants:\n"
+	for _, name := range frontMatter.Participants {
+		header += "  - " + strconv.Quote(name) + "\n"
+	}
+	if len(frontMatter.Tags) > 0 {
+		header += "tags:\n"
+		for _, tag := range frontMatter.Tags {
+			header += "  - " + strconv.Quote(tag) + "\n"
+		}
+	}
+	return header + "---\n\n"
+}
+
+// Double quoted YAML is close enough to a Go string
+func unquoteYAML(value string) string {
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return value
+	}
+	return unquoted
+}
+
+// Everything in both, once, sorted
+func mergeUnique(existing []string, more []string) []string {
+	seen := map[string]bool{}
+	var merged []string
+	for _, item := range append(existing, more...) {
+		if !seen[item] {
+			seen[item] = true
+			merged = append(merged, item)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Some things don't come from a chat bot at all. Those get run from the
+// command line instead of the server, like `grab import-slack-export ...`
+var commands = map[string]func(args []string) error{
+	"import-slack-export": importSlackExportCmd,
+	"import-mail":         importMailCmd,
+	"import-irc":          importIRCCmd,
+}
+
+func runCommand(args []string) {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s. Available commands:\n", args[0])
+		for name := range commands {
+			fmt.Fprintf(os.Stderr, "  %s\n", name)
+		}
+		os.Exit(2)
+	}
+
+	err := command(args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Importers publish to whatever wiki an existing instance is set up with
+func commandInstance(grabID string) (instance Instance, err error) {
+	if grabID == "" {
+		return instance, fmt.Errorf("-grab-id is required")
+	}
+	instance, err = selectInstance(db, grabID)
+	if err != nil {
+		return instance, fmt.Errorf("could not find instance %s: %s", grabID, err)
+	}
+	return instance, nil
+}
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Remembers what we've already published, so a big import can pick up where
+// it left off.
+type ImportState struct {
+	path string
+	Done map[string]string `json:"done"` // Key -> URL
+}
+
+func loadImportState(statePath string) (state *ImportState, err error) {
+	state = &ImportState{path: statePath, Done: map[string]string{}}
+	contents, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, state)
+	return state, err
+}
+
+func (s *ImportState) markDone(key string, url string) error {
+	s.Done[key] = url
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write it somewhere else first so getting killed mid-write doesn't eat it
+	err = os.WriteFile(s.path+".tmp", contents, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+func importSlackExportCmd(args []string) (err error) {
+	flags := flag.NewFlagSet("import-slack-export", flag.ExitOnError)
+	grabID := flags.String("grab-id", "", "Instance whose wiki we publish to")
+	channelList := flags.String("channels", "", "Comma-separated channels to import (default: all of them)")
+	threadList := flags.String("threads", "", "Comma-separated threads to import, as channel/ts")
+	article := flags.String("article", "", "Article to put everything in (default: one per channel)")
+	statePath := flags.String("state", "", "Where to remember progress (default: next to the export)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: grab import-slack-export [flags] <export.zip>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	zipPath := flags.Arg(0)
+
+	instance, err := commandInstance(*grabID)
+	if err != nil {
+		return err
+	}
+
+	export, err := OpenSlackExport(zipPath)
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+
+	if *statePath == "" {
+		*statePath = strings.TrimSuffix(zipPath, filepath.Ext(zipPath)) + ".grab-state.json"
+	}
+	state, err := loadImportState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	// Figure out what we're importing
+	channels := splitList(*channelList)
+	threads := splitList(*threadList)
+	for _, thread := range threads {
+		channel, _, _ := strings.Cut(thread, "/")
+		channels = append(channels, channel)
+	}
+	if len(channels) == 0 {
+		for _, channel := range export.channels {
+			channels = append(channels, channel.Name)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, channel := range channels {
+		if seen[channel] {
+			continue
+		}
+		seen[channel] = true
+
+		exportThreads, err := export.getThreads(channel)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range exportThreads {
+			if len(threads) > 0 && !slices.Contains(threads, t.Key) {
+				continue
+			}
+			if url, ok := state.Done[t.Key]; ok {
+				log.Printf("Skipping %s, already at %s\n", t.Key, url)
+				continue
+			}
+
+			articleTitle := *article
+			if articleTitle == "" {
+				articleTitle = t.Channel
+			}
+			thread := export.conversationToThread(t.messages)
+			url, err := publishThread(instance, thread, articleTitle, t.Section, false)
+			if err != nil {
+				return fmt.Errorf("could not publish %s (rerun to pick up from here): %s", t.Key, err)
+			}
+			log.Printf("Published %s to %s\n", t.Key, url)
+
+			err = state.markDone(t.Key, url)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func importMailCmd(args []string) (err error) {
+	flags := flag.NewFlagSet("import-mail", flag.ExitOnError)
+	grabID := flags.String("grab-id", "", "Instance whose wiki we publish to")
+	article := flags.String("article", "", "Article to put everything in (default: one per thread, named after its subject)")
+	threadList := flags.String("threads", "", "Comma-separated Message-IDs of thread roots to import (default: all of them)")
+	statePath := flags.String("state", "", "Where to remember progress (default: next to the archive)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: grab import-mail [flags] <mbox file or Maildir>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	archivePath := strings.TrimSuffix(flags.Arg(0), "/")
+
+	instance, err := commandInstance(*grabID)
+	if err != nil {
+		return err
+	}
+
+	archive, err := OpenMailArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	if *statePath == "" {
+		*statePath = archivePath + ".grab-state.json"
+	}
+	state, err := loadImportState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	threads := splitList(*threadList)
+	for _, t := range archive.getThreads() {
+		if len(threads) > 0 && !slices.Contains(threads, t.RootID) {
+			continue
+		}
+		if url, ok := state.Done[t.RootID]; ok {
+			log.Printf("Skipping %s, already at %s\n", t.RootID, url)
+			continue
+		}
+
+		// Each thread gets its own article, unless they're all going into
+		// one, in which case each thread is a section.
+		articleTitle := *article
+		sectionTitle := ""
+		if articleTitle == "" {
+			articleTitle = t.Subject
+		} else {
+			sectionTitle = t.Subject
+		}
+
+		thread := archive.conversationToThread(t)
+		url, err := publishThread(instance, thread, articleTitle, sectionTitle, false)
+		if err != nil {
+			return fmt.Errorf("could not publish %s (rerun to pick up from here): %s", t.RootID, err)
+		}
+		log.Printf("Published %s to %s\n", t.RootID, url)
+
+		err = state.markDone(t.RootID, url)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func importIRCCmd(args []string) (err error) {
+	flags := flag.NewFlagSet("import-irc", flag.ExitOnError)
+	grabID := flags.String("grab-id", "", "Instance whose wiki we publish to")
+	article := flags.String("article", "", "Article to publish to (default: the first message)")
+	section := flags.String("section", "", "Section to publish to")
+	clobber := flags.Bool("clobber", false, "Overwrite whatever's already in the article/section")
+	from := flags.String("from", "", "Start of the window to grab, as YYYY-MM-DD HH:MM")
+	to := flags.String("to", "", "End of the window to grab, as YYYY-MM-DD HH:MM")
+	nicks := flags.String("nicks", "", "Comma-separated nicks to grab (default: everyone)")
+	date := flags.String("date", "", "Day the log starts on, as YYYY-MM-DD, if the timestamps don't say (default: from the filename)")
+	timePattern := flags.String("time-pattern", "", "Regex matching the timestamp at the start of each line, with a group around the timestamp itself")
+	timeLayout := flags.String("time-layout", "", "Go time layout for the timestamp, like 15:04:05")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: grab import-irc [flags] <log file>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	logPath := flags.Arg(0)
+
+	instance, err := commandInstance(*grabID)
+	if err != nil {
+		return err
+	}
+
+	slice, err := NewIRCLogSlice(*from, *to, *nicks)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	thread, err := ircLogToThread(file, logPath, *date, *timePattern, *timeLayout, slice)
+	if err != nil {
+		return err
+	}
+
+	url, err := publishThread(instance, thread, *article, *section, *clobber)
+	if err != nil {
+		return err
+	}
+	log.Printf("Published %d messages to %s\n", len(thread.Messages), url)
+	return nil
+}
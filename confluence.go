@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Confluence Server/Data Center (Cloud works too, with a username and API
+// token). Pages are stored as XHTML, so that's what transcripts are made of.
+type ConfluenceBridge struct {
+	client   *http.Client
+	url      string
+	spaceKey string
+	username string
+	token    string
+
+	// Attachments can only go on a page that exists, so images wait here
+	// until uploadArticle has made one.
+	pendingAttachments []string
+}
+
+type ConfluencePage struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Version struct {
+		Number int `json:"number"`
+	} `json:"version"`
+	Body struct {
+		Storage struct {
+			Value string `json:"value"`
+		} `json:"storage"`
+	} `json:"body"`
+	Links struct {
+		Base  string `json:"base"`
+		WebUI string `json:"webui"`
+	} `json:"_links"`
+}
+
+var confluenceHeadingRegex = regexp.MustCompile(`(?s)<h([1-6])[^>]*>(.*?)</h[1-6]>`)
+var confluenceTagRegex = regexp.MustCompile(`<[^>]+>`)
+
+func NewConfluenceBridge(instance Instance) (wiki ConfluenceBridge, err error) {
+	wiki.client = &http.Client{Timeout: time.Second * 30}
+	wiki.url = strings.TrimSuffix(instance.ConfluenceURL, "/")
+	wiki.spaceKey = instance.ConfluenceSpaceKey
+	wiki.username = instance.ConfluenceUsername
+	wiki.token = instance.ConfluenceToken
+
+	// Make sure we can actually get into the space
+	var space struct {
+		Key string `json:"key"`
+	}
+	err = wiki.request(http.MethodGet, "/rest/api/space/"+url.PathEscape(wiki.spaceKey), nil, &space)
+	if err != nil {
+		return ConfluenceBridge{}, err
+	}
+	return wiki, nil
+}
+
+func (w *ConfluenceBridge) generateTranscript(thread Thread) (transcript string) {
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "<p>Transcript generated at " + currentTime + ".</p>"
+	transcript += "<p>Conversation begins at " + transcriptBegin + ".</p>"
+
+	for _, m := range thread.Messages {
+		author := "<strong>" + html.EscapeString(m.Author) + ":</strong> "
+		body, err := pandocConvert(m.Text, "markdown", "html")
+		if err != nil || strings.TrimSpace(body) == "" {
+			if err != nil {
+				log.Println("Warning: Failed to convert to Confluence storage format: ", err)
+			}
+			body = "<p>" + html.EscapeString(m.Text) + "</p>"
+		}
+		// Put the name in the first paragraph, like "Author: text"
+		if strings.HasPrefix(body, "<p>") {
+			transcript += "<p>" + author + strings.TrimPrefix(body, "<p>")
+		} else {
+			transcript += "<p>" + author + "</p>" + body
+		}
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				filename, err := w.uploadImage(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				transcript += fmt.Sprintf(`<p><ac:image><ri:attachment ri:filename="%s" /></ac:image></p>`, html.EscapeString(filename))
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				// CDATA can't have "]]>" in it, so split it across two
+				contents := strings.ReplaceAll(string(fileContents), "]]>", "]]]]><![CDATA[>")
+				transcript += `<ac:structured-macro ac:name="code"><ac:plain-text-body><![CDATA[` + contents + `]]></ac:plain-text-body></ac:structured-macro>`
+			}
+		}
+	}
+
+	return transcript
+}
+
+// Same deal as MediaWiki. No section means the whole page, and sections are
+// headings. Clobbering a section moves it to the end of the page.
+func (w *ConfluenceBridge) uploadArticle(title string, section string, transcript string, clobber bool) (pageURL string, err error) {
+	page, found, err := w.getPage(title)
+	if err != nil {
+		return "", err
+	}
+	existing := page.Body.Storage.Value
+
+	var body string
+	if section == "" {
+		if clobber {
+			body = transcript
+		} else {
+			body = existing + transcript
+		}
+	} else {
+		heading := "<h2>" + html.EscapeString(section) + "</h2>"
+		start, end, exists := w.findSection(existing, section)
+		if exists && clobber {
+			body = existing[:start] + existing[end:] + heading + transcript
+		} else if exists /* && append */ {
+			body = existing[:end] + transcript + existing[end:]
+		} else {
+			body = existing + heading + transcript
+		}
+	}
+
+	content := map[string]interface{}{
+		"type":  "page",
+		"title": title,
+		"space": map[string]string{"key": w.spaceKey},
+		"body": map[string]interface{}{
+			"storage": map[string]string{
+				"value":          body,
+				"representation": "storage",
+			},
+		},
+	}
+	if found {
+		content["id"] = page.ID
+		content["version"] = map[string]interface{}{
+			"number":  page.Version.Number + 1,
+			"message": "Grab uploadArticle section " + section,
+		}
+		err = w.request(http.MethodPut, "/rest/api/content/"+page.ID, content, &page)
+	} else {
+		err = w.request(http.MethodPost, "/rest/api/content", content, &page)
+	}
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	// Now that there's a page, the pictures have somewhere to go
+	for _, path := range w.pendingAttachments {
+		err = w.uploadAttachment(page.ID, path)
+		if err != nil {
+			log.Println("Could not upload attachment: ", err)
+		}
+		os.Remove(path)
+	}
+	w.pendingAttachments = nil
+
+	base := page.Links.Base
+	if base == "" {
+		base = w.url
+	}
+	return base + page.Links.WebUI, nil
+}
+
+// The page might not exist yet, so hang on to the file until it does.
+// Attachments are named after the file, which is already a UUID.
+func (w *ConfluenceBridge) uploadImage(path string) (filename string, err error) {
+	w.pendingAttachments = append(w.pendingAttachments, path)
+	return filepath.Base(path), nil
+}
+
+// Utility Functions
+
+func (w *ConfluenceBridge) getPage(title string) (page ConfluencePage, found bool, err error) {
+	query := url.Values{
+		"spaceKey": {w.spaceKey},
+		"title":    {title},
+		"type":     {"page"},
+		"expand":   {"body.storage,version"},
+	}
+	var results struct {
+		Results []ConfluencePage `json:"results"`
+	}
+	err = w.request(http.MethodGet, "/rest/api/content?"+query.Encode(), nil, &results)
+	if err != nil {
+		return page, false, err
+	}
+	if len(results.Results) == 0 {
+		return page, false, nil
+	}
+	return results.Results[0], true, nil
+}
+
+// Find where a section starts and ends. It ends wherever the next heading of
+// the same level (or bigger) starts.
+func (w *ConfluenceBridge) findSection(body string, section string) (start int, end int, exists bool) {
+	headings := confluenceHeadingRegex.FindAllStringSubmatchIndex(body, -1)
+	for i, heading := range headings {
+		text := html.UnescapeString(confluenceTagRegex.ReplaceAllString(body[heading[4]:heading[5]], ""))
+		if strings.TrimSpace(text) != section {
+			continue
+		}
+
+		level := body[heading[2]:heading[3]]
+		for _, next := range headings[i+1:] {
+			if body[next[2]:next[3]] <= level {
+				return heading[0], next[0], true
+			}
+		}
+		return heading[0], len(body), true
+	}
+	return 0, 0, false
+}
+
+func (w *ConfluenceBridge) uploadAttachment(pageID string, path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("minorEdit", "true")
+	writer.WriteField("comment", "Attachment from Grab.")
+	fw, err := writer.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, file)
+	if err != nil {
+		return err
+	}
+	writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, w.url+"/rest/api/content/"+url.PathEscape(pageID)+"/child/attachment", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	// Confluence won't take uploads without this
+	req.Header.Set("X-Atlassian-Token", "nocheck")
+	return w.do(req, nil)
+}
+
+func (w *ConfluenceBridge) request(method string, endpoint string, body interface{}, result interface{}) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, w.url+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return w.do(req, result)
+}
+
+// Server and Data Center use personal access tokens. Cloud wants a username
+// along with its API token.
+func (w *ConfluenceBridge) do(req *http.Request, result interface{}) (err error) {
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("confluence returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, result)
+}
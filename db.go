@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"time"
 
 	"github.com/uptrace/bun"
 )
@@ -17,6 +21,124 @@ type Instance struct {
 	MediaWikiURL     string
 	MediaWikiUname   string
 	MediaWikiPword   string
+
+	ConfluenceURL      string
+	ConfluenceSpaceKey string
+	ConfluenceUsername string
+	ConfluenceToken    string
+
+	DokuWikiURL      string
+	DokuWikiUsername string
+	DokuWikiPassword string
+
+	BookStackURL         string
+	BookStackTokenID     string
+	BookStackTokenSecret string
+
+	WikiJSURL   string
+	WikiJSToken string
+
+	OutlineURL        string
+	OutlineToken      string
+	OutlineCollection string
+
+	GitRepoPath string
+	GitRemote   string
+	GitWebURL   string
+
+	ObsidianVaultPath string
+
+	ArchivePath string
+
+	SharePointSiteURL      string
+	SharePointTenantID     string
+	SharePointClientID     string
+	SharePointClientSecret string
+
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	// Where the "Grab an issue" shortcut reads from
+	ForgeAPIURL string
+	ForgeToken  string
+
+	DiscordGuildID      string
+	DiscordAccessToken  string
+	DiscordRefreshToken string
+
+	MatrixHomeserverURL string
+	MatrixUserID        string
+	MatrixAccessToken   string
+
+	ZulipURL          string
+	ZulipBotEmail     string
+	ZulipAPIKey       string
+	ZulipWebhookToken string
+
+	MattermostURL         string
+	MattermostTeamID      string
+	MattermostAccessToken string
+	MattermostActionToken string
+
+	TeamsTenantID string
+	TeamsLinkCode string // Until somebody in the tenant sends it to Grab
+
+	// Reacting with this grabs a Slack thread. Nobody in the list means
+	// anybody can.
+	SlackGrabReaction      string
+	SlackGrabReactionUsers string // Comma separated user IDs
+
+	TelegramBotToken      string
+	TelegramBotUsername   string
+	TelegramWebhookSecret string
+}
+
+// Telegram bots can't read history, so we keep our own copy of every message
+// the bot sees. Files are just IDs until someone grabs them.
+type TelegramMessage struct {
+	GrabID    string `bun:",pk"`
+	ChatID    int64  `bun:",pk"`
+	MessageID int64  `bun:",pk"`
+	TopicID   int64
+	ReplyToID int64
+	TopicName string // Only set on the message that started a forum topic
+	Author    string
+	Date      time.Time
+	Text      string
+	FileID    string
+	FileName  string
+}
+
+// Every grab, whether it worked or not, for "/grab status"
+type GrabLog struct {
+	ID        int64 `bun:",pk,autoincrement"`
+	GrabID    string
+	Channel   string
+	Article   string
+	Section   string
+	URL       string
+	Error     string
+	CreatedAt time.Time
+}
+
+// Threads that have been grabbed with a reaction, so reacting again (or two
+// people reacting at once) doesn't grab them twice
+type SlackReactionGrab struct {
+	GrabID    string `bun:",pk"`
+	ChannelID string `bun:",pk"`
+	ThreadTS  string `bun:",pk"`
+	CreatedAt time.Time
+}
+
+// What "/grab config" sets up for a channel
+type ChannelSettings struct {
+	GrabID         string `bun:",pk"`
+	ChannelID      string `bun:",pk"`
+	DefaultArticle string
+	DefaultSection string
 }
 
 // Check if we need to initialize the database, and do so if that's the case
@@ -34,17 +156,80 @@ func initDB(db *bun.DB) (err error) {
 		panic(err)
 	}
 
+	err = migrateTable(ctx, db, instance)
+	if err != nil {
+		panic(err)
+	}
+
+	telegramMessage := new(TelegramMessage)
+	_, err = db.NewCreateTable().Model(telegramMessage).IfNotExists().Exec(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = migrateTable(ctx, db, telegramMessage)
+	if err != nil {
+		panic(err)
+	}
+
+	grabLog := new(GrabLog)
+	_, err = db.NewCreateTable().Model(grabLog).IfNotExists().Exec(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = migrateTable(ctx, db, grabLog)
+	if err != nil {
+		panic(err)
+	}
+
+	slackReactionGrab := new(SlackReactionGrab)
+	_, err = db.NewCreateTable().Model(slackReactionGrab).IfNotExists().Exec(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = migrateTable(ctx, db, slackReactionGrab)
+	if err != nil {
+		panic(err)
+	}
+
+	channelSettings := new(ChannelSettings)
+	_, err = db.NewCreateTable().Model(channelSettings).IfNotExists().Exec(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = migrateTable(ctx, db, channelSettings)
+	if err != nil {
+		panic(err)
+	}
+
 	return nil
 }
 
-// Should only return one instance
-func selectInstance(db *bun.DB, grabID string) (instance *Instance) {
-	instance = new(Instance)
-	db.NewSelect().
-		Model(instance).
-		Where("grab_id = ?", grabID)
+// CreateTable won't touch a table that already exists, so every time we
+// learn to talk to something new, older databases would be missing the
+// columns for it. Add whatever isn't there yet.
+func migrateTable(ctx context.Context, db *bun.DB, model interface{}) (err error) {
+	table := db.Table(reflect.TypeOf(model).Elem())
+	for _, field := range table.Fields {
+		_, err = db.NewAddColumn().
+			Model(model).
+			IfNotExists().
+			ColumnExpr("? "+field.CreateTableSQLType, bun.Ident(field.Name)).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return instance
+// Should only return one instance
+func selectInstance(db *bun.DB, grabID string) (instance Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instance).Where("grab_id = ?", grabID).Scan(ctx)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
 }
 
 func selectInstanceByTeamID(db *bun.DB, teamID string) (instance Instance, err error) {
@@ -56,6 +241,90 @@ func selectInstanceByTeamID(db *bun.DB, teamID string) (instance Instance, err e
 	return instance, nil
 }
 
+func selectInstanceByDiscordGuildID(db *bun.DB, guildID string) (instance Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instance).Where("discord_guild_id = ?", guildID).Scan(ctx)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+func selectInstanceByZulipToken(db *bun.DB, token string) (instance Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instance).Where("zulip_webhook_token = ?", token).Scan(ctx)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+func selectInstanceByMattermostTeamID(db *bun.DB, teamID string) (instance Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instance).Where("mattermost_team_id = ?", teamID).Scan(ctx)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+func selectInstanceByTeamsTenantID(db *bun.DB, tenantID string) (instance Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instance).Where("teams_tenant_id = ?", tenantID).Scan(ctx)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+func selectInstanceByTeamsLinkCode(db *bun.DB, code string) (instance Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instance).Where("teams_link_code = ?", code).Where("teams_link_code != ''").Scan(ctx)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+// A tenant only goes to one install, so whichever linked it last wins
+func linkTeamsTenant(db *bun.DB, grabID string, tenantID string) (err error) {
+	ctx := context.Background()
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model((*Instance)(nil)).
+			Set("teams_tenant_id = ''").
+			Where("teams_tenant_id = ?", tenantID).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().Model((*Instance)(nil)).
+			Set("teams_tenant_id = ?", tenantID).
+			Set("teams_link_code = ''").
+			Where("grab_id = ?", grabID).
+			Exec(ctx)
+		return err
+	})
+}
+
+func selectInstanceByTelegramSecret(db *bun.DB, secret string) (instance Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instance).Where("telegram_webhook_secret = ?", secret).Scan(ctx)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+// Every instance that needs a Matrix bot running
+func selectMatrixInstances(db *bun.DB) (instances []Instance, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&instances).Where("matrix_access_token != ''").Scan(ctx)
+	if err != nil {
+		return instances, err
+	}
+	return instances, nil
+}
+
 // Add a new instance
 func insertInstance(db *bun.DB, instance *Instance) (err error) {
 	ctx := context.Background()
@@ -85,3 +354,130 @@ func deleteInstance(db *bun.DB, teamID string) (err error) {
 	}
 	return nil
 }
+
+// Save a Telegram message, or update it if someone edited it
+func upsertTelegramMessage(db *bun.DB, message *TelegramMessage) (err error) {
+	ctx := context.Background()
+	_, err = db.NewInsert().
+		Model(message).
+		On("CONFLICT (grab_id, chat_id, message_id) DO UPDATE").
+		Set("text = EXCLUDED.text").
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func selectTelegramMessage(db *bun.DB, grabID string, chatID int64, messageID int64) (message TelegramMessage, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&message).
+		Where("grab_id = ?", grabID).
+		Where("chat_id = ?", chatID).
+		Where("message_id = ?", messageID).
+		Scan(ctx)
+	if err != nil {
+		return message, err
+	}
+	return message, nil
+}
+
+// Everything in a chat (or one topic of it) from some point on
+func selectTelegramMessages(db *bun.DB, grabID string, chatID int64, topicID int64, since time.Time) (messages []TelegramMessage, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&messages).
+		Where("grab_id = ?", grabID).
+		Where("chat_id = ?", chatID).
+		Where("topic_id = ?", topicID).
+		Where("date >= ?", since).
+		Order("date", "message_id").
+		Scan(ctx)
+	if err != nil {
+		return messages, err
+	}
+	return messages, nil
+}
+
+func insertGrabLog(db *bun.DB, grabLog *GrabLog) (err error) {
+	ctx := context.Background()
+	_, err = db.NewInsert().Model(grabLog).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// The most recent grabs first
+func selectGrabLogs(db *bun.DB, grabID string, channel string, limit int) (grabLogs []GrabLog, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&grabLogs).
+		Where("grab_id = ?", grabID).
+		Where("channel = ?", channel).
+		Order("created_at DESC").
+		Limit(limit).
+		Scan(ctx)
+	if err != nil {
+		return grabLogs, err
+	}
+	return grabLogs, nil
+}
+
+// Channels that were never set up just get empty settings
+func selectChannelSettings(db *bun.DB, grabID string, channelID string) (settings ChannelSettings, err error) {
+	ctx := context.Background()
+	err = db.NewSelect().Model(&settings).
+		Where("grab_id = ?", grabID).
+		Where("channel_id = ?", channelID).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChannelSettings{GrabID: grabID, ChannelID: channelID}, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+func upsertChannelSettings(db *bun.DB, settings *ChannelSettings) (err error) {
+	ctx := context.Background()
+	_, err = db.NewInsert().
+		Model(settings).
+		On("CONFLICT (grab_id, channel_id) DO UPDATE").
+		Set("default_article = EXCLUDED.default_article").
+		Set("default_section = EXCLUDED.default_section").
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Whoever gets the row first does the grab. Everybody else is too late.
+func claimReactionGrab(db *bun.DB, grabID string, channelID string, threadTS string) (claimed bool, err error) {
+	ctx := context.Background()
+	result, err := db.NewInsert().
+		Model(&SlackReactionGrab{GrabID: grabID, ChannelID: channelID, ThreadTS: threadTS, CreatedAt: time.Now()}).
+		On("CONFLICT DO NOTHING").
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func releaseReactionGrab(db *bun.DB, grabID string, channelID string, threadTS string) (err error) {
+	ctx := context.Background()
+	_, err = db.NewDelete().Model((*SlackReactionGrab)(nil)).
+		Where("grab_id = ?", grabID).
+		Where("channel_id = ?", channelID).
+		Where("thread_ts = ?", threadTS).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
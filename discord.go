@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// There's no Discord library in here, so we talk to the REST API ourselves.
+// It's pretty pleasant as far as these things go.
+const discordDefaultAPIURL = "https://discord.com/api/v10"
+
+// Channel types that are actually threads. Forum posts are public threads
+// whose parent happens to be a forum.
+const (
+	discordAnnouncementThread = 10
+	discordPublicThread       = 11
+	discordPrivateThread      = 12
+)
+
+// Message types we care about. Everything else is a system message
+// (pins, joins, thread renames, etc)
+const (
+	discordDefaultMessage = 0
+	discordReplyMessage   = 19
+)
+
+type DiscordBridge struct {
+	client   *http.Client
+	apiURL   string
+	botToken string
+	appID    string
+}
+
+type DiscordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Bot        bool   `json:"bot"`
+}
+
+type DiscordAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+type DiscordEmbed struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+}
+
+type DiscordMessage struct {
+	ID          string              `json:"id"`
+	ChannelID   string              `json:"channel_id"`
+	Type        int                 `json:"type"`
+	Author      DiscordUser         `json:"author"`
+	Content     string              `json:"content"`
+	Timestamp   time.Time           `json:"timestamp"`
+	Attachments []DiscordAttachment `json:"attachments"`
+	Embeds      []DiscordEmbed      `json:"embeds"`
+	Mentions    []DiscordUser       `json:"mentions"`
+}
+
+type DiscordChannel struct {
+	ID       string `json:"id"`
+	Type     int    `json:"type"`
+	GuildID  string `json:"guild_id"`
+	ParentID string `json:"parent_id"`
+	Name     string `json:"name"`
+}
+
+func NewDiscordBridge(instance Instance) (d DiscordBridge) {
+	d.client = &http.Client{Timeout: time.Second * 30}
+	d.apiURL = os.Getenv("DISCORD_API_URL")
+	if d.apiURL == "" {
+		d.apiURL = discordDefaultAPIURL
+	}
+	d.botToken = os.Getenv("DISCORD_BOT_TOKEN")
+	d.appID = os.Getenv("DISCORD_APP_ID")
+	return d
+}
+
+// In Discord, a thread is its own channel, so the threadID is the ID of the
+// thread channel. The starter message for a thread made off of a regular
+// message lives in the parent channel under the same ID, so we go get that
+// too.
+func (d *DiscordBridge) getThread(channelID string, threadID string) (thread Thread, err error) {
+	channel, err := d.getChannel(threadID)
+	if err != nil {
+		return Thread{}, err
+	}
+	if !d.isThread(channel) {
+		return Thread{}, fmt.Errorf("channel %s is not a thread", threadID)
+	}
+
+	conversation, err := d.getChannelMessages(threadID)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	// Forum posts keep their starter message inside the thread. Regular
+	// threads don't.
+	hasStarter := false
+	for _, message := range conversation {
+		if message.ID == threadID {
+			hasStarter = true
+			break
+		}
+	}
+	if !hasStarter && channel.ParentID != "" {
+		starter, err := d.getMessage(channel.ParentID, threadID)
+		if err == nil {
+			conversation = append([]DiscordMessage{starter}, conversation...)
+		}
+	}
+
+	return d.conversationToThread(conversation)
+}
+
+func (d *DiscordBridge) conversationToThread(conversation []DiscordMessage) (thread Thread, err error) {
+	if len(conversation) == 0 {
+		return Thread{}, fmt.Errorf("no messages in thread")
+	}
+
+	// The first message is when this party started
+	thread.Timestamp = conversation[0].Timestamp
+
+	for _, message := range conversation {
+		// Don't include messages from Grab, or stuff like pins and renames.
+		if message.Author.ID == d.appID {
+			continue
+		}
+		if message.Type != discordDefaultMessage && message.Type != discordReplyMessage {
+			continue
+		}
+
+		m := Message{}
+		m.Timestamp = message.Timestamp
+		m.Author = d.displayName(message.Author)
+		m.Text = d.resolveMentions(message.Content, message.Mentions)
+
+		// Discord already speaks (mostly) markdown, so embeds can go right in
+		for _, embed := range message.Embeds {
+			if embed.Description != "" {
+				m.Text += "\n\n> " + embed.Description
+			}
+		}
+
+		for _, attachment := range message.Attachments {
+			path, err := d.getFile(attachment)
+			if err != nil {
+				log.Println("Could not save file: ", err)
+				continue
+			}
+			m.Files = append(m.Files, path)
+		}
+
+		thread.Messages = append(thread.Messages, m)
+	}
+
+	return thread, nil
+}
+
+// Utility Functions
+
+func (d *DiscordBridge) isThread(channel DiscordChannel) bool {
+	return channel.Type == discordAnnouncementThread ||
+		channel.Type == discordPublicThread ||
+		channel.Type == discordPrivateThread
+}
+
+func (d *DiscordBridge) displayName(user DiscordUser) string {
+	if user.GlobalName != "" {
+		return user.GlobalName
+	}
+	return user.Username
+}
+
+// Mentions come through as <@1234>, which isn't very useful on a wiki.
+func (d *DiscordBridge) resolveMentions(content string, mentions []DiscordUser) string {
+	for _, user := range mentions {
+		mentionRegex := regexp.MustCompile(fmt.Sprintf(`<@!?%s>`, user.ID))
+		content = mentionRegex.ReplaceAllString(content, "@"+d.displayName(user))
+	}
+	return content
+}
+
+func (d *DiscordBridge) getChannel(channelID string) (channel DiscordChannel, err error) {
+	err = d.request(http.MethodGet, "/channels/"+channelID, nil, &channel)
+	return channel, err
+}
+
+func (d *DiscordBridge) getMessage(channelID string, messageID string) (message DiscordMessage, err error) {
+	err = d.request(http.MethodGet, fmt.Sprintf("/channels/%s/messages/%s", channelID, messageID), nil, &message)
+	return message, err
+}
+
+// Discord hands messages back newest-first, 100 at a time. Walk backwards
+// until we run out, then flip it around.
+func (d *DiscordBridge) getChannelMessages(channelID string) (conversation []DiscordMessage, err error) {
+	before := ""
+	for {
+		endpoint := fmt.Sprintf("/channels/%s/messages?limit=100", channelID)
+		if before != "" {
+			endpoint += "&before=" + before
+		}
+
+		var page []DiscordMessage
+		err = d.request(http.MethodGet, endpoint, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		conversation = append(conversation, page...)
+		if len(page) < 100 {
+			break
+		}
+		before = page[len(page)-1].ID
+	}
+
+	length := len(conversation)
+	for i := 0; i < length/2; i++ {
+		conversation[i], conversation[length-i-1] = conversation[length-i-1], conversation[i]
+	}
+	return conversation, nil
+}
+
+// Attachments live on Discord's CDN and don't need auth
+func (d *DiscordBridge) getFile(attachment DiscordAttachment) (path string, err error) {
+	rsp, err := d.client.Get(attachment.URL)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting file from Discord: %s", rsp.Status)
+	}
+
+	extension := strings.TrimPrefix(filepath.Ext(attachment.Filename), ".")
+	return saveTempFile(rsp.Body, extension)
+}
+
+// Register the "Grab thread" message command. PUT overwrites whatever was
+// there before, so this is safe to call on every startup.
+func (d *DiscordBridge) registerCommands() (err error) {
+	commands := []map[string]interface{}{
+		{
+			"name": "Grab thread",
+			"type": 3, // MESSAGE, which puts it in the right-click menu
+		},
+	}
+	return d.request(http.MethodPut, fmt.Sprintf("/applications/%s/commands", d.appID), commands, nil)
+}
+
+// Edit the response to an interaction we deferred earlier
+func (d *DiscordBridge) editInteractionResponse(interactionToken string, content string) (err error) {
+	body := map[string]string{"content": content}
+	return d.request(http.MethodPatch, fmt.Sprintf("/webhooks/%s/%s/messages/@original", d.appID, interactionToken), body, nil)
+}
+
+func (d *DiscordBridge) request(method string, endpoint string, body interface{}, result interface{}) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, d.apiURL+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+d.botToken)
+	req.Header.Set("User-Agent", "DiscordBot (https://github.com/WillNilges/grab, 1.0)")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("discord returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	if result != nil {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
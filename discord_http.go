@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Interaction types
+const (
+	DiscordPing               = 1
+	DiscordApplicationCommand = 2
+	DiscordModalSubmit        = 5
+)
+
+// Interaction response types
+const (
+	DiscordPong                   = 1
+	DiscordChannelMessage         = 4
+	DiscordDeferredChannelMessage = 5
+	DiscordModal                  = 9
+	DiscordEphemeral              = 1 << 6
+)
+
+// Custom ID for the "Grab thread" modal
+const DiscordGrabThreadModalCallback = "grab_thread"
+
+type DiscordInteractionComponent struct {
+	Type       int                           `json:"type"`
+	CustomID   string                        `json:"custom_id"`
+	Value      string                        `json:"value"`
+	Components []DiscordInteractionComponent `json:"components"`
+}
+
+type DiscordInteraction struct {
+	ID      string         `json:"id"`
+	AppID   string         `json:"application_id"`
+	Type    int            `json:"type"`
+	Token   string         `json:"token"`
+	GuildID string         `json:"guild_id"`
+	Channel DiscordChannel `json:"channel"`
+	Member  struct {
+		User DiscordUser `json:"user"`
+	} `json:"member"`
+	Data struct {
+		Name       string                        `json:"name"`
+		Type       int                           `json:"type"`
+		TargetID   string                        `json:"target_id"`
+		CustomID   string                        `json:"custom_id"`
+		Components []DiscordInteractionComponent `json:"components"`
+	} `json:"data"`
+}
+
+// Middleware to verify integrity of interactions from Discord. Discord will
+// actually send us garbage on purpose to make sure we check this.
+func discordSignatureVerification(c *gin.Context) {
+	publicKey, err := hex.DecodeString(os.Getenv("DISCORD_PUBLIC_KEY"))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "invalid discord public key"})
+		return
+	}
+	signature, err := hex.DecodeString(c.GetHeader("X-Signature-Ed25519"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid discord signature"})
+		return
+	}
+	bodyBytes, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error reading request body"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+	message := append([]byte(c.GetHeader("X-Signature-Timestamp")), bodyBytes...)
+	if !ed25519.Verify(publicKey, message, signature) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid discord signature"})
+		return
+	}
+	c.Next()
+}
+
+// Add Grab to a Discord server. Discord hands us the guild the bot got added
+// to along with the token.
+func discordInstallResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		code := c.PostForm("code")
+		if code == "" {
+			c.String(http.StatusBadRequest, "missing mandatory 'code' form field")
+			return
+		}
+
+		d := NewDiscordBridge(Instance{})
+		form := url.Values{
+			"client_id":     {os.Getenv("DISCORD_CLIENT_ID")},
+			"client_secret": {os.Getenv("DISCORD_CLIENT_SECRET")},
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {os.Getenv("DISCORD_REDIRECT_URI")},
+		}
+		rsp, err := d.client.PostForm(d.apiURL+"/oauth2/token", form)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error exchanging temporary code for access token: %s", err.Error())
+			return
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			c.String(http.StatusInternalServerError, "error exchanging temporary code for access token: %s", rsp.Status)
+			return
+		}
+
+		var token struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+			Guild        struct {
+				ID string `json:"id"`
+			} `json:"guild"`
+		}
+		err = json.NewDecoder(rsp.Body).Decode(&token)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error reading discord access token: %s", err.Error())
+			return
+		}
+
+		instance := new(Instance)
+		instance.GrabID = uuid.New().String()
+		instance.DiscordGuildID = token.Guild.ID
+		instance.DiscordAccessToken = token.AccessToken
+		instance.DiscordRefreshToken = token.RefreshToken
+		setWikiCredentials(instance, c.PostForm)
+
+		err = insertInstance(db, instance)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error storing discord access token: %s", err.Error())
+			return
+		}
+		installedPage(c, instance, "Grab is in your Discord server.", fmt.Sprintf("https://discord.com/channels/%s", token.Guild.ID))
+	}
+}
+
+func discordInteractionResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var interaction DiscordInteraction
+		err := c.ShouldBindJSON(&interaction)
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading discord interaction payload: %s", err.Error())
+			return
+		}
+
+		// Discord pings us when you set the endpoint up
+		if interaction.Type == DiscordPing {
+			c.JSON(http.StatusOK, gin.H{"type": DiscordPong})
+			return
+		}
+
+		// Pull credentials out of DB
+		instance, err := selectInstanceByDiscordGuildID(db, interaction.GuildID)
+		if err != nil {
+			log.Println("Could not get credentials from DB", err)
+			discordReply(c, "Grab isn't set up for this server! Please reinstall it.")
+			return
+		}
+
+		d := NewDiscordBridge(instance)
+
+		switch interaction.Type {
+		case DiscordApplicationCommand:
+			d.handleMessageCommand(c, interaction)
+		case DiscordModalSubmit:
+			d.handleModalSubmit(c, interaction, instance)
+		default:
+			c.String(http.StatusBadRequest, "Invalid interaction type: %d", interaction.Type)
+		}
+	}
+}
+
+// Interaction Handlers
+
+func (d *DiscordBridge) handleMessageCommand(c *gin.Context, interaction DiscordInteraction) {
+	// This command only works inside threads and forum posts.
+	if !d.isThread(interaction.Channel) {
+		discordReply(c, "'Grab thread' only works inside threads!")
+		return
+	}
+	c.JSON(http.StatusOK, d.generateTitleFormResponse(interaction.Channel.ParentID, interaction.Channel.ID))
+}
+
+func (d *DiscordBridge) handleModalSubmit(c *gin.Context, interaction DiscordInteraction, instance Instance) {
+	values := map[string]string{}
+	for _, row := range interaction.Data.Components {
+		for _, component := range row.Components {
+			values[component.CustomID] = strings.TrimSpace(component.Value)
+		}
+	}
+	clobber := strings.EqualFold(values["clobber"], "yes")
+
+	// The modal remembers which thread it was for
+	messageContext := strings.Split(interaction.Data.CustomID, ",")
+	if len(messageContext) != 3 || messageContext[0] != DiscordGrabThreadModalCallback {
+		c.String(http.StatusBadRequest, "Invalid modal: %s", interaction.Data.CustomID)
+		return
+	}
+	channelID := messageContext[1]
+	threadID := messageContext[2]
+
+	// Big threads take a while, so ACK now and fill in the answer later
+	c.JSON(http.StatusOK, gin.H{
+		"type": DiscordDeferredChannelMessage,
+		"data": gin.H{"flags": DiscordEphemeral},
+	})
+
+	go func() {
+		url, err := archiveThread(d, instance, channelID, threadID, values["articleTitle"], values["sectionTitle"], clobber)
+		responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+		if err != nil {
+			log.Println("Error grabbing Discord thread: ", err)
+			responseData = fmt.Sprintf("Could not save article: %s", err)
+		}
+		err = d.editInteractionResponse(interaction.Token, responseData)
+		if err != nil {
+			log.Println("Could not respond to Discord interaction: ", err)
+		}
+	}()
+}
+
+// Discord modals can only hold text inputs, so the clobber checkbox turns into
+// a "type yes" box.
+func (d *DiscordBridge) generateTitleFormResponse(channelID string, threadID string) gin.H {
+	textInput := func(customID string, label string, placeholder string) gin.H {
+		return gin.H{
+			"type": 1, // ACTION_ROW
+			"components": []gin.H{{
+				"type":        4, // TEXT_INPUT
+				"custom_id":   customID,
+				"label":       label,
+				"placeholder": placeholder,
+				"style":       1, // Short
+				"required":    false,
+			}},
+		}
+	}
+
+	return gin.H{
+		"type": DiscordModal,
+		"data": gin.H{
+			"custom_id": fmt.Sprintf("%s,%s,%s", DiscordGrabThreadModalCallback, channelID, threadID),
+			"title":     "Grab a thread",
+			"components": []gin.H{
+				textInput("articleTitle", "Article Title", "Article Title"),
+				textInput("sectionTitle", "Section Title", "Section Title"),
+				textInput("clobber", "Overwrite existing content? (yes/no)", "no"),
+			},
+		},
+	}
+}
+
+// Answer an interaction with a message only the user can see
+func discordReply(c *gin.Context, content string) {
+	c.JSON(http.StatusOK, gin.H{
+		"type": DiscordChannelMessage,
+		"data": gin.H{
+			"content": content,
+			"flags":   DiscordEphemeral,
+		},
+	})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// DokuWiki's remote API speaks XML-RPC. Old and new versions alike still
+// answer to the wiki.* methods, so that's what we use.
+const dokuWikiXMLRPCPath = "/lib/exe/xmlrpc.php"
+
+// Everything we upload goes in here. Give Grab's account upload rights on it.
+const dokuWikiMediaNamespace = "grab"
+
+type DokuWikiBridge struct {
+	client *http.Client
+	url    string
+}
+
+// Just enough of XML-RPC to read what DokuWiki sends back
+type xmlrpcValue struct {
+	String  *string `xml:"string"`
+	Boolean *string `xml:"boolean"`
+	Struct  *struct {
+		Members []struct {
+			Name  string      `xml:"name"`
+			Value xmlrpcValue `xml:"value"`
+		} `xml:"member"`
+	} `xml:"struct"`
+	Text string `xml:",chardata"`
+}
+
+type xmlrpcResponse struct {
+	Params []xmlrpcValue `xml:"params>param>value"`
+	Fault  *xmlrpcValue  `xml:"fault>value"`
+}
+
+// Headings are "====== Title ======", with fewer ='s the deeper they go
+var dokuWikiHeadingRegex = regexp.MustCompile(`^(={2,6})\s*(.+?)\s*={2,6}\s*$`)
+
+func NewDokuWikiBridge(instance Instance) (wiki DokuWikiBridge, err error) {
+	// Logging in gets us a session cookie for everything after
+	cookieJar, _ := cookiejar.New(nil)
+	wiki.client = &http.Client{Timeout: time.Second * 30, Jar: cookieJar}
+	wiki.url = strings.TrimSuffix(instance.DokuWikiURL, "/")
+
+	var ok xmlrpcValue
+	err = wiki.call("dokuwiki.login", []interface{}{instance.DokuWikiUsername, instance.DokuWikiPassword}, &ok)
+	if err != nil {
+		return DokuWikiBridge{}, err
+	}
+	if ok.Boolean == nil || *ok.Boolean != "1" {
+		return DokuWikiBridge{}, fmt.Errorf("could not log in to dokuwiki as %s", instance.DokuWikiUsername)
+	}
+	return wiki, nil
+}
+
+func (w *DokuWikiBridge) generateTranscript(thread Thread) (transcript string) {
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "Transcript generated at " + currentTime + ".\n\n"
+	transcript += "Conversation begins at " + transcriptBegin + ".\n\n"
+
+	for _, m := range thread.Messages {
+		mu, err := pandocConvert(m.Text, "markdown", "dokuwiki")
+		if err != nil {
+			log.Println("Warning: Failed to convert to DokuWiki markup: ", err)
+			mu = m.Text
+		}
+		transcript += "**" + m.Author + "**: " + strings.TrimSpace(mu) + "\n\n"
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				mediaID, err := w.uploadImage(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				transcript += fmt.Sprintf("{{%s}}\n\n", mediaID)
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				transcript += "<code>\n" + string(fileContents) + "\n</code>\n\n"
+			}
+		}
+	}
+
+	return transcript
+}
+
+// Titles are page IDs, namespaces and all, like ops:incidents:2024-01-03.
+// Sections work the same as they do on MediaWiki.
+func (w *DokuWikiBridge) uploadArticle(title string, section string, transcript string, clobber bool) (pageURL string, err error) {
+	pageID := w.cleanID(title)
+
+	var existing xmlrpcValue
+	err = w.call("wiki.getPage", []interface{}{pageID}, &existing)
+	if err != nil {
+		return "", err
+	}
+	text := existing.text()
+
+	var body string
+	if section == "" {
+		if clobber || strings.TrimSpace(text) == "" {
+			body = transcript
+		} else {
+			body = strings.TrimRight(text, "\n") + "\n\n" + transcript
+		}
+	} else {
+		heading := "===== " + section + " =====\n\n"
+		start, end, exists := w.findSection(text, section)
+		if exists && clobber {
+			body = text[:start] + text[end:]
+			body = strings.TrimRight(body, "\n") + "\n\n" + heading + transcript
+		} else if exists /* && append */ {
+			body = strings.TrimRight(text[:end], "\n") + "\n\n" + transcript + text[end:]
+		} else {
+			body = strings.TrimRight(text, "\n") + "\n\n" + heading + transcript
+		}
+	}
+
+	attributes := map[string]interface{}{
+		"sum":   "Grab uploadArticle section " + section,
+		"minor": false,
+	}
+	var ok xmlrpcValue
+	err = w.call("wiki.putPage", []interface{}{pageID, strings.TrimLeft(body, "\n"), attributes}, &ok)
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	return w.url + "/doku.php?id=" + url.QueryEscape(pageID), nil
+}
+
+// Images go in the media manager, and get linked like {{grab:file.png}}
+func (w *DokuWikiBridge) uploadImage(path string) (mediaID string, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	mediaID = dokuWikiMediaNamespace + ":" + w.cleanID(filepath.Base(path))
+
+	var result xmlrpcValue
+	err = w.call("wiki.putAttachment", []interface{}{mediaID, contents, map[string]interface{}{"ow": true}}, &result)
+	if err != nil {
+		return "", err
+	}
+	return mediaID, nil
+}
+
+// Utility Functions
+
+// DokuWiki does this itself too, but we need to know the ID to link to it
+func (w *DokuWikiBridge) cleanID(title string) string {
+	id := strings.ToLower(strings.TrimSpace(title))
+	id = strings.NewReplacer(" ", "_", "/", ":", ";", ":").Replace(id)
+	return strings.Trim(id, ":")
+}
+
+// Find where a section starts and ends, by byte offset. It ends wherever the
+// next heading of the same level (or bigger) starts.
+func (w *DokuWikiBridge) findSection(text string, section string) (start int, end int, exists bool) {
+	offset := 0
+	level := 0
+	inCode := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineStart := offset
+		offset += len(line)
+
+		// Things that look like headings inside code blocks aren't headings
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "<code") || strings.HasPrefix(trimmed, "<file") {
+			inCode = true
+		}
+		if strings.HasPrefix(trimmed, "</code>") || strings.HasPrefix(trimmed, "</file>") {
+			inCode = false
+			continue
+		}
+		if inCode {
+			continue
+		}
+
+		match := dokuWikiHeadingRegex.FindStringSubmatch(trimmed)
+		if match == nil {
+			continue
+		}
+		if exists && len(match[1]) >= level {
+			return start, lineStart, true
+		}
+		if !exists && match[2] == section {
+			start = lineStart
+			level = len(match[1])
+			exists = true
+		}
+	}
+	return start, len(text), exists
+}
+
+func (w *DokuWikiBridge) call(method string, params []interface{}, result *xmlrpcValue) (err error) {
+	body := &bytes.Buffer{}
+	body.WriteString(`<?xml version="1.0"?><methodCall><methodName>` + method + `</methodName><params>`)
+	for _, param := range params {
+		body.WriteString("<param>")
+		w.encodeValue(body, param)
+		body.WriteString("</param>")
+	}
+	body.WriteString("</params></methodCall>")
+
+	rsp, err := w.client.Post(w.url+dokuWikiXMLRPCPath, "text/xml", body)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("dokuwiki returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	var response xmlrpcResponse
+	err = xml.Unmarshal(responseBody, &response)
+	if err != nil {
+		return err
+	}
+	if response.Fault != nil {
+		return fmt.Errorf("dokuwiki %s failed: %s", method, response.Fault.member("faultString").text())
+	}
+	if len(response.Params) > 0 && result != nil {
+		*result = response.Params[0]
+	}
+	return nil
+}
+
+func (w *DokuWikiBridge) encodeValue(body *bytes.Buffer, value interface{}) {
+	body.WriteString("<value>")
+	switch v := value.(type) {
+	case string:
+		body.WriteString("<string>")
+		xml.EscapeText(body, []byte(v))
+		body.WriteString("</string>")
+	case bool:
+		if v {
+			body.WriteString("<boolean>1</boolean>")
+		} else {
+			body.WriteString("<boolean>0</boolean>")
+		}
+	case []byte:
+		body.WriteString("<base64>" + base64.StdEncoding.EncodeToString(v) + "</base64>")
+	case map[string]interface{}:
+		body.WriteString("<struct>")
+		for name, member := range v {
+			body.WriteString("<member><name>" + name + "</name>")
+			w.encodeValue(body, member)
+			body.WriteString("</member>")
+		}
+		body.WriteString("</struct>")
+	}
+	body.WriteString("</value>")
+}
+
+// Strings can come back with or without a <string> around them
+func (v xmlrpcValue) text() string {
+	if v.String != nil {
+		return *v.String
+	}
+	return v.Text
+}
+
+func (v xmlrpcValue) member(name string) (member xmlrpcValue) {
+	if v.Struct == nil {
+		return member
+	}
+	for _, m := range v.Struct.Members {
+		if m.Name == name {
+			return m.Value
+		}
+	}
+	return member
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Issues, pull requests, and discussions on GitHub, or anything that speaks
+// its API (Gitea, Forgejo, GitHub Enterprise). Each workspace gives us its own
+// API URL, like https://gitea.example.com/api/v1, and a token to read with.
+const forgeDefaultAPIURL = "https://api.github.com"
+
+// Comments per page, and how many pages we'll go through before giving up on
+// a forge that won't stop handing them out
+const forgePageSize = 50
+const forgeMaxPages = 100
+
+// Where GitHub keeps pictures people paste into comments. Everywhere else
+// keeps them on the forge itself.
+var forgeGitHubAttachmentHosts = []string{
+	"github.com",
+	"user-images.githubusercontent.com",
+	"private-user-images.githubusercontent.com",
+	"objects.githubusercontent.com",
+}
+
+var forgeLinkNextRegex = regexp.MustCompile(`rel="?next"?`)
+
+type ForgeBridge struct {
+	client *http.Client
+	apiURL string
+	token  string
+}
+
+type ForgeUser struct {
+	Login string `json:"login"`
+	Type  string `json:"type"`
+}
+
+type ForgeComment struct {
+	Body      string    `json:"body"`
+	User      ForgeUser `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ForgeIssue struct {
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	User      ForgeUser `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Pictures in comments, either markdown or the <img> tags GitHub likes to
+// paste in for you
+var forgeImageRegex = regexp.MustCompile(`!\[[^\]]*\]\(([^)\s]+)[^)]*\)|<img[^>]+src="([^"]+)"[^>]*>`)
+
+func NewForgeBridge(instance Instance) (f ForgeBridge, err error) {
+	// Without a token of their own, they'd be reading with somebody else's
+	if instance.ForgeAPIURL == "" || instance.ForgeToken == "" {
+		return ForgeBridge{}, errors.New("no forge has been set up for this workspace")
+	}
+	f.client = &http.Client{Timeout: time.Second * 30}
+	f.apiURL = strings.TrimSuffix(instance.ForgeAPIURL, "/")
+	f.token = instance.ForgeToken
+	return f, nil
+}
+
+// The channel is the repo, as "owner/repo", and the thread is whatever we're
+// grabbing, as "issues/12", "pulls/12", or "discussions/12".
+func (f *ForgeBridge) getThread(channelID string, threadID string) (thread Thread, err error) {
+	owner, repo, ok := strings.Cut(channelID, "/")
+	if !ok {
+		return Thread{}, fmt.Errorf("invalid repository: %s", channelID)
+	}
+	kind, number, ok := strings.Cut(threadID, "/")
+	if !ok {
+		return Thread{}, fmt.Errorf("invalid issue: %s", threadID)
+	}
+	if _, err := strconv.Atoi(number); err != nil {
+		return Thread{}, fmt.Errorf("invalid issue number: %s", number)
+	}
+
+	var conversation []ForgeComment
+	switch kind {
+	case "issues", "pulls":
+		conversation, err = f.getIssueComments(owner, repo, kind, number)
+	case "discussions":
+		conversation, err = f.getDiscussionComments(owner, repo, number)
+	default:
+		return Thread{}, fmt.Errorf("don't know how to grab %s", kind)
+	}
+	if err != nil {
+		return Thread{}, err
+	}
+
+	return f.conversationToThread(conversation)
+}
+
+func (f *ForgeBridge) conversationToThread(conversation []ForgeComment) (thread Thread, err error) {
+	thread.Timestamp = conversation[0].CreatedAt
+
+	for _, comment := range conversation {
+		// Don't include CI bots and such
+		if comment.User.Type == "Bot" || strings.HasSuffix(comment.User.Login, "[bot]") {
+			continue
+		}
+
+		m := Message{}
+		m.Timestamp = comment.CreatedAt
+		m.Author = comment.User.Login
+
+		// Comments are already markdown, so they can go straight to the wiki.
+		// Pull the pictures out so they get uploaded like everything else.
+		text := comment.Body
+		for _, img := range forgeImageRegex.FindAllStringSubmatch(text, -1) {
+			link := img[1]
+			if link == "" {
+				link = img[2]
+			}
+			path, err := f.getFile(link)
+			if err != nil {
+				log.Println("Could not save file: ", err)
+				continue
+			}
+			m.Files = append(m.Files, path)
+			text = strings.Replace(text, img[0], "", 1)
+		}
+		m.Text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+
+		thread.Messages = append(thread.Messages, m)
+	}
+
+	return thread, nil
+}
+
+// Turn a link someone copied out of their browser into a repo and a thread,
+// like https://github.com/owner/repo/pull/12 -> "owner/repo", "pulls/12"
+func (f *ForgeBridge) parseLink(link string) (channelID string, threadID string, err error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return "", "", err
+	}
+	// Same owner and repo on another forge is a different thing entirely
+	if !strings.EqualFold(u.Host, f.webHost()) {
+		return "", "", fmt.Errorf("not a link to %s: %s", f.webHost(), link)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 4 {
+		return "", "", fmt.Errorf("not an issue, pull request, or discussion: %s", link)
+	}
+
+	// Forges can live in a subdirectory, so go from the end
+	parts = parts[len(parts)-4:]
+	kind := parts[2]
+	switch kind {
+	case "issues", "discussions":
+	case "pull", "pulls":
+		kind = "pulls"
+	default:
+		return "", "", fmt.Errorf("not an issue, pull request, or discussion: %s", link)
+	}
+	return parts[0] + "/" + parts[1], kind + "/" + parts[3], nil
+}
+
+// Utility Functions
+
+// Pull requests are issues as far as comments go. The comments on the code
+// itself live somewhere else, if the forge has them at all.
+func (f *ForgeBridge) getIssueComments(owner string, repo string, kind string, number string) (conversation []ForgeComment, err error) {
+	repoPath := fmt.Sprintf("/repos/%s/%s", url.PathEscape(owner), url.PathEscape(repo))
+
+	var issue ForgeIssue
+	err = f.apiRequest(http.MethodGet, f.apiURL+repoPath+"/issues/"+number, nil, &issue)
+	if err != nil {
+		return nil, err
+	}
+
+	// Put the title up top so it ends up as the default article title
+	conversation = append(conversation, ForgeComment{
+		Body:      strings.TrimSpace(issue.Title + "\n\n" + issue.Body),
+		User:      issue.User,
+		CreatedAt: issue.CreatedAt,
+	})
+
+	comments, err := f.getPages(repoPath + "/issues/" + number + "/comments")
+	if err != nil {
+		return nil, err
+	}
+	conversation = append(conversation, comments...)
+
+	if kind == "pulls" {
+		reviewComments, err := f.getPages(repoPath + "/pulls/" + number + "/comments")
+		if err != nil {
+			log.Println("Could not get review comments: ", err)
+		}
+		conversation = append(conversation, reviewComments...)
+	}
+
+	sort.SliceStable(conversation, func(i, j int) bool {
+		return conversation[i].CreatedAt.Before(conversation[j].CreatedAt)
+	})
+	return conversation, nil
+}
+
+// GitHub asks for per_page and Gitea asks for limit, so ask for both. Some
+// endpoints ignore both and hand back everything every time, so anything but
+// a full page is the last one. Where there's a Link header, it knows best.
+func (f *ForgeBridge) getPages(endpoint string) (comments []ForgeComment, err error) {
+	for page := 1; page <= forgeMaxPages; page++ {
+		var pageComments []ForgeComment
+		header, err := f.apiResponse(http.MethodGet, fmt.Sprintf("%s%s?per_page=%d&limit=%d&page=%d", f.apiURL, endpoint, forgePageSize, forgePageSize, page), nil, &pageComments)
+		if err != nil {
+			return comments, err
+		}
+		comments = append(comments, pageComments...)
+
+		link := header.Get("Link")
+		if len(pageComments) != forgePageSize || (link != "" && !forgeLinkNextRegex.MatchString(link)) {
+			return comments, nil
+		}
+	}
+	log.Printf("Stopped after %d pages of %s\n", forgeMaxPages, endpoint)
+	return comments, nil
+}
+
+// Discussions only exist in GitHub's GraphQL API. Replies to comments get
+// flattened into the timeline, since that's about how people read them anyway.
+func (f *ForgeBridge) getDiscussionComments(owner string, repo string, number string) (conversation []ForgeComment, err error) {
+	query := `query($owner: String!, $repo: String!, $number: Int!, $after: String) {
+		repository(owner: $owner, name: $repo) {
+			discussion(number: $number) {
+				title body createdAt author { login }
+				comments(first: 50, after: $after) {
+					pageInfo { hasNextPage endCursor }
+					nodes {
+						body createdAt author { login }
+						replies(first: 100) { nodes { body createdAt author { login } } }
+					}
+				}
+			}
+		}
+	}`
+
+	type discussionComment struct {
+		Body      string    `json:"body"`
+		CreatedAt time.Time `json:"createdAt"`
+		Author    *struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	}
+	toComment := func(c discussionComment) ForgeComment {
+		// Deleted users come back as null
+		author := "ghost"
+		if c.Author != nil {
+			author = c.Author.Login
+		}
+		return ForgeComment{Body: c.Body, User: ForgeUser{Login: author}, CreatedAt: c.CreatedAt}
+	}
+
+	n, _ := strconv.Atoi(number)
+	var after *string
+	for {
+		var result struct {
+			Data struct {
+				Repository struct {
+					Discussion *struct {
+						discussionComment
+						Title    string `json:"title"`
+						Comments struct {
+							PageInfo struct {
+								HasNextPage bool   `json:"hasNextPage"`
+								EndCursor   string `json:"endCursor"`
+							} `json:"pageInfo"`
+							Nodes []struct {
+								discussionComment
+								Replies struct {
+									Nodes []discussionComment `json:"nodes"`
+								} `json:"replies"`
+							} `json:"nodes"`
+						} `json:"comments"`
+					} `json:"discussion"`
+				} `json:"repository"`
+			} `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+
+		body := map[string]interface{}{
+			"query": query,
+			"variables": map[string]interface{}{
+				"owner":  owner,
+				"repo":   repo,
+				"number": n,
+				"after":  after,
+			},
+		}
+		err = f.apiRequest(http.MethodPost, f.graphqlURL(), body, &result)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Errors) > 0 {
+			return nil, fmt.Errorf("error getting discussion: %s", result.Errors[0].Message)
+		}
+		discussion := result.Data.Repository.Discussion
+		if discussion == nil {
+			return nil, fmt.Errorf("no discussion #%s in %s/%s", number, owner, repo)
+		}
+
+		if after == nil {
+			root := toComment(discussion.discussionComment)
+			root.Body = strings.TrimSpace(discussion.Title + "\n\n" + root.Body)
+			conversation = append(conversation, root)
+		}
+		for _, comment := range discussion.Comments.Nodes {
+			conversation = append(conversation, toComment(comment.discussionComment))
+			for _, reply := range comment.Replies.Nodes {
+				conversation = append(conversation, toComment(reply))
+			}
+		}
+
+		if !discussion.Comments.PageInfo.HasNextPage {
+			break
+		}
+		cursor := discussion.Comments.PageInfo.EndCursor
+		after = &cursor
+	}
+
+	return conversation, nil
+}
+
+// GitHub Enterprise keeps REST at /api/v3 and GraphQL at /api/graphql.
+// Everywhere else, it's next to the REST API.
+func (f *ForgeBridge) graphqlURL() string {
+	if strings.HasSuffix(f.apiURL, "/api/v3") {
+		return strings.TrimSuffix(f.apiURL, "/v3") + "/graphql"
+	}
+	return f.apiURL + "/graphql"
+}
+
+// The forge's web pages live next to the API, minus any "api." on the front
+func (f *ForgeBridge) webHost() string {
+	apiURL, err := url.Parse(f.apiURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(apiURL.Host, "api.")
+}
+
+// Pictures can point anywhere, so only go get the ones the forge keeps
+func (f *ForgeBridge) isAttachmentHost(host string) bool {
+	if strings.EqualFold(host, f.webHost()) {
+		return true
+	}
+	if f.apiURL != forgeDefaultAPIURL {
+		return false
+	}
+	for _, attachmentHost := range forgeGitHubAttachmentHosts {
+		if strings.EqualFold(host, attachmentHost) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ForgeBridge) getFile(fileURL string) (path string, err error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if req.URL.Scheme != "https" && req.URL.Scheme != "http" || !f.isAttachmentHost(req.URL.Host) {
+		return "", fmt.Errorf("not fetching a file from outside the forge: %s", fileURL)
+	}
+	// Only hand our token to the forge itself, not wherever the picture is
+	if strings.EqualFold(req.URL.Host, f.webHost()) {
+		req.Header.Set("Authorization", "token "+f.token)
+	}
+
+	rsp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting file from forge: %s", rsp.Status)
+	}
+
+	extension := strings.TrimPrefix(filepath.Ext(req.URL.Path), ".")
+	if extension == "" {
+		extension = "png"
+	}
+	return saveTempFile(rsp.Body, extension)
+}
+
+func (f *ForgeBridge) apiRequest(method string, endpoint string, body interface{}, result interface{}) (err error) {
+	_, err = f.apiResponse(method, endpoint, body, result)
+	return err
+}
+
+// Same as apiRequest, for when the headers matter too
+func (f *ForgeBridge) apiResponse(method string, endpoint string, body interface{}, result interface{}) (header http.Header, err error) {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, endpoint, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Both GitHub and Gitea take "token <token>"
+	if f.token != "" {
+		req.Header.Set("Authorization", "token "+f.token)
+	}
+
+	rsp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("forge returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	return rsp.Header, json.Unmarshal(responseBody, result)
+}
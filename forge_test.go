@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func forgeComments(n int) (comments []ForgeComment) {
+	for i := 0; i < n; i++ {
+		comments = append(comments, ForgeComment{
+			Body:      fmt.Sprintf("comment %d", i),
+			User:      ForgeUser{Login: "alice"},
+			CreatedAt: time.Date(2024, 1, 1, 9, 0, i, 0, time.UTC),
+		})
+	}
+	return comments
+}
+
+func TestForgePages(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     func(page string) (comments []ForgeComment, link string)
+		comments int
+		requests int32
+	}{
+		{
+			// Gitea's comments endpoint hands back everything, whatever you ask for
+			name:     "ignores paging",
+			page:     func(page string) ([]ForgeComment, string) { return forgeComments(60), "" },
+			comments: 60,
+			requests: 1,
+		},
+		{
+			name:     "short page",
+			page:     func(page string) ([]ForgeComment, string) { return forgeComments(3), "" },
+			comments: 3,
+			requests: 1,
+		},
+		{
+			name: "link header",
+			page: func(page string) ([]ForgeComment, string) {
+				if page == "1" {
+					return forgeComments(forgePageSize), `<https://forge/comments?page=2>; rel="next", <https://forge/comments?page=2>; rel="last"`
+				}
+				return forgeComments(forgePageSize), `<https://forge/comments?page=1>; rel="prev", <https://forge/comments?page=1>; rel="first"`
+			},
+			comments: 2 * forgePageSize,
+			requests: 2,
+		},
+		{
+			name: "never ends",
+			page: func(page string) ([]ForgeComment, string) {
+				return forgeComments(forgePageSize), `<https://forge/comments?page=1000>; rel="next"`
+			},
+			comments: forgeMaxPages * forgePageSize,
+			requests: forgeMaxPages,
+		},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			comments, link := test.page(r.URL.Query().Get("page"))
+			if link != "" {
+				w.Header().Set("Link", link)
+			}
+			json.NewEncoder(w).Encode(comments)
+		}))
+
+		f, _ := NewForgeBridge(Instance{ForgeAPIURL: server.URL + "/api/v1", ForgeToken: "token"})
+		comments, err := f.getPages("/repos/owner/repo/issues/1/comments")
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(comments) != test.comments || requests != test.requests {
+			t.Errorf("%s: expected %d comments in %d requests, got %d in %d", test.name, test.comments, test.requests, len(comments), requests)
+		}
+	}
+}
+
+func TestForgeGetThread(t *testing.T) {
+	os.MkdirAll("/tmp/grab", 0777)
+
+	// Somewhere a comment points that isn't the forge
+	var lured int32
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lured, 1)
+	}))
+	defer elsewhere.Close()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token gitea token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/repos/owner/repo/issues/7":
+			json.NewEncoder(w).Encode(ForgeIssue{
+				Title:     "Builds are slow",
+				Body:      "Since Tuesday",
+				User:      ForgeUser{Login: "alice"},
+				CreatedAt: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+			})
+		case "/api/v1/repos/owner/repo/issues/7/comments":
+			json.NewEncoder(w).Encode([]ForgeComment{
+				{Body: "CI passed", User: ForgeUser{Login: "ci", Type: "Bot"}, CreatedAt: time.Date(2024, 1, 1, 9, 1, 0, 0, time.UTC)},
+				{Body: "Here's the graph ![graph](" + server.URL + "/attachments/graph.png)", User: ForgeUser{Login: "bob"}, CreatedAt: time.Date(2024, 1, 1, 9, 2, 0, 0, time.UTC)},
+				{Body: `Mine too <img src="` + elsewhere.URL + `/graph.png">`, User: ForgeUser{Login: "carol"}, CreatedAt: time.Date(2024, 1, 1, 9, 3, 0, 0, time.UTC)},
+			})
+		case "/attachments/graph.png":
+			w.Write([]byte("not really a png"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := NewForgeBridge(Instance{ForgeAPIURL: server.URL + "/api/v1"}); err == nil {
+		t.Error("set up a forge without a token")
+	}
+	f, err := NewForgeBridge(Instance{ForgeAPIURL: server.URL + "/api/v1/", ForgeToken: "gitea token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only links to the forge we were given
+	if _, _, err = f.parseLink("https://github.com/owner/repo/issues/7"); err == nil {
+		t.Error("took a link to a different forge")
+	}
+	repo, issue, err := f.parseLink(server.URL + "/owner/repo/issues/7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread, err := f.getThread(repo, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Message{
+		{Author: "alice", Text: "Builds are slow\n\nSince Tuesday"},
+		{Author: "bob", Text: "Here's the graph"},
+		{Author: "carol", Text: `Mine too <img src="` + elsewhere.URL + `/graph.png">`},
+	}
+	if len(thread.Messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %+v", len(expected), thread.Messages)
+	}
+	for i, msg := range thread.Messages {
+		if msg.Author != expected[i].Author || msg.Text != expected[i].Text {
+			t.Errorf("message %d: expected %s: %q, got %s: %q", i, expected[i].Author, expected[i].Text, msg.Author, msg.Text)
+		}
+	}
+
+	files := thread.Messages[1].Files
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".png") {
+		t.Fatalf("expected one png, got %v", files)
+	}
+	defer os.Remove(files[0])
+	if len(thread.Messages[2].Files) != 0 || atomic.LoadInt32(&lured) != 0 {
+		t.Error("fetched a picture from outside the forge")
+	}
+}
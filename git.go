@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// For people who keep their docs as markdown in a git repo. Grab writes into
+// a local clone, commits, and pushes if there's a remote to push to.
+const gitAssetsDir = "assets"
+
+// Where the operator keeps clones Grab is allowed to write to. Install forms
+// pick one by name.
+const gitDefaultReposPath = "repos"
+
+// Two grabs at once would fight over the index
+var gitLock sync.Mutex
+
+type GitBridge struct {
+	repoPath string
+	remote   string
+	webURL   string
+
+	// generateTranscript hangs onto this for the front matter
+	thread Thread
+}
+
+// Images are linked relative to the file, which we don't know the location of
+// until uploadArticle
+var gitPendingAssetRegex = regexp.MustCompile(`\]\(grab-asset:([^)]+)\)`)
+
+func NewGitBridge(instance Instance) (wiki GitBridge, err error) {
+	if instance.GitRepoPath == "" {
+		return GitBridge{}, fmt.Errorf("no git repository picked")
+	}
+	// Every workspace gets its own folder of clones, so nobody can name
+	// somebody else's
+	wiki.repoPath, err = confinePath(filepath.Join(gitReposRoot(), publicGrabID(instance.GrabID)), instance.GitRepoPath)
+	if err != nil {
+		return GitBridge{}, err
+	}
+	wiki.webURL = strings.TrimSuffix(instance.GitWebURL, "/")
+
+	// Make sure it's actually a clone
+	_, err = wiki.git("rev-parse", "--git-dir")
+	if err != nil {
+		return GitBridge{}, fmt.Errorf("%s is not a git repository: %s", wiki.repoPath, err)
+	}
+
+	// The install form only gets to pick from the remotes whoever cloned it
+	// set up, not give us a URL
+	if instance.GitRemote != "" {
+		remotes, err := wiki.git("remote")
+		if err != nil {
+			return GitBridge{}, err
+		}
+		for _, remote := range strings.Fields(remotes) {
+			if remote == instance.GitRemote {
+				wiki.remote = remote
+			}
+		}
+		if wiki.remote == "" {
+			return GitBridge{}, fmt.Errorf("%s has no remote called %s", instance.GitRepoPath, instance.GitRemote)
+		}
+	}
+	return wiki, nil
+}
+
+func (w *GitBridge) generateTranscript(thread Thread) (transcript string) {
+	w.thread = thread
+
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "Transcript generated at " + currentTime + ".\n\n"
+	transcript += "Conversation begins at " + transcriptBegin + ".\n\n"
+
+	for _, m := range thread.Messages {
+		transcript += "**" + m.Author + "**: " + strings.TrimSpace(m.Text) + "\n\n"
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				filename, err := w.uploadImage(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				transcript += fmt.Sprintf("![](grab-asset:%s)\n\n", filename)
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				transcript += "```\n" + string(fileContents) + "\n```\n\n"
+			}
+		}
+	}
+
+	return transcript
+}
+
+// Titles are paths in the repo, like "ops/incidents/Outage", which ends up in
+// ops/incidents/outage.md. Sections are "## Section" headings, and work the
+// same as they do on MediaWiki.
+func (w *GitBridge) uploadArticle(title string, section string, transcript string, clobber bool) (pageURL string, err error) {
+	relPath, err := w.articlePath(title)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(w.repoPath, relPath)
+
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	if w.remote != "" {
+		branch, err := w.git("rev-parse", "--abbrev-ref", "HEAD")
+		if err != nil {
+			return "", err
+		}
+		_, err = w.git("pull", "--rebase", "--", w.remote, strings.TrimSpace(branch))
+		if err != nil {
+			return "", fmt.Errorf("could not pull from %s: %s", w.remote, err)
+		}
+	}
+
+	existing, err := os.ReadFile(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	frontMatter, body := parseFrontMatter(string(existing))
+	if frontMatter.Title == "" {
+		frontMatter.Title = filepath.Base(title)
+	}
+	if frontMatter.Channel == "" {
+		frontMatter.Channel = w.thread.Channel
+	}
+	if frontMatter.Date == "" || (section == "" && clobber) {
+		frontMatter.Date = w.thread.Timestamp.Format(time.RFC3339)
+	}
+	frontMatter.Participants = mergeUnique(frontMatter.Participants, w.thread.getNames())
+
+	// Now that we know where the file is, we know where the pictures are
+	assetsRel, err := filepath.Rel(filepath.Dir(relPath), gitAssetsDir)
+	if err != nil {
+		return "", err
+	}
+	transcript = gitPendingAssetRegex.ReplaceAllString(transcript, "]("+filepath.ToSlash(assetsRel)+"/$1)")
+
+	body = mergeMarkdownSection(body, section, transcript, clobber)
+
+	err = os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(fullPath, []byte(formatFrontMatter(frontMatter)+body), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	// Commit the article and anything we put in the assets directory
+	paths := []string{relPath}
+	if _, err := os.Stat(filepath.Join(w.repoPath, gitAssetsDir)); err == nil {
+		paths = append(paths, gitAssetsDir)
+	}
+	_, err = w.git(append([]string{"add", "--"}, paths...)...)
+	if err != nil {
+		return "", err
+	}
+	_, err = w.git(append([]string{"commit", "-m", w.commitMessage(relPath, section, frontMatter.Participants), "--"}, paths...)...)
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	if w.remote != "" {
+		_, err = w.git("push", "--", w.remote, "HEAD")
+		if err != nil {
+			return "", fmt.Errorf("committed %s, but could not push to %s: %s", relPath, w.remote, err)
+		}
+	}
+
+	if w.webURL != "" {
+		return w.webURL + "/" + filepath.ToSlash(relPath), nil
+	}
+	return fullPath, nil
+}
+
+// Just copy it into the assets directory. It gets committed with the article.
+func (w *GitBridge) uploadImage(path string) (filename string, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Join(w.repoPath, gitAssetsDir), 0755)
+	if err != nil {
+		return "", err
+	}
+	filename = filepath.Base(path)
+	err = os.WriteFile(filepath.Join(w.repoPath, gitAssetsDir, filename), contents, 0644)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// Utility Functions
+
+func gitReposRoot() string {
+	if root := os.Getenv("GIT_REPOS_PATH"); root != "" {
+		return root
+	}
+	return gitDefaultReposPath
+}
+
+// Lowercase, dashes instead of spaces, and nowhere outside the repo
+func (w *GitBridge) articlePath(title string) (relPath string, err error) {
+	var parts []string
+	for _, part := range strings.Split(strings.TrimSuffix(title, ".md"), "/") {
+		part = strings.ToLower(strings.Join(strings.Fields(part), "-"))
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." || strings.HasPrefix(part, ".git") {
+			return "", fmt.Errorf("invalid article path: %s", title)
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("invalid article path: %s", title)
+	}
+	return filepath.Join(parts...) + ".md", nil
+}
+
+func (w *GitBridge) commitMessage(relPath string, section string, participants []string) string {
+	message := "Grab transcript into " + relPath
+	if section != "" {
+		message += " (" + section + ")"
+	}
+	message += "\n\n"
+	if w.thread.Channel != "" {
+		message += "Channel: " + w.thread.Channel + "\n"
+	}
+	message += "Conversation began: " + w.thread.Timestamp.Format(time.RFC3339) + "\n"
+	message += "Participants: " + strings.Join(participants, ", ") + "\n"
+	return message
+}
+
+// Everything is committed as Grab, so it's obvious where it came from
+func (w *GitBridge) git(args ...string) (output string, err error) {
+	var outputBuffer, errorBuffer bytes.Buffer
+
+	cmd := exec.Command("git", append([]string{"-C", w.repoPath}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Grab",
+		"GIT_AUTHOR_EMAIL=grab@localhost",
+		"GIT_COMMITTER_NAME=Grab",
+		"GIT_COMMITTER_EMAIL=grab@localhost",
+		"GIT_TERMINAL_PROMPT=0",
+		// No running things through ext::, or reading other repos on the
+		// server through file://
+		"GIT_ALLOW_PROTOCOL=git:http:https:ssh",
+	)
+	cmd.Stdout = &outputBuffer
+	cmd.Stderr = &errorBuffer
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(errorBuffer.String()))
+	}
+	return outputBuffer.String(), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitBridgeRepoAndRemote(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("GIT_REPOS_PATH", root)
+
+	clone := filepath.Join(root, publicGrabID("grab-id"), "docs")
+	os.MkdirAll(clone, 0755)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", "https://example.com/docs.git"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", clone}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+
+	wiki, err := NewGitBridge(Instance{GrabID: "grab-id", GitRepoPath: "docs", GitRemote: "origin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wiki.repoPath != clone || wiki.remote != "origin" {
+		t.Errorf("expected origin in %s, got %s in %s", clone, wiki.remote, wiki.repoPath)
+	}
+
+	tests := []struct {
+		name     string
+		instance Instance
+	}{
+		{"remote url", Instance{GrabID: "grab-id", GitRepoPath: "docs", GitRemote: "/srv/someone-elses-repo"}},
+		{"option", Instance{GrabID: "grab-id", GitRepoPath: "docs", GitRemote: "--upload-pack=touch /tmp/pwned"}},
+		{"unknown remote", Instance{GrabID: "grab-id", GitRepoPath: "docs", GitRemote: "upstream"}},
+		{"someone else's clone", Instance{GrabID: "another-grab-id", GitRepoPath: "docs"}},
+		{"climbing out", Instance{GrabID: "another-grab-id", GitRepoPath: "../" + publicGrabID("grab-id") + "/docs"}},
+	}
+	for _, test := range tests {
+		if _, err := NewGitBridge(test.instance); err == nil {
+			t.Errorf("%s: set up a git bridge for %+v", test.name, test.instance)
+		}
+	}
+}
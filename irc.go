@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Plain text chat logs, mostly IRC. Every client has its own idea of what a
+// log line looks like, but it's always a timestamp, then a nick, then what
+// they said. We just need to know what the timestamp looks like.
+type IRCLogParser struct {
+	timestamps []IRCTimestampFormat
+	date       time.Time // For logs that only have the time of day
+}
+
+// Pattern's first group is the timestamp, and Layout is how to read it. The
+// whole match gets chopped off the front of the line.
+type IRCTimestampFormat struct {
+	Pattern *regexp.Regexp
+	Layout  string
+}
+
+type IRCLine struct {
+	Time time.Time
+	Nick string
+	Text string
+}
+
+// Which part of the log we want
+type IRCLogSlice struct {
+	From  time.Time
+	To    time.Time
+	Nicks []string
+}
+
+var ircDefaultTimestampFormats = []IRCTimestampFormat{
+	// weechat
+	{regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\t`), "2006-01-02 15:04:05"},
+	// Bouncers and bots that log the whole date
+	{regexp.MustCompile(`^\[(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\]\s`), "2006-01-02 15:04:05"},
+	{regexp.MustCompile(`^\[(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2})\]\s`), "2006-01-02T15:04:05"},
+	// ZNC
+	{regexp.MustCompile(`^\[(\d{2}:\d{2}:\d{2})\]\s`), "15:04:05"},
+	// irssi, with and without seconds
+	{regexp.MustCompile(`^(\d{2}:\d{2}:\d{2})\s`), "15:04:05"},
+	{regexp.MustCompile(`^(\d{2}:\d{2})\s`), "15:04"},
+}
+
+// irssi tells us when the day changes, since it doesn't log the date
+var ircDayChangedRegex = regexp.MustCompile(`^--- Day changed \w+ (\w+ \d+ \d{4})`)
+var ircLogOpenedRegex = regexp.MustCompile(`^--- Log opened \w+ (\w+ \d+) \d{2}:\d{2}:\d{2} (\d{4})`)
+
+var ircMessageRegex = regexp.MustCompile(`^<\s*[~&@%+]?([^>]+)>\s?(.*)$`)
+var ircActionRegex = regexp.MustCompile(`^\*\s+(\S+)\s+(.*)$`)
+var ircColonMessageRegex = regexp.MustCompile(`^[~&@%+]?([^\s:*<>-][^\s:]*):\s(.*)$`)
+var ircFilenameDateRegex = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})`)
+
+// Use our own timestamp format if we got one, otherwise try all the usual
+// suspects.
+func NewIRCLogParser(timePattern string, timeLayout string, date time.Time) (p IRCLogParser, err error) {
+	p.date = date
+	p.timestamps = ircDefaultTimestampFormats
+	if timePattern == "" && timeLayout == "" {
+		return p, nil
+	}
+	if timePattern == "" || timeLayout == "" {
+		return p, fmt.Errorf("a custom timestamp needs both a pattern and a layout")
+	}
+
+	pattern, err := regexp.Compile(timePattern)
+	if err != nil {
+		return p, fmt.Errorf("invalid timestamp pattern: %s", err)
+	}
+	if pattern.NumSubexp() < 1 {
+		return p, fmt.Errorf("timestamp pattern needs a group around the timestamp")
+	}
+	p.timestamps = []IRCTimestampFormat{{pattern, timeLayout}}
+	return p, nil
+}
+
+func NewIRCLogSlice(from string, to string, nicks string) (slice IRCLogSlice, err error) {
+	slice.From, err = parseIRCSliceTime(from)
+	if err != nil {
+		return slice, err
+	}
+	slice.To, err = parseIRCSliceTime(to)
+	if err != nil {
+		return slice, err
+	}
+	// A window ending on a day means the end of that day
+	if len(to) == len("2006-01-02") {
+		slice.To = slice.To.Add(24*time.Hour - time.Second)
+	}
+	slice.Nicks = splitList(nicks)
+	return slice, nil
+}
+
+// Everything the CLI and the upload form need in one go. Read the whole log,
+// then cut out the part we want.
+func ircLogToThread(r io.Reader, filename string, date string, timePattern string, timeLayout string, slice IRCLogSlice) (thread Thread, err error) {
+	day, err := ircLogDate(filename, date)
+	if err != nil {
+		return thread, err
+	}
+	p, err := NewIRCLogParser(timePattern, timeLayout, day)
+	if err != nil {
+		return thread, err
+	}
+	lines, err := p.parse(r)
+	if err != nil {
+		return thread, err
+	}
+	thread = p.linesToThread(lines, slice)
+	if len(thread.Messages) == 0 {
+		return thread, fmt.Errorf("none of the %d messages in %s matched", len(lines), filename)
+	}
+	return thread, nil
+}
+
+// Pull every message out of a log. Joins, parts, mode changes, and the rest
+// of the noise get dropped.
+func (p *IRCLogParser) parse(r io.Reader) (lines []IRCLine, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		raw := strings.TrimRight(scanner.Text(), "\r")
+
+		if match := ircDayChangedRegex.FindStringSubmatch(raw); match != nil {
+			if day, err := time.ParseInLocation("Jan _2 2006", match[1], time.Local); err == nil {
+				p.date = day
+			}
+			continue
+		}
+		if match := ircLogOpenedRegex.FindStringSubmatch(raw); match != nil {
+			if day, err := time.ParseInLocation("Jan _2 2006", match[1]+" "+match[2], time.Local); err == nil {
+				p.date = day
+			}
+			continue
+		}
+
+		line, ok := p.parseLine(raw)
+		if ok {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// Turn the slice of the log we care about into a Thread. People on IRC hit
+// enter a lot, so back-to-back lines from the same nick become one message.
+func (p *IRCLogParser) linesToThread(lines []IRCLine, slice IRCLogSlice) (thread Thread) {
+	for _, line := range lines {
+		if !slice.From.IsZero() && line.Time.Before(slice.From) {
+			continue
+		}
+		if !slice.To.IsZero() && line.Time.After(slice.To) {
+			continue
+		}
+		if len(slice.Nicks) > 0 && !slices.ContainsFunc(slice.Nicks, func(nick string) bool {
+			return strings.EqualFold(nick, line.Nick)
+		}) {
+			continue
+		}
+
+		if len(thread.Messages) == 0 {
+			thread.Timestamp = line.Time
+		} else {
+			last := &thread.Messages[len(thread.Messages)-1]
+			if last.Author == line.Nick && line.Time.Sub(last.Timestamp) < 2*time.Minute {
+				last.Text += "\n\n" + line.Text
+				continue
+			}
+		}
+
+		thread.Messages = append(thread.Messages, Message{
+			Timestamp: line.Time,
+			Author:    line.Nick,
+			Text:      line.Text,
+		})
+	}
+	return thread
+}
+
+// Utility Functions
+
+func (p *IRCLogParser) parseLine(raw string) (line IRCLine, ok bool) {
+	for _, format := range p.timestamps {
+		match := format.Pattern.FindStringSubmatch(raw)
+		if match == nil {
+			continue
+		}
+		t, err := time.ParseInLocation(format.Layout, match[1], time.Local)
+		if err != nil {
+			continue
+		}
+		// No date in the timestamp, so it's whatever day we're on. Some have
+		// the day but not the year, so keep that if it's there.
+		if t.Year() == 0 && t.Month() == time.January && t.Day() == 1 {
+			t = time.Date(p.date.Year(), p.date.Month(), p.date.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+		} else if t.Year() == 0 {
+			t = t.AddDate(p.date.Year(), 0, 0)
+		}
+		line.Time = t
+
+		rest := raw[len(match[0]):]
+		line.Nick, line.Text, ok = p.parseMessage(rest)
+		return line, ok
+	}
+	return line, false
+}
+
+func (p *IRCLogParser) parseMessage(rest string) (nick string, text string, ok bool) {
+	// weechat puts a tab between the nick and the message, and uses arrows
+	// and such in place of the nick for everything that isn't a message
+	if nick, text, found := strings.Cut(rest, "\t"); found {
+		nick = strings.TrimSpace(nick)
+		switch nick {
+		case "", "-->", "<--", "--", "<->", "=!=", "-!-":
+			return "", "", false
+		case "*":
+			nick, text, _ = strings.Cut(text, " ")
+			return nick, "*" + text + "*", nick != ""
+		}
+		return strings.TrimLeft(nick, "~&@%+"), text, true
+	}
+
+	rest = strings.TrimSpace(rest)
+	if match := ircMessageRegex.FindStringSubmatch(rest); match != nil {
+		return strings.TrimSpace(match[1]), match[2], true
+	}
+	if match := ircActionRegex.FindStringSubmatch(rest); match != nil {
+		return match[1], "*" + match[2] + "*", true
+	}
+	// Some loggers do "nick: message" instead
+	if match := ircColonMessageRegex.FindStringSubmatch(rest); match != nil {
+		return match[1], match[2], true
+	}
+	return "", "", false
+}
+
+// Figure out what day a log starts on. irssi will tell us itself, bouncers
+// put it in the filename, and everyone else has to tell us.
+func ircLogDate(filename string, date string) (day time.Time, err error) {
+	if date != "" {
+		return time.ParseInLocation("2006-01-02", date, time.Local)
+	}
+	match := ircFilenameDateRegex.FindStringSubmatch(filepath.Base(filename))
+	if match != nil {
+		day, err = time.ParseInLocation("20060102", match[1]+match[2]+match[3], time.Local)
+		if err == nil {
+			return day, nil
+		}
+	}
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local), nil
+}
+
+// People type the edges of the window in all kinds of ways
+func parseIRCSliceTime(value string) (t time.Time, err error) {
+	if value == "" {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		t, err = time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return t, fmt.Errorf("could not read %s as a time, try YYYY-MM-DD HH:MM", value)
+}
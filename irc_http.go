@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Same thing as `grab import-irc`, but for people who'd rather not SSH into
+// the server to do it. The Grab ID is the password.
+func ircUploadResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		instance, err := selectInstance(db, c.PostForm("grabID"))
+		if err != nil || c.PostForm("grabID") == "" {
+			c.String(http.StatusUnauthorized, "invalid grab id")
+			return
+		}
+
+		fileHeader, err := c.FormFile("log")
+		if err != nil {
+			c.String(http.StatusBadRequest, "missing log file: %s", err.Error())
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error reading log file: %s", err.Error())
+			return
+		}
+		defer file.Close()
+
+		slice, err := NewIRCLogSlice(c.PostForm("from"), c.PostForm("to"), c.PostForm("nicks"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not save article: %s", err)
+			return
+		}
+		thread, err := ircLogToThread(file, fileHeader.Filename, c.PostForm("date"), c.PostForm("timePattern"), c.PostForm("timeLayout"), slice)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not save article: %s", err)
+			return
+		}
+
+		url, err := publishThread(instance, thread, c.PostForm("article"), c.PostForm("section"), c.PostForm("clobber") == "confirmed")
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Could not save article: %s", err)
+			return
+		}
+		c.String(http.StatusOK, "Article saved! You can find it at: %s", url)
+	}
+}
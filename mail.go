@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mailing list archives, as mbox files or Maildirs. Mails get threaded by
+// their References and In-Reply-To headers, same as any mail client would.
+type MailArchive struct {
+	mails []MailMessage
+}
+
+type MailMessage struct {
+	ID        string
+	InReplyTo string
+	Refs      []string
+	Subject   string
+	From      string
+	Date      time.Time
+	raw       []byte
+}
+
+// A thread of mails, and the subject it started with
+type MailThread struct {
+	RootID  string
+	Subject string
+	mails   []MailMessage
+}
+
+var mailIDRegex = regexp.MustCompile(`<[^>]+>`)
+var mailSubjectPrefixRegex = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw)\s*:\s*|\[[^\]]+\]\s*)+`)
+var mailAttributionRegex = regexp.MustCompile(`(?i)^(on .+wrote|.+ schrieb|le .+ a écrit)\s*:\s*$`)
+
+var mailHeaderDecoder = mime.WordDecoder{}
+
+// Read an mbox file, or a Maildir if the path is a directory
+func OpenMailArchive(archivePath string) (a *MailArchive, err error) {
+	a = &MailArchive{}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raws [][]byte
+	if info.IsDir() {
+		raws, err = a.readMaildir(archivePath)
+	} else {
+		raws, err = a.readMbox(archivePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, raw := range raws {
+		m, err := a.parseHeaders(raw)
+		if err != nil {
+			log.Println("Skipping unreadable mail: ", err)
+			continue
+		}
+		a.mails = append(a.mails, m)
+	}
+	return a, nil
+}
+
+// Group mails into threads. Every mail points at its parent, and the root of
+// a thread is whichever ancestor we can't go past.
+func (a *MailArchive) getThreads() (threads []MailThread) {
+	byID := map[string]MailMessage{}
+	for _, m := range a.mails {
+		byID[m.ID] = m
+	}
+
+	rootOf := func(m MailMessage) string {
+		// References lists the whole ancestry, oldest first, so the first one
+		// is the root if we have it or not.
+		if len(m.Refs) > 0 {
+			return m.Refs[0]
+		}
+		seen := map[string]bool{}
+		for m.InReplyTo != "" && !seen[m.ID] {
+			seen[m.ID] = true
+			parent, ok := byID[m.InReplyTo]
+			if !ok {
+				return m.InReplyTo
+			}
+			m = parent
+		}
+		return m.ID
+	}
+
+	threadsByRoot := map[string]*MailThread{}
+	var order []string
+	for _, m := range a.mails {
+		root := rootOf(m)
+		t, ok := threadsByRoot[root]
+		if !ok {
+			t = &MailThread{RootID: root}
+			threadsByRoot[root] = t
+			order = append(order, root)
+		}
+		t.mails = append(t.mails, m)
+	}
+
+	for _, root := range order {
+		t := threadsByRoot[root]
+		sort.SliceStable(t.mails, func(i, j int) bool {
+			return t.mails[i].Date.Before(t.mails[j].Date)
+		})
+		t.Subject = mailSubjectPrefixRegex.ReplaceAllString(t.mails[0].Subject, "")
+		threads = append(threads, *t)
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].mails[0].Date.Before(threads[j].mails[0].Date)
+	})
+	return threads
+}
+
+func (a *MailArchive) conversationToThread(t MailThread) (thread Thread) {
+	thread.Timestamp = t.mails[0].Date
+
+	for _, mail := range t.mails {
+		m := Message{}
+		m.Timestamp = mail.Date
+		m.Author = mail.From
+
+		text, files, err := a.parseBody(mail.raw)
+		if err != nil {
+			log.Printf("Could not read body of %s: %s\n", mail.ID, err)
+		}
+		m.Text = a.stripQuotes(text)
+		m.Files = files
+
+		thread.Messages = append(thread.Messages, m)
+	}
+	return thread
+}
+
+// Utility Functions
+
+// mbox is every mail glued together, each starting with a "From " line.
+// Lines in the body that started with "From " got a ">" stuck on the front.
+func (a *MailArchive) readMbox(mboxPath string) (raws [][]byte, err error) {
+	file, err := os.Open(mboxPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var current *bytes.Buffer
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, []byte("From ")) {
+				if current != nil {
+					raws = append(raws, current.Bytes())
+				}
+				current = &bytes.Buffer{}
+			} else if current != nil {
+				if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+					line = line[1:]
+				}
+				current.Write(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if current != nil {
+		raws = append(raws, current.Bytes())
+	}
+	return raws, nil
+}
+
+// Maildir is one file per mail, in cur/ and new/
+func (a *MailArchive) readMaildir(maildirPath string) (raws [][]byte, err error) {
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(maildirPath, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			raw, err := os.ReadFile(filepath.Join(maildirPath, sub, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			raws = append(raws, raw)
+		}
+	}
+	return raws, nil
+}
+
+func (a *MailArchive) parseHeaders(raw []byte) (m MailMessage, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return m, err
+	}
+	m.raw = raw
+
+	m.ID = mailIDRegex.FindString(msg.Header.Get("Message-ID"))
+	m.InReplyTo = mailIDRegex.FindString(msg.Header.Get("In-Reply-To"))
+	m.Refs = mailIDRegex.FindAllString(msg.Header.Get("References"), -1)
+	if m.InReplyTo == "" && len(m.Refs) > 0 {
+		m.InReplyTo = m.Refs[len(m.Refs)-1]
+	}
+
+	m.Subject, err = mailHeaderDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+
+	from, err := msg.Header.AddressList("From")
+	if err == nil && len(from) > 0 {
+		m.From = from[0].Name
+		if m.From == "" {
+			m.From = from[0].Address
+		}
+	} else {
+		m.From = msg.Header.Get("From")
+	}
+
+	m.Date, err = msg.Header.Date()
+	if err != nil {
+		log.Printf("Could not read date of %s: %s\n", m.ID, err)
+	}
+
+	// Mails with no ID can't be replied to, but they can still be a thread
+	if m.ID == "" {
+		m.ID = fmt.Sprintf("<grab-%d-%s>", m.Date.Unix(), m.Subject)
+	}
+	return m, nil
+}
+
+// Find the text of a mail, and save any pictures attached to it
+func (a *MailArchive) parseBody(raw []byte) (text string, files []string, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", nil, err
+	}
+	var html string
+	err = a.walkPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body, &text, &html, &files)
+	if err != nil {
+		return text, files, err
+	}
+
+	// Some clients only send HTML
+	if text == "" && html != "" {
+		text, err = pandocConvert(html, "html", "markdown")
+	}
+	return text, files, err
+}
+
+func (a *MailArchive) walkPart(contentType string, encoding string, disposition string, body io.Reader, text *string, html *string, files *[]string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			err = a.walkPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part, text, html, files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	body = a.decodeTransfer(encoding, body)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		extensions, _ := mime.ExtensionsByType(mediaType)
+		extension := strings.TrimPrefix(filepath.Ext(params["name"]), ".")
+		if extension == "" && len(extensions) > 0 {
+			extension = strings.TrimPrefix(extensions[0], ".")
+		}
+		path, err := saveTempFile(body, extension)
+		if err != nil {
+			return err
+		}
+		*files = append(*files, path)
+	case mediaType == "text/plain" && !strings.HasPrefix(disposition, "attachment") && *text == "":
+		// Only the first plain text part. The rest are usually the same thing
+		// again, or someone's attached log file.
+		contents, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		*text = strings.ReplaceAll(string(contents), "\r\n", "\n")
+	case mediaType == "text/html" && !strings.HasPrefix(disposition, "attachment") && *html == "":
+		contents, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		*html = string(contents)
+	}
+	return nil
+}
+
+func (a *MailArchive) decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// Drop quoted replies and the "On Tuesday, So-and-so wrote:" line before them.
+// We already have whatever they're quoting.
+func (a *MailArchive) stripQuotes(text string) string {
+	lines := strings.Split(text, "\n")
+	var kept []string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		if mailAttributionRegex.MatchString(trimmed) && i+1 < len(lines) && (strings.HasPrefix(strings.TrimSpace(lines[i+1]), ">") || strings.TrimSpace(lines[i+1]) == "") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
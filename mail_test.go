@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestMailParseBody(t *testing.T) {
+	a := &MailArchive{}
+	alternative := "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nThe build is broken\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>The <b>build</b> is broken</p>\r\n" +
+		"--b--\r\n"
+
+	// The plain text part wins when there is one
+	text, _, err := a.parseBody([]byte(alternative))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "The build is broken" {
+		t.Errorf("unexpected text %q", text)
+	}
+
+	if _, err = exec.LookPath("pandoc"); err != nil {
+		t.Skip("pandoc isn't installed")
+	}
+	htmlOnly := "Content-Type: text/html; charset=utf-8\r\n\r\n<p>The <b>build</b> is broken</p>\r\n"
+	text, _, err = a.parseBody([]byte(htmlOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(text) != "The **build** is broken" {
+		t.Errorf("unexpected text from html %q", text)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"html/template"
 	"log"
 	"net/http"
 	"os"
@@ -24,7 +25,27 @@ type Config struct {
 
 var db *bun.DB
 
-func init() {
+// An extra box on the install form, for platforms that don't do OAuth
+type CredentialField struct {
+	Name        string
+	Type        string
+	Placeholder string
+}
+
+// The last page of every install. It's the only place anybody sees the Grab
+// ID, which the importers and the IRC upload form want as a password.
+func installedPage(c *gin.Context, instance *Instance, message string, next string) {
+	c.HTML(http.StatusOK, "installed.html", gin.H{
+		"Message": message,
+		"GrabID":  instance.GrabID,
+		// Not just http(s), so html/template would blank it out otherwise
+		"Next": template.URL(next),
+	})
+}
+
+// Everything main needs before it can do anything. Not in init(), so tests can
+// run without a database.
+func setup() {
 	// Load environment variables, one way or another
 	err := godotenv.Load()
 	if err != nil {
@@ -48,9 +69,19 @@ func init() {
 }
 
 func main() {
+	setup()
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	app := gin.Default()
 	app.LoadHTMLGlob("templates/*")
 	app.Static("/static", "./static")
+	// Static HTML archives (see archive.go). No directory listings, so you need
+	// the link to find one.
+	app.Static("/archive", archiveRoot())
 
 	slackGroup := app.Group("/slack")
 	installGroup := slackGroup.Group("/install")
@@ -68,30 +99,19 @@ func main() {
 
 		code := c.DefaultQuery("code", "") // Retrieve the code parameter from the query string
 		c.HTML(http.StatusOK, "index.html", gin.H{
-			"Code": code, // Pass the code parameter to the template
+			"Code":   code, // Pass the code parameter to the template
+			"Action": "/slack/install/submit",
 		})
 	})
 
-	// Then, the creds get submitted
-	installGroup.POST("/submit", func(c *gin.Context) {
-		wikiUsername := c.PostForm("username")
-		wikiPassword := c.PostForm("password")
-		wikiUrl := c.PostForm("url")
-		wikiDomain := c.PostForm("domain")
-		code := c.PostForm("code")
-
-		c.Redirect(
-			http.StatusSeeOther,
-			"/slack/install/authorize?code="+code+"&mediaWikiUname="+wikiUsername+"&mediaWikiPword="+wikiPassword+"&mediaWikiURL="+wikiUrl+"&mediaWikiDomain="+wikiDomain,
-		)
-	})
-	// Then we use them while we set up the DB and do Slack things
-	installGroup.Any("/authorize", installResp())
+	// Then, the creds get submitted, and we use them while we set up the DB
+	// and do Slack things. They stay in the POST body, and out of URLs that
+	// end up in logs and browser history.
+	installGroup.POST("/submit", installResp())
 
 	// Serve initial interactions with the bot
 	eventGroup := slackGroup.Group("/event")
 	eventGroup.Use(signatureVerification)
-	//eventGroup.Use(signatureVerification)
 	eventGroup.POST("/handle", eventResp())
 	// eventGroup.POST("/grab", appendResp())
 	// eventGroup.POST("/range", rangeResp())
@@ -100,5 +120,130 @@ func main() {
 	interactionGroup.Use(signatureVerification)
 	interactionGroup.POST("/handle", interactionResp())
 
+	commandGroup := slackGroup.Group("/command")
+	commandGroup.Use(signatureVerification)
+	commandGroup.POST("/handle", commandResp())
+
+	// Or, Slack can send all of that down a websocket instead
+	startSlackSocketMode()
+
+	// Discord does more or less the same dance as Slack
+	discordGroup := app.Group("/discord")
+	discordInstallGroup := discordGroup.Group("/install")
+	discordInstallGroup.GET("/", func(c *gin.Context) {
+		discordError := c.DefaultQuery("error", "")
+		if discordError != "" {
+			c.HTML(http.StatusOK, "error.html", gin.H{
+				"SlackError": discordError,
+				"ErrorDesc":  c.Query("error_description"),
+			})
+			return
+		}
+
+		c.HTML(http.StatusOK, "index.html", gin.H{
+			"Code":   c.DefaultQuery("code", ""),
+			"Action": "/discord/install/submit",
+		})
+	})
+	discordInstallGroup.POST("/submit", discordInstallResp())
+
+	discordInteractionGroup := discordGroup.Group("/interaction")
+	discordInteractionGroup.Use(discordSignatureVerification)
+	discordInteractionGroup.POST("/handle", discordInteractionResp())
+
+	// Matrix just needs a form for the bot's account. The bots themselves
+	// live on /sync.
+	matrixGroup := app.Group("/matrix")
+	matrixGroup.GET("/install/", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "credentials.html", gin.H{
+			"Intro":  "Matrix doesn't have apps, so Grab needs an account of its own. Register a user for it on your homeserver, log in once, and grab the access token from your client's settings.",
+			"Action": "/matrix/install/submit",
+			"Fields": []CredentialField{
+				{Name: "homeserver", Type: "url", Placeholder: "Homeserver URL"},
+				{Name: "accessToken", Type: "password", Placeholder: "Bot Access Token"},
+			},
+		})
+	})
+	matrixGroup.POST("/install/submit", matrixInstallResp())
+	startMatrixBots()
+
+	// Zulip's outgoing webhooks are a lot like Slack's events
+	zulipGroup := app.Group("/zulip")
+	zulipGroup.GET("/install/", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "credentials.html", gin.H{
+			"Intro":  "In Zulip, go to Personal settings > Bots and add an Outgoing webhook bot called Grab, pointed at /zulip/event/handle. Then, give us its API key and the token from its zuliprc.",
+			"Action": "/zulip/install/submit",
+			"Fields": []CredentialField{
+				{Name: "zulipURL", Type: "url", Placeholder: "Zulip URL"},
+				{Name: "botEmail", Type: "email", Placeholder: "Bot Email"},
+				{Name: "apiKey", Type: "password", Placeholder: "Bot API Key"},
+				{Name: "webhookToken", Type: "password", Placeholder: "Outgoing Webhook Token"},
+			},
+		})
+	})
+	zulipGroup.POST("/install/submit", zulipInstallResp())
+	zulipGroup.POST("/event/handle", zulipEventResp())
+
+	// Mattermost is Slack-shaped, but needs a bot account handed to it
+	mattermostGroup := app.Group("/mattermost")
+	mattermostGroup.GET("/install/", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "credentials.html", gin.H{
+			"Intro":  "In Mattermost, go to Integrations > Bot Accounts and add a bot called Grab, then make it an access token.",
+			"Action": "/mattermost/install/submit",
+			"Fields": []CredentialField{
+				{Name: "mattermostURL", Type: "url", Placeholder: "Mattermost URL"},
+				{Name: "team", Type: "text", Placeholder: "Team Name"},
+				{Name: "accessToken", Type: "password", Placeholder: "Bot Access Token"},
+			},
+		})
+	})
+	mattermostGroup.POST("/install/submit", mattermostInstallResp())
+	mattermostGroup.POST("/action/handle", mattermostActionResp())
+	mattermostGroup.POST("/dialog/submit", mattermostDialogResp())
+
+	// Teams talks Bot Framework, and we read conversations through Graph
+	teamsGroup := app.Group("/teams")
+	teamsGroup.GET("/install/", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "credentials.html", gin.H{
+			"Intro":  "Have your Microsoft 365 admin install the Grab Teams app and grant it ChannelMessage.Read.All. Then, tell us where your wiki is, and we'll give you a code to send Grab in Teams.",
+			"Action": "/teams/install/submit",
+		})
+	})
+	teamsGroup.POST("/install/submit", teamsInstallResp())
+	teamsVerifier = newTeamsVerifier()
+	teamsActivityGroup := teamsGroup.Group("/api")
+	teamsActivityGroup.Use(teamsSignatureVerification)
+	teamsActivityGroup.POST("/messages", teamsActivityResp())
+
+	// Telegram bots just need a token, and we set up the webhook ourselves
+	telegramGroup := app.Group("/telegram")
+	telegramGroup.GET("/install/", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "credentials.html", gin.H{
+			"Intro":  "Talk to @BotFather to make a bot called Grab, and turn off its privacy mode with /setprivacy so it can see the messages it's going to save. Then, give us its token.",
+			"Action": "/telegram/install/submit",
+			"Fields": []CredentialField{
+				{Name: "botToken", Type: "password", Placeholder: "Bot Token"},
+			},
+		})
+	})
+	telegramGroup.POST("/install/submit", telegramInstallResp())
+	telegramGroup.POST("/webhook/handle", telegramUpdateResp())
+
+	// IRC doesn't have anything to install, just logs to upload
+	ircGroup := app.Group("/irc")
+	ircGroup.GET("/import/", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "irc.html", gin.H{})
+	})
+	ircGroup.POST("/import/submit", ircUploadResp())
+
+	// Make sure the "Grab thread" command shows up in Discord
+	if os.Getenv("DISCORD_APP_ID") != "" {
+		d := NewDiscordBridge(Instance{})
+		err := d.registerCommands()
+		if err != nil {
+			log.Println("Could not register Discord commands: ", err)
+		}
+	}
+
 	_ = app.Run()
 }
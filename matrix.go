@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type MatrixBridge struct {
+	client      *http.Client
+	homeserver  string
+	accessToken string
+	userID      string
+}
+
+type MatrixRelatesTo struct {
+	RelType   string `json:"rel_type,omitempty"`
+	EventID   string `json:"event_id,omitempty"`
+	Key       string `json:"key,omitempty"`
+	InReplyTo *struct {
+		EventID string `json:"event_id"`
+	} `json:"m.in_reply_to,omitempty"`
+}
+
+type MatrixEvent struct {
+	EventID        string `json:"event_id"`
+	Type           string `json:"type"`
+	Sender         string `json:"sender"`
+	RoomID         string `json:"room_id"`
+	OriginServerTS int64  `json:"origin_server_ts"`
+	Content        struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+		URL     string `json:"url"`
+		Info    struct {
+			Mimetype string `json:"mimetype"`
+		} `json:"info"`
+		RelatesTo MatrixRelatesTo `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+func NewMatrixBridge(instance Instance) (m MatrixBridge) {
+	// Syncs hang around for 30 seconds on purpose, so give them some room
+	m.client = &http.Client{Timeout: time.Second * 60}
+	m.homeserver = strings.TrimSuffix(instance.MatrixHomeserverURL, "/")
+	m.accessToken = instance.MatrixAccessToken
+	m.userID = instance.MatrixUserID
+	return m
+}
+
+// In Matrix, a thread is a root event and everything pointing at it with an
+// m.thread relation.
+func (m *MatrixBridge) getThread(roomID string, threadID string) (thread Thread, err error) {
+	root, err := m.getEvent(roomID, threadID)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	replies, err := m.getThreadRelations(roomID, threadID)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	return m.conversationToThread(append([]MatrixEvent{root}, replies...))
+}
+
+func (m *MatrixBridge) conversationToThread(conversation []MatrixEvent) (thread Thread, err error) {
+	thread.Timestamp = time.UnixMilli(conversation[0].OriginServerTS)
+
+	displayNames := map[string]string{}
+	for _, event := range conversation {
+		// Don't include messages from Grab or that are talking to Grab, or
+		// anything that isn't a message.
+		if event.Sender == m.userID || event.Type != "m.room.message" || m.isGrabCommand(event) {
+			continue
+		}
+
+		msg := Message{}
+		msg.Timestamp = time.UnixMilli(event.OriginServerTS)
+
+		// Translate the user id to a display name. Cache them so we don't
+		// have to hit the API every time
+		if _, ok := displayNames[event.Sender]; !ok {
+			displayNames[event.Sender], err = m.getDisplayName(event.Sender)
+			if err != nil {
+				log.Println(err)
+				displayNames[event.Sender] = event.Sender
+			}
+		}
+		msg.Author = displayNames[event.Sender]
+
+		switch event.Content.MsgType {
+		case "m.image", "m.file", "m.video", "m.audio":
+			path, err := m.getFile(event)
+			if err != nil {
+				log.Println("Could not save file: ", err)
+				continue
+			}
+			msg.Files = append(msg.Files, path)
+		default:
+			msg.Text = m.stripReplyFallback(event)
+		}
+
+		thread.Messages = append(thread.Messages, msg)
+	}
+
+	return thread, nil
+}
+
+// Utility Functions
+
+// "!grab" on its own or with arguments, but not "!grabbed it"
+func (m *MatrixBridge) isGrabCommand(event MatrixEvent) bool {
+	words := strings.Fields(event.Content.Body)
+	return len(words) > 0 && words[0] == matrixGrabCommand
+}
+
+func (m *MatrixBridge) getEvent(roomID string, eventID string) (event MatrixEvent, err error) {
+	endpoint := fmt.Sprintf("/_matrix/client/v3/rooms/%s/event/%s", url.PathEscape(roomID), url.PathEscape(eventID))
+	err = m.request(http.MethodGet, endpoint, nil, &event)
+	return event, err
+}
+
+// Walk every page of the thread, oldest first
+func (m *MatrixBridge) getThreadRelations(roomID string, threadID string) (conversation []MatrixEvent, err error) {
+	from := ""
+	for {
+		endpoint := fmt.Sprintf(
+			"/_matrix/client/v1/rooms/%s/relations/%s/m.thread?dir=f&limit=100",
+			url.PathEscape(roomID), url.PathEscape(threadID),
+		)
+		if from != "" {
+			endpoint += "&from=" + url.QueryEscape(from)
+		}
+
+		var page struct {
+			Chunk     []MatrixEvent `json:"chunk"`
+			NextBatch string        `json:"next_batch"`
+		}
+		err = m.request(http.MethodGet, endpoint, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		conversation = append(conversation, page.Chunk...)
+		if page.NextBatch == "" {
+			break
+		}
+		from = page.NextBatch
+	}
+	return conversation, nil
+}
+
+func (m *MatrixBridge) getDisplayName(userID string) (name string, err error) {
+	var profile struct {
+		DisplayName string `json:"displayname"`
+	}
+	err = m.request(http.MethodGet, fmt.Sprintf("/_matrix/client/v3/profile/%s/displayname", url.PathEscape(userID)), nil, &profile)
+	if err != nil {
+		return "", err
+	}
+	if profile.DisplayName == "" {
+		return userID, nil
+	}
+	return profile.DisplayName, nil
+}
+
+// Pull a file out of the homeserver's media repo. Newer servers want auth
+// for this, older ones only have the unauthenticated endpoint.
+func (m *MatrixBridge) getFile(event MatrixEvent) (path string, err error) {
+	mxc, err := url.Parse(event.Content.URL)
+	if err != nil || mxc.Scheme != "mxc" {
+		return "", fmt.Errorf("invalid media url: %s", event.Content.URL)
+	}
+	mediaPath := mxc.Host + mxc.Path
+
+	extension := strings.TrimPrefix(filepath.Ext(event.Content.Body), ".")
+	if extension == "" {
+		extensions, _ := mime.ExtensionsByType(event.Content.Info.Mimetype)
+		if len(extensions) > 0 {
+			extension = strings.TrimPrefix(extensions[0], ".")
+		}
+	}
+
+	for _, endpoint := range []string{"/_matrix/client/v1/media/download/", "/_matrix/media/v3/download/"} {
+		req, err := http.NewRequest(http.MethodGet, m.homeserver+endpoint+mediaPath, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+m.accessToken)
+
+		rsp, err := m.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if rsp.StatusCode == http.StatusOK {
+			defer rsp.Body.Close()
+			return saveTempFile(rsp.Body, extension)
+		}
+		rsp.Body.Close()
+	}
+
+	return "", fmt.Errorf("could not download %s from homeserver", event.Content.URL)
+}
+
+// Replies carry a quoted copy of whatever they're replying to, which just
+// adds noise to a transcript.
+func (m *MatrixBridge) stripReplyFallback(event MatrixEvent) string {
+	if event.Content.RelatesTo.InReplyTo == nil {
+		return event.Content.Body
+	}
+	lines := strings.Split(event.Content.Body, "\n")
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "> ") {
+		lines = lines[1:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Post a notice into a thread so we don't wake everyone up
+func (m *MatrixBridge) postThreadNotice(roomID string, threadID string, text string) (err error) {
+	content := map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    text,
+		"m.relates_to": map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        threadID,
+			"is_falling_back": true,
+			"m.in_reply_to":   map[string]string{"event_id": threadID},
+		},
+	}
+	endpoint := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", url.PathEscape(roomID), uuid.New())
+	return m.request(http.MethodPut, endpoint, content, nil)
+}
+
+func (m *MatrixBridge) joinRoom(roomID string) (err error) {
+	return m.request(http.MethodPost, fmt.Sprintf("/_matrix/client/v3/join/%s", url.PathEscape(roomID)), map[string]string{}, nil)
+}
+
+func (m *MatrixBridge) request(method string, endpoint string, body interface{}, result interface{}) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, m.homeserver+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("homeserver returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	if result != nil {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Matrix doesn't call us, we call it. Each instance with a Matrix account gets
+// a bot that sits on /sync and waits for someone to ask it for something.
+//
+// "!grab" inside a thread archives that thread. So does reacting to a message
+// with the grab reaction. "!grab Article / Section" picks where it goes.
+const matrixGrabCommand = "!grab"
+const matrixDefaultGrabReaction = "💾"
+
+type matrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []MatrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]interface{} `json:"invite"`
+	} `json:"rooms"`
+}
+
+// We only care about messages and reactions
+const matrixSyncFilter = `{"room":{"timeline":{"types":["m.room.message","m.reaction"]},"state":{"lazy_load_members":true}},"presence":{"types":[]},"account_data":{"types":[]}}`
+
+// Start a bot for every instance that has Matrix set up
+func startMatrixBots() {
+	instances, err := selectMatrixInstances(db)
+	if err != nil {
+		log.Println("Could not get Matrix instances from DB: ", err)
+		return
+	}
+	for _, instance := range instances {
+		go runMatrixBot(instance)
+	}
+}
+
+func runMatrixBot(instance Instance) {
+	m := NewMatrixBridge(instance)
+	log.Printf("Starting Matrix bot %s on %s\n", m.userID, m.homeserver)
+
+	since := ""
+	backoff := time.Second
+	for {
+		sync, err := m.sync(since)
+		if err != nil {
+			log.Printf("Matrix sync for %s failed, retrying in %s: %s\n", m.userID, backoff, err)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		// The first sync is everything that happened before we showed up.
+		// Don't go replaying old commands.
+		if since != "" {
+			m.handleSync(instance, sync)
+		}
+		since = sync.NextBatch
+	}
+}
+
+func (m *MatrixBridge) sync(since string) (sync matrixSyncResponse, err error) {
+	query := url.Values{
+		"timeout": {"30000"},
+		"filter":  {matrixSyncFilter},
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+	err = m.request(http.MethodGet, "/_matrix/client/v3/sync?"+query.Encode(), nil, &sync)
+	return sync, err
+}
+
+func (m *MatrixBridge) handleSync(instance Instance, sync matrixSyncResponse) {
+	// Accept any invite we get. If you can invite it, you can use it.
+	for roomID := range sync.Rooms.Invite {
+		err := m.joinRoom(roomID)
+		if err != nil {
+			log.Printf("Could not join %s: %s\n", roomID, err)
+		}
+	}
+
+	for roomID, room := range sync.Rooms.Join {
+		for _, event := range room.Timeline.Events {
+			if event.Sender == m.userID {
+				continue
+			}
+			event.RoomID = roomID
+
+			switch event.Type {
+			case "m.room.message":
+				if m.isGrabCommand(event) {
+					go m.handleGrabCommand(instance, event)
+				}
+			case "m.reaction":
+				if event.Content.RelatesTo.Key == m.grabReaction() {
+					go m.handleGrabReaction(instance, event)
+				}
+			}
+		}
+	}
+}
+
+// Event Handlers
+
+func (m *MatrixBridge) handleGrabCommand(instance Instance, event MatrixEvent) {
+	// This command only works inside threads.
+	if event.Content.RelatesTo.RelType != "m.thread" {
+		err := m.postNotice(event.RoomID, fmt.Sprintf("'%s' only works inside threads!", matrixGrabCommand))
+		if err != nil {
+			log.Println("Could not respond to Matrix command: ", err)
+		}
+		return
+	}
+
+	args := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(event.Content.Body), matrixGrabCommand))
+	articleTitle, sectionTitle, _ := strings.Cut(args, "/")
+	m.grabAndReply(instance, event.RoomID, event.Content.RelatesTo.EventID, strings.TrimSpace(articleTitle), strings.TrimSpace(sectionTitle))
+}
+
+func (m *MatrixBridge) handleGrabReaction(instance Instance, event MatrixEvent) {
+	target, err := m.getEvent(event.RoomID, event.Content.RelatesTo.EventID)
+	if err != nil {
+		log.Println("Could not get reacted-to Matrix event: ", err)
+		return
+	}
+
+	// Reacting to a reply grabs the whole thread it's in
+	threadID := target.EventID
+	if target.Content.RelatesTo.RelType == "m.thread" {
+		threadID = target.Content.RelatesTo.EventID
+	}
+	m.grabAndReply(instance, event.RoomID, threadID, "", "")
+}
+
+func (m *MatrixBridge) grabAndReply(instance Instance, roomID string, threadID string, articleTitle string, sectionTitle string) {
+	url, err := archiveThread(m, instance, roomID, threadID, articleTitle, sectionTitle, false)
+	responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+	if err != nil {
+		log.Println("Error grabbing Matrix thread: ", err)
+		responseData = fmt.Sprintf("Could not save article: %s", err)
+	}
+
+	err = m.postThreadNotice(roomID, threadID, responseData)
+	if err != nil {
+		log.Println("Could not respond to Matrix command: ", err)
+	}
+}
+
+func (m *MatrixBridge) grabReaction() string {
+	if reaction := os.Getenv("MATRIX_GRAB_REACTION"); reaction != "" {
+		return reaction
+	}
+	return matrixDefaultGrabReaction
+}
+
+// Post a notice into the room itself
+func (m *MatrixBridge) postNotice(roomID string, text string) (err error) {
+	content := map[string]string{
+		"msgtype": "m.notice",
+		"body":    text,
+	}
+	endpoint := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", url.PathEscape(roomID), uuid.New())
+	return m.request(http.MethodPut, endpoint, content, nil)
+}
+
+// Matrix has no app install flow, so we just ask for the bot's account.
+func matrixInstallResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		instance := new(Instance)
+		instance.GrabID = uuid.New().String()
+		instance.MatrixHomeserverURL = c.PostForm("homeserver")
+		instance.MatrixAccessToken = c.PostForm("accessToken")
+		setWikiCredentials(instance, c.PostForm)
+
+		// Make sure the account actually works before we save it
+		m := NewMatrixBridge(*instance)
+		var whoami struct {
+			UserID string `json:"user_id"`
+		}
+		err := m.request(http.MethodGet, "/_matrix/client/v3/account/whoami", nil, &whoami)
+		if err != nil {
+			c.HTML(http.StatusOK, "error.html", gin.H{
+				"SlackError": "Could not log in to Matrix",
+				"ErrorDesc":  err.Error(),
+			})
+			return
+		}
+		instance.MatrixUserID = whoami.UserID
+
+		err = insertInstance(db, instance)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error storing matrix access token: %s", err.Error())
+			return
+		}
+
+		go runMatrixBot(*instance)
+		installedPage(c, instance, fmt.Sprintf("Grab is running as %s. Invite it to a room, then say '%s' in a thread.", whoami.UserID, matrixGrabCommand), "")
+	}
+}
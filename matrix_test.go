@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func matrixMessage(id string, sender string, body string) MatrixEvent {
+	event := MatrixEvent{EventID: id, Type: "m.room.message", Sender: sender, RoomID: "!room:example.org"}
+	event.Content.MsgType = "m.text"
+	event.Content.Body = body
+	return event
+}
+
+// A homeserver that knows about one thread and not much else. Anything it
+// doesn't have an answer for is a 404, like a real one.
+func stubHomeserver(t *testing.T, responses map[string]interface{}) MatrixBridge {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		key := r.URL.Path
+		if from := r.URL.Query().Get("from"); from != "" {
+			key += "?from=" + from
+		}
+		response, ok := responses[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if media, ok := response.([]byte); ok {
+			w.Write(media)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return NewMatrixBridge(Instance{
+		MatrixHomeserverURL: server.URL + "/",
+		MatrixAccessToken:   "token",
+		MatrixUserID:        "@grab:example.org",
+	})
+}
+
+func TestMatrixGetThread(t *testing.T) {
+	root := matrixMessage("$root", "@alice:example.org", "The build is broken")
+	reply := matrixMessage("$reply", "@bob:example.org", "> <@alice:example.org> The build is broken\n\nWorks for me")
+	reply.Content.RelatesTo.InReplyTo = &struct {
+		EventID string `json:"event_id"`
+	}{EventID: "$root"}
+	command := matrixMessage("$command", "@alice:example.org", "!grab Broken Build")
+	notice := matrixMessage("$notice", "@grab:example.org", "Saved!")
+	reaction := matrixMessage("$reaction", "@bob:example.org", "")
+	reaction.Type = "m.reaction"
+	fix := matrixMessage("$fix", "@alice:example.org", "Nevermind, cleared the cache")
+	grabbed := matrixMessage("$grabbed", "@bob:example.org", "!grabbed the logs first")
+
+	relations := "/_matrix/client/v1/rooms/!room:example.org/relations/$root/m.thread"
+	m := stubHomeserver(t, map[string]interface{}{
+		"/_matrix/client/v3/rooms/!room:example.org/event/$root": root,
+		relations:                 map[string]interface{}{"chunk": []MatrixEvent{reply, command, notice}, "next_batch": "page2"},
+		relations + "?from=page2": map[string]interface{}{"chunk": []MatrixEvent{reaction, fix, grabbed}},
+		"/_matrix/client/v3/profile/@alice:example.org/displayname": map[string]string{"displayname": "Alice"},
+	})
+
+	thread, err := m.getThread("!room:example.org", "$root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both pages, minus the command, Grab's answer to it, and the reaction.
+	// Bob has no display name, so the user ID stands in.
+	expected := []Message{
+		{Author: "Alice", Text: "The build is broken"},
+		{Author: "@bob:example.org", Text: "Works for me"},
+		{Author: "Alice", Text: "Nevermind, cleared the cache"},
+		{Author: "@bob:example.org", Text: "!grabbed the logs first"},
+	}
+	if len(thread.Messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %+v", len(expected), thread.Messages)
+	}
+	for i, msg := range thread.Messages {
+		if msg.Author != expected[i].Author || msg.Text != expected[i].Text {
+			t.Errorf("message %d: expected %s: %q, got %s: %q", i, expected[i].Author, expected[i].Text, msg.Author, msg.Text)
+		}
+	}
+}
+
+func TestMatrixIsGrabCommand(t *testing.T) {
+	m := NewMatrixBridge(Instance{})
+	for body, expected := range map[string]bool{
+		"!grab":                   true,
+		"  !grab Outage / Monday": true,
+		"!grab\nOutage":           true,
+		"!grabbed it":             false,
+		"!grab-bag":               false,
+		"please !grab this":       false,
+		"":                        false,
+	} {
+		if m.isGrabCommand(matrixMessage("$event", "@alice:example.org", body)) != expected {
+			t.Errorf("%q: expected %t", body, expected)
+		}
+	}
+}
+
+func TestMatrixGetFile(t *testing.T) {
+	os.MkdirAll("/tmp/grab", 0777)
+
+	// Only the old, unauthenticated media endpoint is around
+	m := stubHomeserver(t, map[string]interface{}{
+		"/_matrix/media/v3/download/example.org/abc123": []byte("not really a png"),
+	})
+
+	image := matrixMessage("$image", "@alice:example.org", "screenshot")
+	image.Content.MsgType = "m.image"
+	image.Content.URL = "mxc://example.org/abc123"
+	image.Content.Info.Mimetype = "image/png"
+
+	path, err := m.getFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if filepath.Ext(path) != ".png" {
+		t.Errorf("expected a .png from the mimetype, got %s", path)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil || string(contents) != "not really a png" {
+		t.Errorf("unexpected file contents %q: %s", contents, err)
+	}
+
+	image.Content.URL = "https://example.org/abc123"
+	if _, err = m.getFile(image); err == nil {
+		t.Error("downloaded something that isn't an mxc url")
+	}
+}
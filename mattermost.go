@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type MattermostBridge struct {
+	client      *http.Client
+	url         string
+	accessToken string
+	botUserID   string
+}
+
+type MattermostFileInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Extension string `json:"extension"`
+	MimeType  string `json:"mime_type"`
+}
+
+type MattermostPost struct {
+	ID        string   `json:"id"`
+	RootID    string   `json:"root_id"`
+	ChannelID string   `json:"channel_id"`
+	UserID    string   `json:"user_id"`
+	Message   string   `json:"message"`
+	Type      string   `json:"type"`
+	CreateAt  int64    `json:"create_at"`
+	FileIDs   []string `json:"file_ids"`
+	Metadata  struct {
+		Files []MattermostFileInfo `json:"files"`
+	} `json:"metadata"`
+}
+
+type MattermostUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+func NewMattermostBridge(instance Instance) (mm MattermostBridge) {
+	mm.client = &http.Client{Timeout: time.Second * 30}
+	mm.url = strings.TrimSuffix(instance.MattermostURL, "/")
+	mm.accessToken = instance.MattermostAccessToken
+	return mm
+}
+
+// Mattermost threads are a root post and its replies. Any post in the thread
+// will get you the whole thing.
+func (mm *MattermostBridge) getThread(channelID string, postID string) (thread Thread, err error) {
+	var postList struct {
+		Order []string                  `json:"order"`
+		Posts map[string]MattermostPost `json:"posts"`
+	}
+	err = mm.request(http.MethodGet, fmt.Sprintf("/api/v4/posts/%s/thread", postID), nil, &postList)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	var conversation []MattermostPost
+	for _, post := range postList.Posts {
+		conversation = append(conversation, post)
+	}
+	sort.Slice(conversation, func(i, j int) bool {
+		return conversation[i].CreateAt < conversation[j].CreateAt
+	})
+
+	return mm.conversationToThread(conversation)
+}
+
+func (mm *MattermostBridge) conversationToThread(conversation []MattermostPost) (thread Thread, err error) {
+	if len(conversation) == 0 {
+		return Thread{}, fmt.Errorf("no posts in thread")
+	}
+
+	// Get the bot's userID
+	if mm.botUserID == "" {
+		var me MattermostUser
+		err = mm.request(http.MethodGet, "/api/v4/users/me", nil, &me)
+		if err != nil {
+			return Thread{}, err
+		}
+		mm.botUserID = me.ID
+	}
+
+	// The root post is when this party started
+	thread.Timestamp = time.UnixMilli(conversation[0].CreateAt)
+
+	conversationUsers := map[string]string{}
+	for _, post := range conversation {
+		// Don't include posts from Grab, or system posts (joins, headers, etc)
+		if post.UserID == mm.botUserID || post.Type != "" {
+			continue
+		}
+
+		m := Message{}
+		m.Timestamp = time.UnixMilli(post.CreateAt)
+
+		// Translate the user id to a user name. Cache them so we don't have
+		// to hit the API every time
+		if len(conversationUsers[post.UserID]) == 0 {
+			var user MattermostUser
+			err = mm.request(http.MethodGet, "/api/v4/users/"+post.UserID, nil, &user)
+			if err != nil {
+				log.Println(err)
+			} else {
+				conversationUsers[post.UserID] = user.Username
+			}
+		}
+		m.Author = conversationUsers[post.UserID]
+
+		// Mattermost already speaks markdown
+		m.Text = post.Message
+
+		for _, file := range post.Metadata.Files {
+			path, err := mm.getFile(file)
+			if err != nil {
+				log.Println("Could not save file: ", err)
+				continue
+			}
+			m.Files = append(m.Files, path)
+		}
+
+		thread.Messages = append(thread.Messages, m)
+	}
+
+	return thread, nil
+}
+
+// Utility Functions
+
+func (mm *MattermostBridge) getFile(file MattermostFileInfo) (path string, err error) {
+	req, err := http.NewRequest(http.MethodGet, mm.url+"/api/v4/files/"+file.ID, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+mm.accessToken)
+
+	rsp, err := mm.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting file from Mattermost: %s", rsp.Status)
+	}
+
+	return saveTempFile(rsp.Body, file.Extension)
+}
+
+func (mm *MattermostBridge) getTeamByName(name string) (teamID string, err error) {
+	var team struct {
+		ID string `json:"id"`
+	}
+	err = mm.request(http.MethodGet, "/api/v4/teams/name/"+name, nil, &team)
+	return team.ID, err
+}
+
+func (mm *MattermostBridge) postEphemeral(channelID string, rootID string, userID string, message string) (err error) {
+	body := map[string]interface{}{
+		"user_id": userID,
+		"post": map[string]string{
+			"channel_id": channelID,
+			"root_id":    rootID,
+			"message":    message,
+		},
+	}
+	return mm.request(http.MethodPost, "/api/v4/posts/ephemeral", body, nil)
+}
+
+func (mm *MattermostBridge) openDialog(triggerID string, dialog interface{}) (err error) {
+	body := map[string]interface{}{
+		"trigger_id": triggerID,
+		"url":        strings.TrimSuffix(os.Getenv("GRAB_URL"), "/") + "/mattermost/dialog/submit",
+		"dialog":     dialog,
+	}
+	return mm.request(http.MethodPost, "/api/v4/actions/dialogs/open", body, nil)
+}
+
+func (mm *MattermostBridge) request(method string, endpoint string, body interface{}, result interface{}) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, mm.url+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+mm.accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := mm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("mattermost returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	if result != nil {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
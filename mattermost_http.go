@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// What Mattermost sends when someone clicks an integration action
+type MattermostActionRequest struct {
+	UserID    string                 `json:"user_id"`
+	ChannelID string                 `json:"channel_id"`
+	TeamID    string                 `json:"team_id"`
+	PostID    string                 `json:"post_id"`
+	TriggerID string                 `json:"trigger_id"`
+	Context   map[string]interface{} `json:"context"`
+}
+
+// What Mattermost sends when someone submits an interactive dialog
+type MattermostDialogSubmission struct {
+	CallbackID string                 `json:"callback_id"`
+	State      string                 `json:"state"`
+	UserID     string                 `json:"user_id"`
+	ChannelID  string                 `json:"channel_id"`
+	TeamID     string                 `json:"team_id"`
+	Submission map[string]interface{} `json:"submission"`
+	Cancelled  bool                   `json:"cancelled"`
+}
+
+const MattermostGrabThread = "grab_thread"
+
+// Mattermost doesn't have an app directory, so an admin hands us a bot
+// account and we hand back the token the "Grab thread" action has to send.
+func mattermostInstallResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		instance := new(Instance)
+		instance.GrabID = uuid.New().String()
+		instance.MattermostURL = c.PostForm("mattermostURL")
+		instance.MattermostAccessToken = c.PostForm("accessToken")
+		instance.MattermostActionToken = uuid.New().String()
+		setWikiCredentials(instance, c.PostForm)
+
+		mm := NewMattermostBridge(*instance)
+		teamID, err := mm.getTeamByName(c.PostForm("team"))
+		if err != nil {
+			c.HTML(http.StatusOK, "error.html", gin.H{
+				"SlackError": "Could not find Mattermost team",
+				"ErrorDesc":  err.Error(),
+			})
+			return
+		}
+		instance.MattermostTeamID = teamID
+
+		err = insertInstance(db, instance)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error storing mattermost access token: %s", err.Error())
+			return
+		}
+		installedPage(c, instance, fmt.Sprintf("Grab is ready! Point your 'Grab thread' post menu action at /mattermost/action/handle, and have it send {\"token\": \"%s\"} as its context.", instance.MattermostActionToken), "")
+	}
+}
+
+func mattermostActionResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var payload MattermostActionRequest
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading mattermost action payload: %s", err.Error())
+			return
+		}
+
+		// Pull credentials out of DB
+		instance, err := selectInstanceByMattermostTeamID(db, payload.TeamID)
+		if err != nil {
+			log.Println("Could not get credentials from DB", err)
+			c.String(http.StatusInternalServerError, "error reading mattermost access token: %s", err.Error())
+			return
+		}
+		if !validActionToken(payload, instance) {
+			c.String(http.StatusUnauthorized, "invalid mattermost action token")
+			return
+		}
+
+		mm := NewMattermostBridge(instance)
+		err = mm.handlePostAction(payload, instance)
+		if err != nil {
+			log.Println("Error handling post action: ", err)
+			c.String(http.StatusInternalServerError, "Error handling post action: %s", err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{})
+	}
+}
+
+func mattermostDialogResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var payload MattermostDialogSubmission
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading mattermost dialog payload: %s", err.Error())
+			return
+		}
+		if payload.Cancelled {
+			c.JSON(http.StatusOK, gin.H{})
+			return
+		}
+
+		// Pull credentials out of DB
+		instance, err := selectInstanceByMattermostTeamID(db, payload.TeamID)
+		if err != nil {
+			log.Println("Could not get credentials from DB", err)
+			c.String(http.StatusInternalServerError, "error reading mattermost access token: %s", err.Error())
+			return
+		}
+
+		mm := NewMattermostBridge(instance)
+		err = mm.handleDialogSubmission(c, payload, instance)
+		if err != nil {
+			log.Println("Error handling dialog submission: ", err)
+			c.String(http.StatusInternalServerError, "Error handling dialog submission: %s", err.Error())
+		}
+	}
+}
+
+// The action's context is set by whoever installed Grab, so it's the only
+// thing that says a request came from their Mattermost.
+func validActionToken(payload MattermostActionRequest, instance Instance) bool {
+	token, _ := payload.Context["token"].(string)
+	return len(token) > 0 && hmac.Equal([]byte(token), []byte(instance.MattermostActionToken))
+}
+
+// Interaction Handlers
+
+func (mm *MattermostBridge) handlePostAction(payload MattermostActionRequest, instance Instance) (err error) {
+	// Work from the root post, so we can answer inside the thread later
+	var post MattermostPost
+	err = mm.request(http.MethodGet, "/api/v4/posts/"+payload.PostID, nil, &post)
+	if err != nil {
+		return err
+	}
+	rootID := post.RootID
+	if rootID == "" {
+		rootID = post.ID
+	}
+
+	dialog := mm.generateTitleDialog(payload.ChannelID, rootID, payload.UserID, instance)
+	return mm.openDialog(payload.TriggerID, dialog)
+}
+
+func (mm *MattermostBridge) handleDialogSubmission(c *gin.Context, payload MattermostDialogSubmission, instance Instance) (err error) {
+	// Make sure this is a dialog we actually opened
+	messageContext := strings.Split(payload.State, ",")
+	if payload.CallbackID != MattermostGrabThread || len(messageContext) != 4 {
+		c.String(http.StatusBadRequest, "Invalid dialog: %s", payload.CallbackID)
+		return nil
+	}
+	channelID := messageContext[0]
+	postID := messageContext[1]
+	userID := messageContext[2]
+	if !hmac.Equal([]byte(messageContext[3]), []byte(mm.signState(channelID, postID, userID, instance))) {
+		c.String(http.StatusUnauthorized, "invalid dialog state")
+		return nil
+	}
+
+	articleTitle, _ := payload.Submission["articleTitle"].(string)
+	sectionTitle, _ := payload.Submission["sectionTitle"].(string)
+	clobber, _ := payload.Submission["clobber"].(bool)
+
+	// ACK so we don't die when eating large threads
+	c.JSON(http.StatusOK, gin.H{})
+
+	go func() {
+		url, err := archiveThread(mm, instance, channelID, postID, articleTitle, sectionTitle, clobber)
+		responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+		if err != nil {
+			log.Println("Error grabbing Mattermost thread: ", err)
+			responseData = fmt.Sprintf("Could not save article: %s", err)
+		}
+		err = mm.postEphemeral(channelID, postID, userID, responseData)
+		if err != nil {
+			log.Println("Could not respond to Mattermost dialog: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// Same form as generateTitleFormRequest, but in Mattermost's words.
+func (mm *MattermostBridge) generateTitleDialog(channelID string, postID string, userID string, instance Instance) map[string]interface{} {
+	clobberWarning := "By selecting this, any data already present under the provided article/section will be ERASED."
+	return map[string]interface{}{
+		"callback_id":       MattermostGrabThread,
+		"title":             "Grab a thread",
+		"introduction_text": "Saving thread transcript! Please provide some article info. You can specify existing articles and sections, or come up with new ones.",
+		"submit_label":      "Submit",
+		"state":             strings.Join([]string{channelID, postID, userID, mm.signState(channelID, postID, userID, instance)}, ","),
+		"elements": []map[string]interface{}{
+			{
+				"display_name": "Article Title",
+				"name":         "articleTitle",
+				"type":         "text",
+				"placeholder":  "Article Title",
+				"optional":     true,
+			},
+			{
+				"display_name": "Section Title",
+				"name":         "sectionTitle",
+				"type":         "text",
+				"placeholder":  "Section Title",
+				"optional":     true,
+			},
+			{
+				"display_name": "Overwrite existing content",
+				"name":         "clobber",
+				"type":         "bool",
+				"help_text":    clobberWarning,
+				"optional":     true,
+			},
+		},
+	}
+}
+
+// Dialog submissions don't carry the action token, so sign the state we
+// stuff into them instead.
+func (mm *MattermostBridge) signState(channelID string, postID string, userID string, instance Instance) string {
+	mac := hmac.New(sha256.New, []byte(instance.MattermostActionToken))
+	mac.Write([]byte(channelID + "," + postID + "," + userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A Mattermost with one thread in it. Dialogs and ephemeral posts Grab sends
+// come out on the channels.
+func fakeMattermost(t *testing.T, dialogs chan map[string]interface{}, ephemerals chan map[string]interface{}) string {
+	root := MattermostPost{ID: "root", ChannelID: "town-square", UserID: "alice", Message: "Is prod down?", CreateAt: 1000}
+	reply := MattermostPost{ID: "reply", RootID: "root", ChannelID: "town-square", UserID: "bob", Message: "Looks like it, here's the log", CreateAt: 2000}
+	reply.Metadata.Files = []MattermostFileInfo{{ID: "log", Name: "prod.log", Extension: "txt", MimeType: "text/plain"}}
+	joined := MattermostPost{ID: "joined", RootID: "root", ChannelID: "town-square", UserID: "carol", Type: "system_join_channel", CreateAt: 3000}
+	notice := MattermostPost{ID: "notice", RootID: "root", ChannelID: "town-square", UserID: "grab", Message: "Article saved!", CreateAt: 4000}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer bot token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v4/posts/reply":
+			json.NewEncoder(w).Encode(reply)
+		case "GET /api/v4/posts/root/thread":
+			// Mattermost doesn't promise the map comes back in any order
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"order": []string{"notice", "joined", "reply", "root"},
+				"posts": map[string]MattermostPost{"root": root, "reply": reply, "joined": joined, "notice": notice},
+			})
+		case "GET /api/v4/users/me":
+			json.NewEncoder(w).Encode(MattermostUser{ID: "grab", Username: "grab"})
+		case "GET /api/v4/users/alice", "GET /api/v4/users/bob":
+			json.NewEncoder(w).Encode(MattermostUser{ID: filepath.Base(r.URL.Path), Username: filepath.Base(r.URL.Path)})
+		case "GET /api/v4/files/log":
+			w.Write([]byte("panic: assignment to entry in nil map"))
+		case "POST /api/v4/actions/dialogs/open":
+			dialogs <- body
+			w.Write([]byte("{}"))
+		case "POST /api/v4/posts/ephemeral":
+			ephemerals <- body
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func submitMattermostDialog(mm *MattermostBridge, instance Instance, state string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	mm.handleDialogSubmission(c, MattermostDialogSubmission{
+		CallbackID: MattermostGrabThread,
+		State:      state,
+		Submission: map[string]interface{}{"articleTitle": "Prod Outage"},
+	}, instance)
+	return w
+}
+
+func TestMattermostGrabThread(t *testing.T) {
+	os.MkdirAll("/tmp/grab", 0777)
+	useUnreachableDB(t)
+	vault := t.TempDir()
+	t.Setenv("OBSIDIAN_VAULT_PATH", vault)
+
+	dialogs := make(chan map[string]interface{}, 1)
+	ephemerals := make(chan map[string]interface{}, 1)
+	instance := Instance{
+		GrabID:                "grab-id",
+		MattermostURL:         fakeMattermost(t, dialogs, ephemerals) + "/",
+		MattermostAccessToken: "bot token",
+		MattermostActionToken: "action token",
+	}
+	mm := NewMattermostBridge(instance)
+
+	// Only the token Grab handed out at install will do
+	action := MattermostActionRequest{UserID: "alice", ChannelID: "town-square", PostID: "reply", TriggerID: "trigger"}
+	for _, token := range []interface{}{nil, "", "someone else's token", 42} {
+		action.Context = map[string]interface{}{"token": token}
+		if validActionToken(action, instance) {
+			t.Errorf("accepted action token %v", token)
+		}
+	}
+	action.Context = map[string]interface{}{"token": "action token"}
+	if !validActionToken(action, instance) {
+		t.Fatal("rejected the right action token")
+	}
+
+	// Clicking on a reply opens the dialog for the whole thread
+	err := mm.handlePostAction(action, instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialog map[string]interface{}
+	select {
+	case body := <-dialogs:
+		if body["trigger_id"] != "trigger" {
+			t.Errorf("dialog opened with the wrong trigger: %v", body["trigger_id"])
+		}
+		dialog, _ = body["dialog"].(map[string]interface{})
+	default:
+		t.Fatal("no dialog was opened")
+	}
+	state, _ := dialog["state"].(string)
+	if !strings.HasPrefix(state, "town-square,root,alice,") {
+		t.Fatalf("unexpected dialog state %q", state)
+	}
+
+	// Dialog state that Grab didn't sign gets nowhere
+	signature := strings.Split(state, ",")[3]
+	otherInstance := instance
+	otherInstance.MattermostActionToken = "someone else's token"
+	for _, forged := range []string{
+		"town-square,notice,alice," + signature,
+		"town-square,root,mallory," + signature,
+		"town-square,root,alice," + mm.signState("town-square", "root", "alice", otherInstance),
+		"town-square,root,alice",
+	} {
+		w := submitMattermostDialog(&mm, instance, forged)
+		if w.Code == http.StatusOK {
+			t.Errorf("accepted dialog state %q", forged)
+		}
+	}
+
+	w := submitMattermostDialog(&mm, instance, state)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the dialog to be acked, got %d: %s", w.Code, w.Body.String())
+	}
+	select {
+	case body := <-ephemerals:
+		post, _ := body["post"].(map[string]interface{})
+		message, _ := post["message"].(string)
+		if body["user_id"] != "alice" || post["root_id"] != "root" || !strings.HasPrefix(message, "Article saved!") {
+			t.Fatalf("unexpected answer %+v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("never heard back about the grab")
+	}
+
+	// Oldest first, without Grab's own posts or system messages, and the log
+	// file inlined
+	note, err := os.ReadFile(filepath.Join(vault, "grab-id", "Prod Outage.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := string(note)
+	alice := strings.Index(transcript, "**alice**: Is prod down?")
+	bob := strings.Index(transcript, "**bob**: Looks like it, here's the log")
+	if alice < 0 || bob < alice {
+		t.Errorf("messages missing or out of order:\n%s", transcript)
+	}
+	if !strings.Contains(transcript, "```\npanic: assignment to entry in nil map\n```") {
+		t.Errorf("log file wasn't included:\n%s", transcript)
+	}
+	if strings.Contains(transcript, "Article saved!") || strings.Contains(transcript, "carol") {
+		t.Errorf("transcript has posts it shouldn't:\n%s", transcript)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"net/http/cookiejar"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -348,25 +347,5 @@ func (w *MediaWikiBridge) findSectionId(title string, section string) (id string
 }
 
 func (w *MediaWikiBridge) markdownToMediaWikiMarkup(md string) (mu string, err error) {
-	// Create a buffer to store the command output
-	var outputBuffer bytes.Buffer
-
-	// Set up the Pandoc command
-	cmd := exec.Command("pandoc", "-f", "markdown", "-t", "mediawiki")
-
-	// Pipe the input string to Pandoc's standard input
-	cmd.Stdin = bytes.NewBufferString(md)
-
-	// Set Pandoc's standard output to our buffer
-	cmd.Stdout = &outputBuffer
-
-	// Run the Pandoc command
-	err = cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("failed to run Pandoc: %v", err)
-	}
-
-	// Convert the buffer to a string and return
-	mu = outputBuffer.String()
-	return mu, nil
+	return pandocConvert(md, "markdown", "mediawiki")
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Markdown notes in a directory, laid out the way Obsidian likes them. No
+// service to talk to, so this is also what you get if you haven't set up a
+// wiki yet.
+const obsidianDefaultVaultPath = "vault"
+
+// Every note links to a note for its channel, which links back to all of them
+const obsidianChannelsDir = "Channels"
+
+// Attachments go in here, next to the note they're in
+const obsidianAttachmentsDir = "attachments"
+
+// Obsidian (and Windows, and Android) won't have these in file names
+var obsidianUnsafeChars = strings.NewReplacer(
+	"*", "", "\"", "", "\\", "", "<", "", ">", "",
+	":", "-", "|", "-", "?", "", "#", "", "^", "", "[", "", "]", "",
+)
+
+type ObsidianBridge struct {
+	vaultPath string
+
+	// generateTranscript hangs onto this for the front matter
+	thread Thread
+
+	// We don't know where the note goes until uploadArticle, so attachments
+	// wait here until then
+	pendingFiles []string
+}
+
+func NewObsidianBridge(instance Instance) (wiki ObsidianBridge, err error) {
+	root := obsidianDefaultVaultPath
+	if envPath := os.Getenv("OBSIDIAN_VAULT_PATH"); envPath != "" {
+		root = envPath
+	}
+	// Don't go mixing up everyone's notes. A vault picked on the install form
+	// is just a folder in there.
+	wiki.vaultPath, err = confinePath(filepath.Join(root, instance.GrabID), instance.ObsidianVaultPath)
+	if err != nil {
+		return ObsidianBridge{}, err
+	}
+
+	err = os.MkdirAll(wiki.vaultPath, 0755)
+	if err != nil {
+		return ObsidianBridge{}, err
+	}
+	return wiki, nil
+}
+
+func (w *ObsidianBridge) generateTranscript(thread Thread) (transcript string) {
+	w.thread = thread
+
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "Transcript generated at " + currentTime + ".\n\n"
+	transcript += "Conversation begins at " + transcriptBegin + ".\n\n"
+
+	for _, m := range thread.Messages {
+		transcript += "**" + m.Author + "**: " + strings.TrimSpace(m.Text) + "\n\n"
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				transcript += "```\n" + string(fileContents) + "\n```\n\n"
+				continue
+			}
+
+			// Pictures and everything else get embedded, and Obsidian
+			// figures out what to do with them
+			filename, err := w.uploadImage(path)
+			if err != nil {
+				log.Println("Could not save attachment: ", err)
+				continue
+			}
+			transcript += fmt.Sprintf("![[%s]]\n\n", filename)
+		}
+	}
+
+	return transcript
+}
+
+// Titles are paths in the vault, like "Incidents/Big Outage". Sections are
+// "## Section" headings, and work the same as they do on MediaWiki.
+func (w *ObsidianBridge) uploadArticle(title string, section string, transcript string, clobber bool) (noteURL string, err error) {
+	notePath, err := w.notePath(title)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(w.vaultPath, notePath+".md")
+
+	existing, err := os.ReadFile(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	frontMatter, body := parseFrontMatter(string(existing))
+	if frontMatter.Title == "" {
+		frontMatter.Title = filepath.Base(notePath)
+	}
+	channel := w.cleanName(w.thread.Channel)
+	if frontMatter.Channel == "" && channel != "" {
+		// Properties can be links too, which puts it on the graph
+		frontMatter.Channel = "[[" + obsidianChannelsDir + "/" + channel + "]]"
+	}
+	if frontMatter.Date == "" || (section == "" && clobber) {
+		frontMatter.Date = w.thread.Timestamp.Format(time.RFC3339)
+	}
+	names := w.thread.getNames()
+	frontMatter.Participants = mergeUnique(frontMatter.Participants, names)
+	frontMatter.Tags = mergeUnique(frontMatter.Tags, w.tags(channel, names))
+
+	err = os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// Copy attachments in next to the note
+	for _, path := range w.pendingFiles {
+		err = w.copyAttachment(path, filepath.Join(filepath.Dir(fullPath), obsidianAttachmentsDir))
+		if err != nil {
+			log.Println("Could not save attachment: ", err)
+		}
+		os.Remove(path)
+	}
+	w.pendingFiles = nil
+
+	body = mergeMarkdownSection(body, section, transcript, clobber)
+	err = os.WriteFile(fullPath, []byte(formatFrontMatter(frontMatter)+body), 0644)
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	if channel != "" {
+		err = w.linkFromChannel(channel, notePath)
+		if err != nil {
+			log.Println("Could not update channel note: ", err)
+		}
+	}
+
+	// Opens the note, if you've got the vault open in Obsidian
+	query := "vault=" + url.PathEscape(filepath.Base(w.vaultPath)) + "&file=" + url.PathEscape(notePath)
+	return "obsidian://open?" + query, nil
+}
+
+// Nowhere to upload it to, so it just waits to be copied into the vault
+func (w *ObsidianBridge) uploadImage(path string) (filename string, err error) {
+	w.pendingFiles = append(w.pendingFiles, path)
+	return filepath.Base(path), nil
+}
+
+// Utility Functions
+
+// Keep the title's case and spaces, since that's what shows up in Obsidian,
+// but nowhere outside the vault
+func (w *ObsidianBridge) notePath(title string) (notePath string, err error) {
+	var parts []string
+	for _, part := range strings.Split(strings.TrimSuffix(title, ".md"), "/") {
+		part = w.cleanName(part)
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid note path: %s", title)
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("invalid note path: %s", title)
+	}
+	return filepath.Join(parts...), nil
+}
+
+func (w *ObsidianBridge) cleanName(name string) string {
+	name = strings.ReplaceAll(name, "/", "-")
+	return strings.TrimSpace(obsidianUnsafeChars.Replace(name))
+}
+
+// Tags can't have spaces, so "Jane Doe" is #person/Jane-Doe
+func (w *ObsidianBridge) tags(channel string, names []string) (tags []string) {
+	tags = append(tags, "grab")
+	if channel != "" {
+		tags = append(tags, "channel/"+strings.Join(strings.Fields(channel), "-"))
+	}
+	for _, name := range names {
+		tag := strings.Join(strings.Fields(w.cleanName(name)), "-")
+		if tag != "" {
+			tags = append(tags, "person/"+tag)
+		}
+	}
+	return tags
+}
+
+func (w *ObsidianBridge) copyAttachment(path string, directory string) (err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(directory, filepath.Base(path)), contents, 0644)
+}
+
+// The channel note is just a list of everything grabbed from that channel
+func (w *ObsidianBridge) linkFromChannel(channel string, notePath string) (err error) {
+	channelPath := filepath.Join(w.vaultPath, obsidianChannelsDir, channel+".md")
+	link := "- [[" + filepath.ToSlash(notePath) + "]]"
+
+	existing, err := os.ReadFile(channelPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(existing), "\n") {
+		if line == link {
+			return nil
+		}
+	}
+
+	text := strings.TrimRight(string(existing), "\n") + "\n"
+	if len(existing) == 0 {
+		text = "# " + channel + "\n\nConversations grabbed from " + channel + ".\n\n"
+	}
+	err = os.MkdirAll(filepath.Dir(channelPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(channelPath, []byte(text+link+"\n"), 0644)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Outline keeps documents in collections, and everything's markdown. Titles
+// can pick a collection, like "Collection > Document". Anything else goes in
+// whichever collection was set up on the install form.
+const outlineTitleSeparator = " > "
+
+// How many things Outline will give us at once
+const outlinePageSize = 100
+
+type OutlineBridge struct {
+	client     *http.Client
+	url        string
+	token      string
+	collection string // Name or ID, might be empty
+}
+
+type OutlineCollection struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type OutlineDocument struct {
+	ID           string `json:"id"`
+	CollectionID string `json:"collectionId"`
+	Title        string `json:"title"`
+	Text         string `json:"text"`
+	URL          string `json:"url"`
+}
+
+// Outline doesn't use status codes for much, it tells you in here instead
+type OutlineError struct {
+	Status  int    `json:"status"`
+	Err     string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e OutlineError) Error() string {
+	return fmt.Sprintf("outline returned %d %s: %s", e.Status, e.Err, e.Message)
+}
+
+func NewOutlineBridge(instance Instance) (wiki OutlineBridge, err error) {
+	wiki.client = &http.Client{Timeout: time.Second * 30}
+	wiki.url = strings.TrimSuffix(instance.OutlineURL, "/")
+	wiki.token = instance.OutlineToken
+	wiki.collection = instance.OutlineCollection
+
+	// Make sure the API key works
+	err = wiki.request("auth.info", map[string]interface{}{}, nil)
+	if err != nil {
+		return OutlineBridge{}, err
+	}
+	return wiki, nil
+}
+
+func (w *OutlineBridge) generateTranscript(thread Thread) (transcript string) {
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "Transcript generated at " + currentTime + ".\n\n"
+	transcript += "Conversation begins at " + transcriptBegin + ".\n\n"
+
+	for _, m := range thread.Messages {
+		transcript += "**" + m.Author + "**: " + strings.TrimSpace(m.Text) + "\n\n"
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				attachmentURL, err := w.uploadImage(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				transcript += fmt.Sprintf("![](%s)\n\n", attachmentURL)
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				transcript += "```\n" + string(fileContents) + "\n```\n\n"
+			}
+		}
+	}
+
+	return transcript
+}
+
+// Sections are markdown headings, and work the same as they do on MediaWiki.
+func (w *OutlineBridge) uploadArticle(title string, section string, transcript string, clobber bool) (documentURL string, err error) {
+	collectionName, documentTitle := w.splitTitle(title)
+	if documentTitle == "" {
+		return "", fmt.Errorf("invalid outline title: %s", title)
+	}
+	collection, err := w.findCollection(collectionName)
+	if err != nil {
+		return "", err
+	}
+
+	document, found, err := w.findDocument(collection.ID, documentTitle)
+	if err != nil {
+		return "", err
+	}
+
+	var result OutlineDocument
+	if found {
+		text := mergeMarkdownSection(document.Text, section, transcript, clobber)
+		err = w.request("documents.update", map[string]interface{}{
+			"id":      document.ID,
+			"text":    text,
+			"publish": true,
+		}, &result)
+	} else {
+		text := mergeMarkdownSection("", section, transcript, clobber)
+		err = w.request("documents.create", map[string]interface{}{
+			"title":        documentTitle,
+			"text":         text,
+			"collectionId": collection.ID,
+			"publish":      true,
+		}, &result)
+	}
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	return w.url + result.URL, nil
+}
+
+// Outline hands out somewhere to put the file (itself, or S3), and a link
+// that'll redirect to it once it's there
+func (w *OutlineBridge) uploadImage(path string) (attachmentURL string, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var attachment struct {
+		UploadURL  string            `json:"uploadUrl"`
+		Form       map[string]string `json:"form"`
+		Attachment struct {
+			URL string `json:"url"`
+		} `json:"attachment"`
+	}
+	err = w.request("attachments.create", map[string]interface{}{
+		"name":        filepath.Base(path),
+		"contentType": mimetype.Detect(contents).String(),
+		"size":        len(contents),
+		"preset":      "documentAttachment",
+	}, &attachment)
+	if err != nil {
+		return "", err
+	}
+
+	// Whatever's in the form has to go before the file
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, value := range attachment.Form {
+		writer.WriteField(key, value)
+	}
+	fw, err := writer.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	fw.Write(contents)
+	writer.Close()
+
+	uploadURL := attachment.UploadURL
+	local := strings.HasPrefix(uploadURL, "/")
+	if local {
+		uploadURL = w.url + uploadURL
+	}
+	req, err := http.NewRequest(http.MethodPost, uploadURL, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if local {
+		// Only Outline gets the key, not whatever bucket it's using
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		responseBody, _ := io.ReadAll(rsp.Body)
+		return "", fmt.Errorf("could not upload to outline: %s: %s", rsp.Status, string(responseBody))
+	}
+
+	return attachment.Attachment.URL, nil
+}
+
+// Utility Functions
+
+// "Engineering > Big Outage" goes in Engineering, and "Big Outage" goes in
+// the default collection
+func (w *OutlineBridge) splitTitle(title string) (collection string, document string) {
+	collection, document, found := strings.Cut(title, outlineTitleSeparator)
+	if !found {
+		return "", strings.TrimSpace(title)
+	}
+	return strings.TrimSpace(collection), strings.TrimSpace(document)
+}
+
+// Collections are matched by ID first, then name. With nothing to go on, the
+// first one will do.
+func (w *OutlineBridge) findCollection(name string) (collection OutlineCollection, err error) {
+	if name == "" {
+		name = w.collection
+	}
+	collections, err := w.listCollections()
+	if err != nil {
+		return collection, err
+	}
+	for _, c := range collections {
+		if name == "" || c.ID == name {
+			return c, nil
+		}
+	}
+	for _, c := range collections {
+		if strings.EqualFold(c.Name, name) {
+			return c, nil
+		}
+	}
+	if name == "" {
+		return collection, fmt.Errorf("there are no collections in outline to put documents in")
+	}
+	return collection, fmt.Errorf("could not find outline collection %s", name)
+}
+
+func (w *OutlineBridge) listCollections() (collections []OutlineCollection, err error) {
+	for offset := 0; ; offset += outlinePageSize {
+		var page []OutlineCollection
+		err = w.request("collections.list", map[string]interface{}{
+			"offset": offset,
+			"limit":  outlinePageSize,
+		}, &page)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, page...)
+		if len(page) < outlinePageSize {
+			return collections, nil
+		}
+	}
+}
+
+// There's no looking documents up by title, so go through the collection
+func (w *OutlineBridge) findDocument(collectionID string, title string) (document OutlineDocument, found bool, err error) {
+	for offset := 0; ; offset += outlinePageSize {
+		var page []OutlineDocument
+		err = w.request("documents.list", map[string]interface{}{
+			"collectionId": collectionID,
+			"offset":       offset,
+			"limit":        outlinePageSize,
+		}, &page)
+		if err != nil {
+			return document, false, err
+		}
+		for _, d := range page {
+			if d.Title == title {
+				return d, true, nil
+			}
+		}
+		if len(page) < outlinePageSize {
+			return document, false, nil
+		}
+	}
+}
+
+// Everything's a POST to /api/<method>, with the answer in "data"
+func (w *OutlineBridge) request(method string, body interface{}, result interface{}) (err error) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url+"/api/"+method, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+w.token)
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		OutlineError
+		OK   bool            `json:"ok"`
+		Data json.RawMessage `json:"data"`
+	}
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return fmt.Errorf("outline returned %s: %s", rsp.Status, string(responseBody))
+	}
+	if !response.OK || rsp.StatusCode != http.StatusOK {
+		response.OutlineError.Status = rsp.StatusCode
+		return response.OutlineError
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Data, result)
+}
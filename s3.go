@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/google/uuid"
+)
+
+// Raw copies of every grab, for people who need to keep them. Works with
+// anything that speaks S3 (MinIO, Ceph, R2, AWS itself). Every grab gets a
+// folder of its own under the workspace's prefix, with the Thread as JSON,
+// the original attachments, and a markdown transcript.
+const s3DefaultRegion = "us-east-1"
+
+// Bump this if S3Record changes in a way that'd confuse whatever reads it
+const s3RecordVersion = 1
+
+type S3Bridge struct {
+	client    *http.Client
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	prefix    string
+
+	// When we're going alongside a wiki, the wiki gets the files after us,
+	// and we write down how it went
+	keepFiles bool
+	wikiURL   string
+	wikiError string
+
+	// What generateTranscript worked out, for uploadArticle to save
+	thread      Thread
+	folder      string
+	attachments map[string]string
+	transcript  string
+}
+
+// What goes in thread.json
+type S3Record struct {
+	Version    int               `json:"version"`
+	GrabbedAt  time.Time         `json:"grabbedAt"`
+	Title      string            `json:"title"`
+	Section    string            `json:"section,omitempty"`
+	Overwrite  bool              `json:"overwrite"`
+	WikiURL    string            `json:"wikiURL,omitempty"`
+	WikiError  string            `json:"wikiError,omitempty"`
+	Channel    string            `json:"channel,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Messages   []S3RecordMessage `json:"messages"`
+	Transcript string            `json:"transcript"`
+	// Whatever the wiki got, in whatever it speaks
+	WikiTranscript string `json:"wikiTranscript,omitempty"`
+}
+
+type S3RecordMessage struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Author      string    `json:"author"`
+	Text        string    `json:"text"`
+	Attachments []string  `json:"attachments,omitempty"` // Object keys
+}
+
+func NewS3Bridge(instance Instance) (wiki S3Bridge, err error) {
+	wiki.client = &http.Client{Timeout: time.Second * 60}
+	wiki.region = instance.S3Region
+	if wiki.region == "" {
+		wiki.region = s3DefaultRegion
+	}
+	wiki.endpoint = strings.TrimSuffix(instance.S3Endpoint, "/")
+	if wiki.endpoint == "" {
+		wiki.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", wiki.region)
+	}
+	wiki.bucket = instance.S3Bucket
+	wiki.accessKey = instance.S3AccessKeyID
+	wiki.secretKey = instance.S3SecretAccessKey
+	wiki.prefix = "grab/" + publicGrabID(instance.GrabID)
+
+	// Make sure the bucket's there and we're allowed in
+	err = wiki.request(http.MethodHead, "", nil, "")
+	if err != nil {
+		return S3Bridge{}, fmt.Errorf("could not get into bucket %s: %s", wiki.bucket, err)
+	}
+	return wiki, nil
+}
+
+// Attachments go up as they are, before anybody else gets to them. The
+// transcript is markdown, since that's closest to what people typed.
+func (w *S3Bridge) generateTranscript(thread Thread) (transcript string) {
+	w.thread = thread
+	w.folder = fmt.Sprintf("%s/%s/%s-%s", w.prefix, time.Now().UTC().Format("2006/01/02"), time.Now().UTC().Format("20060102T150405Z"), uuid.New().String()[:8])
+	w.attachments = map[string]string{}
+
+	timeLayout := "2006-01-02 at 15:04"
+	transcript += "Transcript generated at " + time.Now().Format(timeLayout) + ".\n\n"
+	transcript += "Conversation begins at " + thread.Timestamp.Format(timeLayout) + ".\n\n"
+
+	for _, m := range thread.Messages {
+		transcript += "**" + m.Author + "**: " + strings.TrimSpace(m.Text) + "\n\n"
+
+		for _, path := range m.Files {
+			key, err := w.uploadImage(path)
+			if !w.keepFiles {
+				os.Remove(path)
+			}
+			if err != nil {
+				log.Println("Could not upload attachment: ", err)
+				continue
+			}
+			w.attachments[path] = key
+			transcript += fmt.Sprintf("[%s](%s)\n\n", filepath.Base(key), w.uriEncode(strings.TrimPrefix(key, w.folder+"/"), false))
+		}
+	}
+
+	w.transcript = transcript
+	return transcript
+}
+
+// There's no editing anything in here. Every grab is a new folder, and the
+// title and section are just written down. If there's a wiki too, what it got
+// is saved next to our own transcript.
+func (w *S3Bridge) uploadArticle(title string, section string, transcript string, clobber bool) (objectURL string, err error) {
+	record := S3Record{
+		Version:    s3RecordVersion,
+		GrabbedAt:  time.Now().UTC(),
+		Title:      title,
+		Section:    section,
+		Overwrite:  clobber,
+		WikiURL:    w.wikiURL,
+		WikiError:  w.wikiError,
+		Channel:    w.thread.Channel,
+		Timestamp:  w.thread.Timestamp,
+		Transcript: "transcript.md",
+	}
+	for _, m := range w.thread.Messages {
+		message := S3RecordMessage{Timestamp: m.Timestamp, Author: m.Author, Text: m.Text}
+		for _, path := range m.Files {
+			if key, ok := w.attachments[path]; ok {
+				message.Attachments = append(message.Attachments, key)
+			}
+		}
+		record.Messages = append(record.Messages, message)
+	}
+
+	err = w.request(http.MethodPut, w.folder+"/transcript.md", []byte(w.transcript), "text/markdown; charset=utf-8")
+	if err != nil {
+		return "", err
+	}
+	if transcript != w.transcript {
+		record.WikiTranscript = "wiki-transcript.txt"
+		err = w.request(http.MethodPut, w.folder+"/wiki-transcript.txt", []byte(transcript), "text/plain; charset=utf-8")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	recordBytes, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = w.request(http.MethodPut, w.folder+"/thread.json", recordBytes, "application/json")
+	if err != nil {
+		log.Println("Failed to save thread: ", err)
+		return "", err
+	}
+
+	return fmt.Sprintf("s3://%s/%s/thread.json", w.bucket, w.folder), nil
+}
+
+// Not just images. Everything goes up, exactly how it came.
+func (w *S3Bridge) uploadImage(path string) (key string, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key = w.folder + "/attachments/" + filepath.Base(path)
+	err = w.request(http.MethodPut, key, contents, mimetype.Detect(contents).String())
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Utility Functions
+
+// Path style (endpoint/bucket/key), since that's what MinIO and friends
+// want, and AWS still takes it.
+func (w *S3Bridge) request(method string, key string, body []byte, contentType string) (err error) {
+	path := "/" + w.bucket
+	if key != "" {
+		path += "/" + key
+	}
+	req, err := http.NewRequest(method, w.endpoint+w.uriEncode(path, false), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w.sign(req, body, time.Now().UTC())
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		responseBody, _ := io.ReadAll(rsp.Body)
+		return fmt.Errorf("s3 returned %s: %s", rsp.Status, string(responseBody))
+	}
+	return nil
+}
+
+// AWS Signature Version 4. Not worth pulling in the whole AWS SDK for.
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (w *S3Bridge) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := w.sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign everything we set, plus the host
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		w.uriEncode(req.URL.Path, false),
+		w.canonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + w.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		w.sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := w.hmacSHA256([]byte("AWS4"+w.secretKey), date)
+	key = w.hmacSHA256(key, w.region)
+	key = w.hmacSHA256(key, "s3")
+	key = w.hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(w.hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		w.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// S3's idea of URI encoding, which isn't quite anybody else's
+func (w *S3Bridge) uriEncode(path string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(path) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// Every parameter gets a value, even if it's empty, and they go in order
+func (w *S3Bridge) canonicalQuery(u *url.URL) string {
+	var params []string
+	for name, values := range u.Query() {
+		for _, value := range values {
+			params = append(params, w.uriEncode(name, true)+"="+w.uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func (w *S3Bridge) sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (w *S3Bridge) hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// SharePoint Online, through Microsoft Graph. Every grab is a text web part
+// on a modern site page. Point SHAREPOINT_GRAPH_URL and SHAREPOINT_LOGIN_URL
+// somewhere else to talk to a fake.
+const (
+	sharePointDefaultGraphURL = "https://graph.microsoft.com/v1.0"
+	sharePointDefaultLoginURL = "https://login.microsoftonline.com"
+	sharePointGraphScope      = "https://graph.microsoft.com/.default"
+	sharePointAssetFolder     = "Grab"
+)
+
+type SharePointBridge struct {
+	client       *http.Client
+	graphURL     string
+	loginURL     string
+	tenantID     string
+	clientID     string
+	clientSecret string
+	siteURL      string
+
+	// Looked up from the site URL
+	siteID string
+}
+
+type SharePointPage struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Title  string `json:"title"`
+	WebURL string `json:"webUrl"`
+
+	// Web parts come in a lot of shapes, and we have to send back all of the
+	// ones we don't touch, so this stays loose
+	CanvasLayout map[string]interface{} `json:"canvasLayout,omitempty"`
+}
+
+// Sections are text web parts that start with the section's heading
+var sharePointHeadingRegex = regexp.MustCompile(`^\s*<h2[^>]*>(.*?)</h2>`)
+
+func NewSharePointBridge(instance Instance) (wiki SharePointBridge, err error) {
+	wiki.client = &http.Client{Timeout: time.Second * 30}
+	wiki.graphURL = strings.TrimSuffix(os.Getenv("SHAREPOINT_GRAPH_URL"), "/")
+	if wiki.graphURL == "" {
+		wiki.graphURL = sharePointDefaultGraphURL
+	}
+	wiki.loginURL = strings.TrimSuffix(os.Getenv("SHAREPOINT_LOGIN_URL"), "/")
+	if wiki.loginURL == "" {
+		wiki.loginURL = sharePointDefaultLoginURL
+	}
+	wiki.tenantID = instance.SharePointTenantID
+	wiki.clientID = instance.SharePointClientID
+	wiki.clientSecret = instance.SharePointClientSecret
+	wiki.siteURL = instance.SharePointSiteURL
+
+	// Graph finds sites by hostname and path, like contoso.sharepoint.com:/sites/docs
+	site, err := url.Parse(wiki.siteURL)
+	if err != nil || site.Host == "" {
+		return SharePointBridge{}, fmt.Errorf("invalid sharepoint site: %s", wiki.siteURL)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	endpoint := "/sites/" + site.Host
+	if path := strings.TrimSuffix(site.Path, "/"); path != "" {
+		endpoint += ":" + path
+	}
+	err = wiki.request(http.MethodGet, endpoint, nil, &result)
+	if err != nil {
+		return SharePointBridge{}, err
+	}
+	wiki.siteID = result.ID
+	return wiki, nil
+}
+
+func (w *SharePointBridge) generateTranscript(thread Thread) (transcript string) {
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "<p>Transcript generated at " + currentTime + ".</p>"
+	transcript += "<p>Conversation begins at " + transcriptBegin + ".</p>"
+
+	for _, m := range thread.Messages {
+		author := "<strong>" + html.EscapeString(m.Author) + ":</strong> "
+		body, err := pandocConvert(m.Text, "markdown", "html")
+		if err != nil || strings.TrimSpace(body) == "" {
+			if err != nil {
+				log.Println("Warning: Failed to convert to HTML: ", err)
+			}
+			body = "<p>" + html.EscapeString(m.Text) + "</p>"
+		}
+		// Put the name in the first paragraph, like "Author: text"
+		if strings.HasPrefix(body, "<p>") {
+			transcript += "<p>" + author + strings.TrimPrefix(body, "<p>")
+		} else {
+			transcript += "<p>" + author + "</p>" + body
+		}
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				imageURL, err := w.uploadImage(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				transcript += fmt.Sprintf(`<p><img src="%s" alt="" /></p>`, html.EscapeString(imageURL))
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				transcript += "<pre>" + html.EscapeString(string(fileContents)) + "</pre>"
+			}
+		}
+	}
+
+	return transcript
+}
+
+// Pages are named after the title. Every section is its own text web part, and
+// it works the same as MediaWiki otherwise.
+func (w *SharePointBridge) uploadArticle(title string, section string, transcript string, clobber bool) (pageURL string, err error) {
+	page, found, err := w.getPage(title)
+	if err != nil {
+		return "", err
+	}
+
+	webPart := transcript
+	if section != "" {
+		webPart = "<h2>" + html.EscapeString(section) + "</h2>" + transcript
+	}
+
+	if !found {
+		page = SharePointPage{Name: w.pageName(title), Title: title}
+		page.CanvasLayout = w.newCanvas([]string{webPart})
+		body := map[string]interface{}{
+			"@odata.type":  "#microsoft.graph.sitePage",
+			"name":         page.Name,
+			"title":        page.Title,
+			"pageLayout":   "article",
+			"canvasLayout": page.CanvasLayout,
+		}
+		err = w.request(http.MethodPost, "/sites/"+w.siteID+"/pages", body, &page)
+	} else {
+		w.addToCanvas(&page, section, webPart, transcript, clobber)
+		body := map[string]interface{}{
+			"@odata.type":  "#microsoft.graph.sitePage",
+			"canvasLayout": page.CanvasLayout,
+		}
+		err = w.request(http.MethodPatch, "/sites/"+w.siteID+"/pages/"+page.ID+"/microsoft.graph.sitePage", body, nil)
+	}
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+
+	// Otherwise it's just a draft nobody else can see
+	err = w.request(http.MethodPost, "/sites/"+w.siteID+"/pages/"+page.ID+"/microsoft.graph.sitePage/publish", nil, nil)
+	if err != nil {
+		log.Println("Failed to publish page: ", err)
+		return "", err
+	}
+
+	return page.WebURL, nil
+}
+
+// Images go in the site's asset library, in a folder of their own
+func (w *SharePointBridge) uploadImage(path string) (imageURL string, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	driveID, err := w.getAssetLibrary()
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("/drives/%s/root:/%s/%s:/content", driveID, sharePointAssetFolder, url.PathEscape(filepath.Base(path)))
+	req, err := http.NewRequest(http.MethodPut, w.graphURL+endpoint, bytes.NewReader(contents))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	var item struct {
+		WebURL string `json:"webUrl"`
+	}
+	err = w.do(req, &item)
+	if err != nil {
+		return "", err
+	}
+	return item.WebURL, nil
+}
+
+// Utility Functions
+
+func (w *SharePointBridge) pageName(title string) string {
+	name := strings.Join(strings.Fields(title), "-")
+	name = strings.NewReplacer("/", "-", "\\", "-", "?", "", "#", "", "%", "", "*", "", ":", "", "<", "", ">", "", "|", "", "\"", "").Replace(name)
+	return name + ".aspx"
+}
+
+// Graph won't filter pages by name, so look through all of them
+func (w *SharePointBridge) getPage(title string) (page SharePointPage, found bool, err error) {
+	name := strings.ToLower(w.pageName(title))
+	endpoint := "/sites/" + w.siteID + "/pages/microsoft.graph.sitePage?$select=id,name,title,webUrl"
+	for endpoint != "" {
+		var results struct {
+			Value    []SharePointPage `json:"value"`
+			NextLink string           `json:"@odata.nextLink"`
+		}
+		err = w.request(http.MethodGet, endpoint, nil, &results)
+		if err != nil {
+			return page, false, err
+		}
+		for _, p := range results.Value {
+			if strings.ToLower(p.Name) == name {
+				// The list doesn't come with the web parts
+				err = w.request(http.MethodGet, "/sites/"+w.siteID+"/pages/"+p.ID+"/microsoft.graph.sitePage?$expand=canvasLayout", nil, &page)
+				return page, err == nil, err
+			}
+		}
+		endpoint = results.NextLink
+	}
+	return page, false, nil
+}
+
+func (w *SharePointBridge) newTextWebPart(innerHTML string) map[string]interface{} {
+	return map[string]interface{}{
+		"@odata.type": "#microsoft.graph.textWebPart",
+		"innerHtml":   innerHTML,
+	}
+}
+
+func (w *SharePointBridge) newCanvas(webParts []string) map[string]interface{} {
+	var parts []interface{}
+	for _, webPart := range webParts {
+		parts = append(parts, w.newTextWebPart(webPart))
+	}
+	return map[string]interface{}{
+		"horizontalSections": []interface{}{
+			map[string]interface{}{
+				"id":       "1",
+				"layout":   "oneColumn",
+				"emphasis": "none",
+				"columns": []interface{}{
+					map[string]interface{}{
+						"id":       "1",
+						"width":    12,
+						"webparts": parts,
+					},
+				},
+			},
+		},
+	}
+}
+
+// The last column on the page is where new things go. Everything else stays
+// where it is.
+func (w *SharePointBridge) addToCanvas(page *SharePointPage, section string, webPart string, transcript string, clobber bool) {
+	if section == "" && clobber {
+		page.CanvasLayout = w.newCanvas([]string{webPart})
+		return
+	}
+
+	var lastColumn map[string]interface{}
+	var sectionColumn map[string]interface{}
+	sectionIndex := -1
+	horizontalSections, _ := page.CanvasLayout["horizontalSections"].([]interface{})
+	for _, hs := range horizontalSections {
+		hsMap, _ := hs.(map[string]interface{})
+		columns, _ := hsMap["columns"].([]interface{})
+		for _, column := range columns {
+			columnMap, _ := column.(map[string]interface{})
+			if columnMap == nil {
+				continue
+			}
+			lastColumn = columnMap
+			webParts, _ := columnMap["webparts"].([]interface{})
+			for i, part := range webParts {
+				partMap, _ := part.(map[string]interface{})
+				innerHTML, _ := partMap["innerHtml"].(string)
+				match := sharePointHeadingRegex.FindStringSubmatch(innerHTML)
+				if section != "" && sectionIndex < 0 && match != nil && html.UnescapeString(match[1]) == section {
+					sectionColumn = columnMap
+					sectionIndex = i
+				}
+			}
+		}
+	}
+	if lastColumn == nil {
+		page.CanvasLayout = w.newCanvas([]string{webPart})
+		return
+	}
+
+	if sectionIndex >= 0 && clobber {
+		webParts := sectionColumn["webparts"].([]interface{})
+		sectionColumn["webparts"] = append(webParts[:sectionIndex], webParts[sectionIndex+1:]...)
+	} else if sectionIndex >= 0 /* && append */ {
+		partMap := sectionColumn["webparts"].([]interface{})[sectionIndex].(map[string]interface{})
+		partMap["innerHtml"] = partMap["innerHtml"].(string) + transcript
+		return
+	}
+
+	webParts, _ := lastColumn["webparts"].([]interface{})
+	lastColumn["webparts"] = append(webParts, w.newTextWebPart(webPart))
+}
+
+// Use "Site Assets" if the site has one, and the default library otherwise
+func (w *SharePointBridge) getAssetLibrary() (driveID string, err error) {
+	var drives struct {
+		Value []struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			WebURL string `json:"webUrl"`
+		} `json:"value"`
+	}
+	err = w.request(http.MethodGet, "/sites/"+w.siteID+"/drives", nil, &drives)
+	if err != nil {
+		return "", err
+	}
+	for _, drive := range drives.Value {
+		if drive.Name == "Site Assets" || strings.HasSuffix(drive.WebURL, "/SiteAssets") {
+			return drive.ID, nil
+		}
+	}
+
+	var drive struct {
+		ID string `json:"id"`
+	}
+	err = w.request(http.MethodGet, "/sites/"+w.siteID+"/drive", nil, &drive)
+	return drive.ID, err
+}
+
+// Endpoints are relative to the Graph URL, unless they're a nextLink, which
+// comes with the whole thing
+func (w *SharePointBridge) request(method string, endpoint string, body interface{}, result interface{}) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = w.graphURL + endpoint
+	}
+	req, err := http.NewRequest(method, endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return w.do(req, result)
+}
+
+func (w *SharePointBridge) do(req *http.Request, result interface{}) (err error) {
+	token, err := getMicrosoftToken(w.client, w.loginURL, w.tenantID, w.clientID, w.clientSecret, sharePointGraphScope)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("graph returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	if result == nil || len(responseBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(responseBody, result)
+}
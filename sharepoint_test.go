@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Just enough of Graph (and its login) to make and edit site pages
+type fakeSharePoint struct {
+	lock      sync.Mutex
+	server    *httptest.Server
+	pages     map[string]*SharePointPage
+	nextID    int
+	published int
+	assets    map[string][]byte
+}
+
+func newFakeSharePoint(t *testing.T) *fakeSharePoint {
+	f := &fakeSharePoint{pages: map[string]*SharePointPage{}, assets: map[string][]byte{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	t.Setenv("SHAREPOINT_GRAPH_URL", f.server.URL+"/graph")
+	t.Setenv("SHAREPOINT_LOGIN_URL", f.server.URL+"/login")
+	return f
+}
+
+func (f *fakeSharePoint) serve(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, "/login/") {
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/graph")
+	switch {
+	case r.Method == http.MethodGet && path == "/sites/contoso.sharepoint.com:/sites/docs":
+		json.NewEncoder(w).Encode(map[string]string{"id": "site"})
+	case r.Method == http.MethodGet && path == "/sites/site/pages/microsoft.graph.sitePage":
+		var list []SharePointPage
+		for _, page := range f.pages {
+			list = append(list, SharePointPage{ID: page.ID, Name: page.Name, Title: page.Title, WebURL: page.WebURL})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": list})
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/microsoft.graph.sitePage"):
+		page, ok := f.pages[f.pageID(path)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(page)
+	case r.Method == http.MethodPost && path == "/sites/site/pages":
+		var page SharePointPage
+		json.NewDecoder(r.Body).Decode(&page)
+		f.nextID++
+		page.ID = fmt.Sprint(f.nextID)
+		page.WebURL = "https://contoso.sharepoint.com/sites/docs/SitePages/" + page.Name
+		f.pages[page.ID] = &page
+		json.NewEncoder(w).Encode(page)
+	case r.Method == http.MethodPatch && strings.HasSuffix(path, "/microsoft.graph.sitePage"):
+		page, ok := f.pages[f.pageID(path)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var update SharePointPage
+		json.NewDecoder(r.Body).Decode(&update)
+		page.CanvasLayout = update.CanvasLayout
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/publish"):
+		f.published++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && path == "/sites/site/drives":
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": []map[string]string{
+			{"id": "documents", "name": "Documents", "webUrl": "https://contoso.sharepoint.com/sites/docs/Shared Documents"},
+			{"id": "assets", "name": "Site Assets", "webUrl": "https://contoso.sharepoint.com/sites/docs/SiteAssets"},
+		}})
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/drives/assets/root:/Grab/") && strings.HasSuffix(path, ":/content"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/drives/assets/root:/Grab/"), ":/content")
+		f.assets[name], _ = io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(map[string]string{"webUrl": "https://contoso.sharepoint.com/sites/docs/SiteAssets/Grab/" + name})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// /sites/site/pages/<id>/...
+func (f *fakeSharePoint) pageID(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
+
+// Every text web part on the page, in order
+func (f *fakeSharePoint) webParts(t *testing.T) (parts []string) {
+	t.Helper()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.pages) != 1 {
+		t.Fatalf("expected one page, got %d", len(f.pages))
+	}
+	for _, page := range f.pages {
+		sections, _ := page.CanvasLayout["horizontalSections"].([]interface{})
+		for _, section := range sections {
+			columns, _ := section.(map[string]interface{})["columns"].([]interface{})
+			for _, column := range columns {
+				webParts, _ := column.(map[string]interface{})["webparts"].([]interface{})
+				for _, part := range webParts {
+					innerHTML, _ := part.(map[string]interface{})["innerHtml"].(string)
+					parts = append(parts, innerHTML)
+				}
+			}
+		}
+	}
+	return parts
+}
+
+func newTestSharePointBridge(t *testing.T) SharePointBridge {
+	t.Helper()
+	w, err := NewSharePointBridge(Instance{
+		SharePointSiteURL:      "https://contoso.sharepoint.com/sites/docs",
+		SharePointTenantID:     "tenant",
+		SharePointClientID:     "client",
+		SharePointClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestSharePointUploadArticle(t *testing.T) {
+	f := newFakeSharePoint(t)
+	w := newTestSharePointBridge(t)
+
+	pageURL, err := w.uploadArticle("Big Outage", "Monday", "<p>one</p>", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageURL != "https://contoso.sharepoint.com/sites/docs/SitePages/Big-Outage.aspx" {
+		t.Errorf("unexpected page url %s", pageURL)
+	}
+	parts := f.webParts(t)
+	if len(parts) != 1 || parts[0] != "<h2>Monday</h2><p>one</p>" {
+		t.Fatalf("unexpected web parts after create: %q", parts)
+	}
+
+	// Appending to a section adds to its web part
+	_, err = w.uploadArticle("Big Outage", "Monday", "<p>two</p>", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts = f.webParts(t)
+	if len(parts) != 1 || parts[0] != "<h2>Monday</h2><p>one</p><p>two</p>" {
+		t.Fatalf("unexpected web parts after append: %q", parts)
+	}
+
+	// A new section gets a web part of its own
+	_, err = w.uploadArticle("Big Outage", "Tuesday", "<p>three</p>", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts = f.webParts(t)
+	if len(parts) != 2 || parts[1] != "<h2>Tuesday</h2><p>three</p>" {
+		t.Fatalf("unexpected web parts after new section: %q", parts)
+	}
+
+	// Clobbering a section only replaces that one
+	_, err = w.uploadArticle("Big Outage", "Monday", "<p>four</p>", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts = f.webParts(t)
+	if len(parts) != 2 || parts[0] != "<h2>Tuesday</h2><p>three</p>" || parts[1] != "<h2>Monday</h2><p>four</p>" {
+		t.Fatalf("unexpected web parts after clobbering a section: %q", parts)
+	}
+
+	// Clobbering without a section replaces the whole page
+	_, err = w.uploadArticle("Big Outage", "", "<p>five</p>", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts = f.webParts(t)
+	if len(parts) != 1 || parts[0] != "<p>five</p>" {
+		t.Fatalf("unexpected web parts after clobbering the page: %q", parts)
+	}
+
+	// Drafts don't do anyone any good
+	if f.published != 5 {
+		t.Errorf("expected every upload to be published, got %d", f.published)
+	}
+}
+
+func TestSharePointUploadImage(t *testing.T) {
+	f := newFakeSharePoint(t)
+	w := newTestSharePointBridge(t)
+
+	path := filepath.Join(t.TempDir(), "screenshot.png")
+	os.WriteFile(path, []byte("not really a png"), 0644)
+
+	imageURL, err := w.uploadImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageURL != "https://contoso.sharepoint.com/sites/docs/SiteAssets/Grab/screenshot.png" {
+		t.Errorf("unexpected image url %s", imageURL)
+	}
+	if string(f.assets["screenshot.png"]) != "not really a png" {
+		t.Errorf("image didn't make it to Site Assets: %v", f.assets)
+	}
+}
+
+// A login server that only knows one secret, and counts how often it's asked
+func newLoginServer(t *testing.T, token string, logins *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("client_secret") != "right" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		*logins++
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": 3600})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMicrosoftTokenNeedsTheSecret(t *testing.T) {
+	var logins int
+	server := newLoginServer(t, "token", &logins)
+
+	token, err := getMicrosoftToken(server.Client(), server.URL, "tenant", "client", "right", sharePointGraphScope)
+	if err != nil || token != "token" {
+		t.Fatalf("could not log in: %s", err)
+	}
+	_, err = getMicrosoftToken(server.Client(), server.URL, "tenant", "client", "wrong", sharePointGraphScope)
+	if err == nil {
+		t.Fatal("got a cached token with the wrong secret")
+	}
+	_, err = getMicrosoftToken(server.Client(), server.URL, "tenant", "client", "right", sharePointGraphScope)
+	if err != nil || logins != 1 {
+		t.Fatalf("expected the token to be cached, logged in %d times: %s", logins, err)
+	}
+}
+
+func TestMicrosoftTokenStaysWithItsLoginServer(t *testing.T) {
+	var logins, otherLogins int
+	server := newLoginServer(t, "token", &logins)
+	other := newLoginServer(t, "other token", &otherLogins)
+
+	token, err := getMicrosoftToken(server.Client(), server.URL, "tenant", "client", "right", sharePointGraphScope)
+	if err != nil || token != "token" {
+		t.Fatalf("could not log in: %s", err)
+	}
+	token, err = getMicrosoftToken(other.Client(), other.URL, "tenant", "client", "right", sharePointGraphScope)
+	if err != nil || token != "other token" || otherLogins != 1 {
+		t.Fatalf("got %q from the wrong login server: %s", token, err)
+	}
+}
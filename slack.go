@@ -1,27 +1,44 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"html"
 	"log"
-	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
 
 	"github.com/google/uuid"
 )
 
 type SlackBridge struct {
-	api *slack.Client
+	api      *slack.Client
+	instance Instance
+
+	// Big grabs take a while, so whoever asked for one can hear how it's
+	// going through this, if they set it
+	progress func(text string)
 }
 
+// How many messages we ask Slack for at once
+const slackPageSize = 200
+
+// Say how it's going every this many messages
+const slackProgressEvery = 1000
+
+// How many times to wait out Slack before giving up
+const slackMaxRetries = 5
+
 func NewSlackBridge(instance Instance) (s SlackBridge) {
-	s.api = slack.New(instance.SlackAccessToken)
+	s.api = slack.New(instance.SlackAccessToken, slackAPIOptions()...)
+	s.instance = instance
 	return s
 }
 
@@ -34,7 +51,9 @@ func (s *SlackBridge) getRange(channelID string, startTs string, endTs string) (
 	for i := 0; i < length/2; i++ {
 		conversation[i], conversation[length-i-1] = conversation[length-i-1], conversation[i]
 	}
-	return s.conversationToThread(conversation)
+	thread, err = s.conversationToThread(conversation)
+	thread.Channel = s.getChannelName(channelID)
+	return thread, err
 }
 
 func (s *SlackBridge) getThread(channelID string, threadTs string) (thread Thread, err error) {
@@ -42,14 +61,32 @@ func (s *SlackBridge) getThread(channelID string, threadTs string) (thread Threa
 	if err != nil {
 		return Thread{}, err
 	}
-	return s.conversationToThread(conversation)
+	thread, err = s.conversationToThread(conversation)
+	thread.Channel = s.getChannelName(channelID)
+	return thread, err
 }
 
 func (s *SlackBridge) conversationToThread(conversation []slack.Message) (thread Thread, err error) {
+	if len(conversation) == 0 {
+		return Thread{}, fmt.Errorf("there's nothing to grab")
+	}
+
 	// Get the bot's userID
-	authTestResponse, err := s.api.AuthTest()
+	var authTestResponse *slack.AuthTestResponse
+	err = s.retry(func() (err error) {
+		authTestResponse, err = s.api.AuthTest()
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Error calling AuthTest: %s", err)
+		return Thread{}, fmt.Errorf("could not find out who Grab is: %w", err)
+	}
+
+	fileCount := 0
+	for _, message := range conversation {
+		fileCount += len(message.Files)
+	}
+	if fileCount > slackProgressEvery/100 {
+		s.reportProgress(fmt.Sprintf("Got %d messages, downloading %d files...", len(conversation), fileCount))
 	}
 
 	// The ThreadTS is when this party started
@@ -69,7 +106,10 @@ func (s *SlackBridge) conversationToThread(conversation []slack.Message) (thread
 		// to hit the API every time
 		var msgUser *slack.User
 		if len(conversationUsers[message.User]) == 0 {
-			msgUser, err = s.api.GetUserInfo(message.User)
+			err = s.retry(func() (err error) {
+				msgUser, err = s.api.GetUserInfo(message.User)
+				return err
+			})
 			if err != nil {
 				log.Println(err)
 			} else {
@@ -94,7 +134,10 @@ func (s *SlackBridge) conversationToThread(conversation []slack.Message) (thread
 		for _, file := range message.Files {
 			path, err := s.getFile(file)
 			if err != nil {
+				// Better to say so than to leave it out
 				log.Println("Could not save file: ", err)
+				m.Text += fmt.Sprintf("\n\n_(Could not save %s: %s)_", file.Name, err)
+				continue
 			}
 			m.Files = append(m.Files, path)
 		}
@@ -128,7 +171,12 @@ func (s *SlackBridge) handleMessageAction(payload slack.InteractionCallback) (er
 }
 
 func (s *SlackBridge) handleShortcut(payload slack.InteractionCallback) (err error) {
-	modalRequest := s.generateRangeTitleFormRequest(payload.Channel.ID, payload.Message.ThreadTimestamp, payload.User.ID)
+	var modalRequest slack.ModalViewRequest
+	if payload.CallbackID == GrabForge {
+		modalRequest = s.generateForgeTitleFormRequest(payload.User.ID)
+	} else {
+		modalRequest = s.generateRangeTitleFormRequest(payload.Channel.ID, payload.Message.ThreadTimestamp, payload.User.ID)
+	}
 	_, err = s.api.OpenView(payload.TriggerID, modalRequest)
 	if err != nil {
 		return err
@@ -137,7 +185,8 @@ func (s *SlackBridge) handleShortcut(payload slack.InteractionCallback) (err err
 	return nil
 }
 
-func (s *SlackBridge) handleViewSubmission(c *gin.Context, payload slack.InteractionCallback, instance Instance) (err error) {
+// ack tells Slack we've got it, however it is we're talking to Slack
+func (s *SlackBridge) handleViewSubmission(payload slack.InteractionCallback, instance Instance, ack func()) (err error) {
 	articleTitle := payload.View.State.Values["Article Title"]["articleTitle"].Value
 	sectionTitle := payload.View.State.Values["Section Title"]["sectionTitle"].Value
 	var clobber bool
@@ -156,97 +205,773 @@ func (s *SlackBridge) handleViewSubmission(c *gin.Context, payload slack.Interac
 	threadTS := messageContext[1]
 	userID := messageContext[2]
 
+	// Range grabs come from wherever the link says
+	var startTS, endTS string
+	if _, ok := payload.View.State.Values["Start Link"]; ok {
+		startTS = s.extractTS(payload.View.State.Values["Start Link"]["startLink"].Value)
+		endTS = s.extractTS(payload.View.State.Values["End Link"]["endLink"].Value)
+		channelID = s.extractChannelID(payload.View.State.Values["Start Link"]["startLink"].Value)
+	}
+
+	// Big grabs take a while, so ACK now and tell them how it went later
+	ack()
+	respond := func(text string) {
+		err := s.respondToSubmission(channelID, threadTS, userID, text)
+		if err != nil {
+			log.Println("Could not respond to view_submission: ", err)
+		}
+	}
+	s.progress = respond
+
 	// Get the Thread into a common form
 	var thread Thread
 	if _, ok := payload.View.State.Values["Start Link"]; ok {
-		// Check if this is a range request
-		startLink := payload.View.State.Values["Start Link"]["startLink"].Value
-		endLink := payload.View.State.Values["End Link"]["endLink"].Value
-		startTS := s.extractTS(startLink)
-		endTS := s.extractTS(endLink)
-		channelID = s.extractChannelID(startLink)
 		thread, err = s.getRange(channelID, startTS, endTS)
+	} else if _, ok := payload.View.State.Values["Issue Link"]; ok {
+		// Or an issue from somewhere else entirely
+		var f ForgeBridge
+		var repo, issue string
+		f, err = NewForgeBridge(instance)
+		if err == nil {
+			repo, issue, err = f.parseLink(payload.View.State.Values["Issue Link"]["issueLink"].Value)
+		}
+		if err == nil {
+			thread, err = f.getThread(repo, issue)
+		}
 	} else {
 		thread, err = s.getThread(channelID, threadTS)
 	}
 	if err != nil {
-		return err
+		log.Println("Could not get messages: ", err)
+		respond(fmt.Sprintf("Could not save article: %s", err))
+		return nil
 	}
 
-	// If we didn't get a title, then grab and truncate the first message
-	if len(articleTitle) == 0 {
-		articleTitle = thread.getTitle()
+	if len(channelID) > 0 {
+		articleTitle, sectionTitle = s.channelDefaults(channelID, thread, articleTitle, sectionTitle)
 	}
 
-	// If all that worked, ACK so we don't die when eating large messages
-	c.String(http.StatusOK, "")
-
-	// Figure out what kind of Wiki this org has
-	var w WikiBridge
-	if len(instance.MediaWikiURL) > 0 {
-		wiki, err := NewMediaWikiBridge(instance)
-		w = &wiki // Forgive me father for I have sinned
+	// BookStack people pick a book and chapter instead of typing them out
+	if location := payload.View.State.Values["Book"]["book"].SelectedOption.Value; len(location) > 0 {
+		if len(articleTitle) == 0 {
+			articleTitle = thread.getTitle()
+		}
+		var w BookStackBridge
+		w, err = NewBookStackBridge(instance)
+		if err == nil {
+			articleTitle, err = w.locationTitle(location, articleTitle)
+		}
 		if err != nil {
-			return err
+			respond(fmt.Sprintf("Could not save article: %s", err))
+			return nil
 		}
 	}
 
+	// Same for Outline collections. Names aren't unique, so it goes by ID.
+	if collectionID := payload.View.State.Values["Collection"]["collection"].SelectedOption.Value; len(collectionID) > 0 {
+		instance.OutlineCollection = collectionID
+	}
+
 	// Post Thread to Wiki
-	transcript := w.generateTranscript(thread)
-	url, err := w.uploadArticle(articleTitle, sectionTitle, transcript, clobber)
+	url, err := publishThread(instance, thread, articleTitle, sectionTitle, clobber)
 
 	// Let the user know where the page is
 	responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+	if err != nil {
+		responseData = fmt.Sprintf("Could not save article: %s", err)
+	}
+	return s.respondToSubmission(channelID, threadTS, userID, responseData)
+}
 
-	if len(threadTS) > 0 {
+// Wherever they grabbed from, or a DM if that was nowhere in particular
+func (s *SlackBridge) respondToSubmission(channelID string, threadTS string, userID string, text string) (err error) {
+	if len(channelID) == 0 {
+		// Global shortcuts don't come from a channel, so DM them instead
+		_, _, err = s.api.PostMessage(
+			userID,
+			slack.MsgOptionText(text, false),
+		)
+	} else if len(threadTS) > 0 {
 		_, err = s.api.PostEphemeral(
 			channelID,
 			userID,
 			slack.MsgOptionTS(threadTS),
-			slack.MsgOptionText(responseData, false),
+			slack.MsgOptionText(text, false),
 		)
 	} else {
 		_, err = s.api.PostEphemeral(
 			channelID,
 			userID,
-			slack.MsgOptionText(responseData, false),
+			slack.MsgOptionText(text, false),
+		)
+	}
+	return err
+}
+
+// Event Handlers
+
+// "@Grab" in a thread saves it without bothering with the modal. "@Grab to
+// Article / Section --overwrite" picks where it goes.
+func (s *SlackBridge) handleAppMention(event *slackevents.AppMentionEvent) (err error) {
+	// Either way, the answer goes in a thread
+	threadTS := event.ThreadTimeStamp
+	if len(threadTS) == 0 {
+		return s.replyInThread(event.Channel, event.TimeStamp, "@Grab only works inside threads! Mention me in a reply to save the whole thread.")
+	}
+
+	articleTitle, sectionTitle, clobber, err := s.parseDestination(event.Text)
+	if err != nil {
+		return s.replyInThread(event.Channel, threadTS, fmt.Sprintf("%s\n\n%s", err, slackMentionUsage))
+	}
+
+	s.progress = func(text string) {
+		err := s.replyInThread(event.Channel, threadTS, text)
+		if err != nil {
+			log.Println("Could not say how the grab is going: ", err)
+		}
+	}
+	thread, err := s.getThread(event.Channel, threadTS)
+	if err != nil {
+		return s.replyInThread(event.Channel, threadTS, fmt.Sprintf("Could not get the thread: %s", err))
+	}
+	articleTitle, sectionTitle = s.channelDefaults(event.Channel, thread, articleTitle, sectionTitle)
+
+	url, err := publishThread(s.instance, thread, articleTitle, sectionTitle, clobber)
+	responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+	if err != nil {
+		responseData = fmt.Sprintf("Could not save article: %s", err)
+	}
+	return s.replyInThread(event.Channel, threadTS, responseData)
+}
+
+// Reacting to the start of a thread with the grab reaction saves the whole
+// thing, wherever the channel's set up to put it
+func (s *SlackBridge) handleReactionAdded(event *slackevents.ReactionAddedEvent) (err error) {
+	if event.Item.Type != "message" || s.reactionName(event.Reaction) != s.grabReaction() || !s.canGrabWithReaction(event.User) {
+		return nil
+	}
+
+	conversation, err := s.getConversationReplies(event.Item.Channel, event.Item.Timestamp)
+	if err != nil {
+		return err
+	}
+	// Replies don't count, just the message that started it
+	if len(conversation) == 0 || conversation[0].Timestamp != event.Item.Timestamp {
+		return nil
+	}
+
+	// If somebody beat them to it, it's saved (or being saved) already
+	claimed, err := claimReactionGrab(db, s.instance.GrabID, event.Item.Channel, event.Item.Timestamp)
+	if err != nil || !claimed {
+		return err
+	}
+
+	s.progress = func(text string) {
+		err := s.replyInThread(event.Item.Channel, event.Item.Timestamp, text)
+		if err != nil {
+			log.Println("Could not say how the grab is going: ", err)
+		}
+	}
+	var url string
+	thread, err := s.conversationToThread(conversation)
+	if err == nil {
+		thread.Channel = s.getChannelName(event.Item.Channel)
+		articleTitle, sectionTitle := s.channelDefaults(event.Item.Channel, thread, "", "")
+		url, err = publishThread(s.instance, thread, articleTitle, sectionTitle, false)
+	}
+
+	responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+	if err != nil {
+		responseData = fmt.Sprintf("Could not save article: %s", err)
+		// Let the next reaction have another go
+		releaseErr := releaseReactionGrab(db, s.instance.GrabID, event.Item.Channel, event.Item.Timestamp)
+		if releaseErr != nil {
+			log.Println("Could not forget failed reaction grab: ", releaseErr)
+		}
+	}
+	return s.replyInThread(event.Item.Channel, event.Item.Timestamp, responseData)
+}
+
+// Command Handlers
+
+const slackCommandHelp = "*/grab last N* saves the last N messages in this channel.\n" +
+	"*/grab since <time>* saves everything since then, like `2h`, `3d`, `yesterday`, `09:30`, or `2024-05-01 14:00`. Times are in your time zone.\n" +
+	"Put `to Article / Section` after either to pick where it goes, and `--overwrite` to replace what's there.\n" +
+	"*/grab status* shows what wiki Grab is using, and the last few grabs from this channel.\n" +
+	"*/grab config* sets where grabs from this channel go when nobody says.\n" +
+	"*/grab help* shows this."
+
+// How many grabs "/grab status" shows
+const slackStatusGrabs = 5
+
+// "/grab last" and "/grab since" go back a page at a time, so this is just to
+// keep them sane
+const slackMaxMessages = 10000
+
+// Whatever comes back goes straight to whoever ran the command. Grabbing
+// takes longer than Slack will wait, so that gets answered later, through
+// the command's response URL.
+func (s *SlackBridge) handleGrabCommand(command slack.SlashCommand) (response string, err error) {
+	subcommand, args, _ := strings.Cut(strings.TrimSpace(command.Text), " ")
+	args = strings.TrimSpace(args)
+
+	switch strings.ToLower(subcommand) {
+	case "last":
+		countText, destination, _ := strings.Cut(args, " ")
+		count, err := strconv.Atoi(countText)
+		if err != nil || count < 1 || count > slackMaxMessages {
+			return fmt.Sprintf("How many messages? Give me a number from 1 to %d, like `/grab last 20`.", slackMaxMessages), nil
+		}
+		articleTitle, sectionTitle, clobber, err := s.parseDestination(destination)
+		if err != nil {
+			return fmt.Sprintf("%s\n\n%s", err, slackCommandHelp), nil
+		}
+		go s.grabAndRespond(command, func() (Thread, error) {
+			return s.getRecent(command.ChannelID, "", count)
+		}, articleTitle, sectionTitle, clobber)
+		return fmt.Sprintf("Grabbing the last %d messages...", count), nil
+	case "since":
+		since, destination, err := s.parseSince(args, s.getUserLocation(command.UserID), time.Now())
+		if err != nil {
+			return fmt.Sprintf("%s\n\n%s", err, slackCommandHelp), nil
+		}
+		articleTitle, sectionTitle, clobber, err := s.parseDestination(destination)
+		if err != nil {
+			return fmt.Sprintf("%s\n\n%s", err, slackCommandHelp), nil
+		}
+		go s.grabAndRespond(command, func() (Thread, error) {
+			return s.getRecent(command.ChannelID, s.timeToSlackTS(since), slackMaxMessages)
+		}, articleTitle, sectionTitle, clobber)
+		return fmt.Sprintf("Grabbing everything since %s...", since.Format("2006-01-02 15:04 MST")), nil
+	case "status":
+		// Checking the wiki can take longer than Slack will wait
+		go func() {
+			err := s.postToResponseURL(command.ResponseURL, s.generateStatus(command.ChannelID))
+			if err != nil {
+				log.Println("Could not respond to /grab status: ", err)
+			}
+		}()
+		return "Checking on your wiki...", nil
+	case "config":
+		return "", s.openChannelConfig(command)
+	case "help", "":
+		return slackCommandHelp, nil
+	default:
+		return fmt.Sprintf("I don't know how to %s.\n\n%s", subcommand, slackCommandHelp), nil
+	}
+}
+
+func (s *SlackBridge) grabAndRespond(command slack.SlashCommand, getThread func() (Thread, error), articleTitle string, sectionTitle string, clobber bool) {
+	s.progress = func(text string) {
+		err := s.postToResponseURL(command.ResponseURL, text)
+		if err != nil {
+			log.Println("Could not say how the grab is going: ", err)
+		}
+	}
+
+	var url string
+	thread, err := getThread()
+	if err == nil {
+		articleTitle, sectionTitle = s.channelDefaults(command.ChannelID, thread, articleTitle, sectionTitle)
+		url, err = publishThread(s.instance, thread, articleTitle, sectionTitle, clobber)
+	}
+
+	responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+	if err != nil {
+		responseData = fmt.Sprintf("Could not save article: %s", err)
+	}
+	err = s.postToResponseURL(command.ResponseURL, responseData)
+	if err != nil {
+		log.Println("Could not respond to /grab: ", err)
+	}
+}
+
+// Only whoever ran the command sees it
+func (s *SlackBridge) postToResponseURL(responseURL string, text string) error {
+	return slack.PostWebhook(responseURL, &slack.WebhookMessage{
+		ResponseType: slack.ResponseTypeEphemeral,
+		Text:         text,
+	})
+}
+
+// Grabs from private channels are nobody else's business, so only the ones
+// from where the command was run
+func (s *SlackBridge) generateStatus(channelID string) (status string) {
+	w, err := newWikiBridge(s.instance)
+	if err != nil {
+		status = fmt.Sprintf("Could not connect to your wiki: %s\n", err)
+	} else {
+		status = fmt.Sprintf("Grabs go to %s, and it's working.\n", wikiName(w))
+		if _, bucketOnly := w.(*S3Bridge); len(s.instance.S3Bucket) > 0 && !bucketOnly {
+			status += fmt.Sprintf("Raw copies go to the S3 bucket %s.\n", s.instance.S3Bucket)
+		}
+	}
+
+	// Grabs are logged with the channel's name, same as it's written here
+	grabLogs, err := selectGrabLogs(db, s.instance.GrabID, s.getChannelName(channelID), slackStatusGrabs)
+	if err != nil {
+		return status + fmt.Sprintf("\nCould not get the last grabs: %s", err)
+	}
+	if len(grabLogs) == 0 {
+		return status + "\nNothing's been grabbed from this channel yet."
+	}
+	status += "\nLast grabs from this channel:\n"
+	for _, grabLog := range grabLogs {
+		where := grabLog.Article
+		if len(grabLog.Section) > 0 {
+			where += " / " + grabLog.Section
+		}
+		result := grabLog.URL
+		if len(grabLog.Error) > 0 {
+			result = "failed: " + grabLog.Error
+		}
+		status += fmt.Sprintf("• %s from #%s to %s: %s\n", grabLog.CreatedAt.Format("2006-01-02 15:04"), grabLog.Channel, where, result)
+	}
+	return status
+}
+
+func (s *SlackBridge) openChannelConfig(command slack.SlashCommand) (err error) {
+	settings, err := selectChannelSettings(db, s.instance.GrabID, command.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	explanation := slack.NewSectionBlock(slack.NewTextBlockObject(
+		"mrkdwn",
+		"When somebody grabs something from this channel without saying where it goes, it goes here. `{channel}` and `{date}` get filled in.",
+		false, false,
+	), nil, nil)
+
+	articleElement := slack.NewPlainTextInputBlockElement(
+		slack.NewTextBlockObject("plain_text", "Like {channel} conversations", false, false),
+		"defaultArticle",
+	)
+	articleElement.InitialValue = settings.DefaultArticle
+	article := slack.NewInputBlock("Default Article", slack.NewTextBlockObject("plain_text", "Default Article Title", false, false), nil, articleElement)
+	article.Optional = true
+
+	sectionElement := slack.NewPlainTextInputBlockElement(
+		slack.NewTextBlockObject("plain_text", "Like {date}", false, false),
+		"defaultSection",
+	)
+	sectionElement.InitialValue = settings.DefaultSection
+	section := slack.NewInputBlock("Default Section", slack.NewTextBlockObject("plain_text", "Default Section Title", false, false), nil, sectionElement)
+	section.Optional = true
+
+	blocks := []slack.Block{explanation, article, section}
+
+	// Admins get to set up the grab reaction too, since it's for everybody
+	if s.isWorkspaceAdmin(command.UserID) {
+		workspaceExplanation := slack.NewSectionBlock(slack.NewTextBlockObject(
+			"mrkdwn",
+			"*For the whole workspace:* reacting to the start of a thread with this emoji saves it.",
+			false, false,
+		), nil, nil)
+
+		reactionElement := slack.NewPlainTextInputBlockElement(
+			slack.NewTextBlockObject("plain_text", slackDefaultGrabReaction, false, false),
+			"grabReaction",
+		)
+		reactionElement.InitialValue = s.grabReaction()
+		reaction := slack.NewInputBlock("Grab Reaction", slack.NewTextBlockObject("plain_text", "Grab Reaction", false, false), nil, reactionElement)
+
+		usersElement := slack.NewOptionsMultiSelectBlockElement(
+			slack.MultiOptTypeUser,
+			slack.NewTextBlockObject("plain_text", "Everybody", false, false),
+			"grabReactionUsers",
 		)
+		usersElement.InitialUsers = s.grabReactionUsers()
+		users := slack.NewInputBlock("Grab Reaction Users", slack.NewTextBlockObject("plain_text", "Who Can Use It", false, false), nil, usersElement)
+		users.Optional = true
+
+		blocks = append(blocks, slack.NewDividerBlock(), workspaceExplanation, reaction, users)
+	}
+
+	var modalRequest slack.ModalViewRequest
+	modalRequest.Type = slack.ViewType("modal")
+	modalRequest.CallbackID = ChannelConfig
+	modalRequest.Title = slack.NewTextBlockObject("plain_text", "Channel Settings", false, false)
+	modalRequest.Close = slack.NewTextBlockObject("plain_text", "Cancel", false, false)
+	modalRequest.Submit = slack.NewTextBlockObject("plain_text", "Save", false, false)
+	modalRequest.Blocks = slack.Blocks{BlockSet: blocks}
+	modalRequest.PrivateMetadata = command.ChannelID
+	_, err = s.api.OpenView(command.TriggerID, modalRequest)
+	return err
+}
+
+func (s *SlackBridge) handleChannelConfigSubmission(payload slack.InteractionCallback) (err error) {
+	settings := ChannelSettings{
+		GrabID:         s.instance.GrabID,
+		ChannelID:      payload.View.PrivateMetadata,
+		DefaultArticle: strings.TrimSpace(payload.View.State.Values["Default Article"]["defaultArticle"].Value),
+		DefaultSection: strings.TrimSpace(payload.View.State.Values["Default Section"]["defaultSection"].Value),
 	}
+	err = upsertChannelSettings(db, &settings)
 	if err != nil {
 		return err
 	}
 
+	// Only there for admins, but check again anyway
+	if _, ok := payload.View.State.Values["Grab Reaction"]; ok && s.isWorkspaceAdmin(payload.User.ID) {
+		s.instance.SlackGrabReaction = s.reactionName(payload.View.State.Values["Grab Reaction"]["grabReaction"].Value)
+		s.instance.SlackGrabReactionUsers = strings.Join(payload.View.State.Values["Grab Reaction Users"]["grabReactionUsers"].SelectedUsers, ",")
+		err = updateInstance(db, s.instance.GrabID, &s.instance)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Slack only waits 3 seconds for options, so whatever isn't back by then
+// doesn't get shown
+const slackSuggestionTimeout = 2500 * time.Millisecond
+
+// Options for external_select menus, filtered by whatever's been typed
+func (s *SlackBridge) handleBlockSuggestion(payload slack.InteractionCallback) (response interface{}, err error) {
+	type result struct {
+		response interface{}
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		var r result
+		switch payload.ActionID {
+		case "book":
+			r.response, r.err = s.suggestBookStackLocations(payload.Value)
+		case "collection":
+			r.response, r.err = s.suggestOutlineCollections(payload.Value)
+		default:
+			r.err = fmt.Errorf("%w: %s", errNoSlackHandler, payload.ActionID)
+		}
+		results <- r
+	}()
+
+	select {
+	case r := <-results:
+		return r.response, r.err
+	case <-time.After(slackSuggestionTimeout):
+		return nil, fmt.Errorf("took too long to find options for %s", payload.ActionID)
+	}
+}
+
+// One group per book, with its chapters in it. Slack only takes 100 options,
+// so big wikis will have to search (or type the title out instead).
+func (s *SlackBridge) suggestBookStackLocations(query string) (response slack.OptionGroupsResponse, err error) {
+	w, err := NewBookStackBridge(s.instance)
+	if err != nil {
+		return response, err
+	}
+	books, chapters, err := w.listLocations()
+	if err != nil {
+		return response, err
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	matches := func(name string) bool { return strings.Contains(strings.ToLower(name), query) }
+	optionCount := 0
+	for _, book := range books {
+		var options []*slack.OptionBlockObject
+		bookMatches := matches(book.Name)
+		if bookMatches {
+			options = append(options, s.newOption(fmt.Sprintf("%d/0", book.ID), "(No chapter)"))
+		}
+		for _, chapter := range chapters[book.ID] {
+			if bookMatches || matches(chapter.Name) {
+				options = append(options, s.newOption(fmt.Sprintf("%d/%d", book.ID, chapter.ID), chapter.Name))
+			}
+		}
+		if len(options) == 0 {
+			continue
+		}
+		if optionCount+len(options) > 100 {
+			break
+		}
+		optionCount += len(options)
+		response.OptionGroups = append(response.OptionGroups, slack.NewOptionGroupBlockElement(
+			slack.NewTextBlockObject("plain_text", s.truncate(book.Name, 75), false, false),
+			options...,
+		))
+	}
+	return response, nil
+}
+
+func (s *SlackBridge) suggestOutlineCollections(query string) (response slack.OptionsResponse, err error) {
+	w, err := NewOutlineBridge(s.instance)
+	if err != nil {
+		return response, err
+	}
+	collections, err := w.listCollections()
+	if err != nil {
+		return response, err
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	response.Options = []*slack.OptionBlockObject{}
+	for _, collection := range collections {
+		if len(response.Options) == 100 {
+			break
+		}
+		if strings.Contains(strings.ToLower(collection.Name), query) {
+			response.Options = append(response.Options, s.newOption(collection.ID, collection.Name))
+		}
+	}
+	return response, nil
+}
+
 // Utility Functions
 
+// Everything between two timestamps, newest first, like Slack gives it to us.
+// If Slack gives up partway, nothing comes back but the error, so nobody
+// saves half a conversation thinking it's the whole thing.
 func (s *SlackBridge) getConversationHistory(channelID string, startTs string, endTs string) (conversation []slack.Message, err error) {
-	params := &slack.GetConversationHistoryParameters{
+	return s.getHistoryPages(&slack.GetConversationHistoryParameters{
 		ChannelID: channelID,
 		Oldest:    startTs,
 		Latest:    endTs,
 		Inclusive: true,
-	}
-
-	history, err := s.api.GetConversationHistory(params)
-	if err != nil {
-		log.Fatalf("Error getting conversation history: %s", err)
-	}
-	return history.Messages, nil
+	}, 0)
 }
 
 func (s *SlackBridge) getConversationReplies(channelID string, threadTs string) (conversation []slack.Message, err error) {
-	// Get the conversation history
 	params := slack.GetConversationRepliesParameters{
 		ChannelID: channelID,
 		Timestamp: threadTs,
+		Limit:     slackPageSize,
+	}
+	nextReport := slackProgressEvery
+	for {
+		var page []slack.Message
+		var hasMore bool
+		err = s.retry(func() (err error) {
+			page, hasMore, params.Cursor, err = s.api.GetConversationReplies(&params)
+			return err
+		})
+		if err != nil {
+			return nil, s.partialFetchError(len(conversation), err)
+		}
+		conversation = append(conversation, page...)
+		if len(conversation) >= nextReport {
+			s.reportProgress(fmt.Sprintf("Got %d messages so far...", len(conversation)))
+			nextReport += slackProgressEvery
+		}
+		if !hasMore || len(params.Cursor) == 0 {
+			return conversation, nil
+		}
+	}
+}
+
+// Follow the cursor until there's nothing left, or until we've got limit
+// messages (if it isn't 0)
+func (s *SlackBridge) getHistoryPages(params *slack.GetConversationHistoryParameters, limit int) (conversation []slack.Message, err error) {
+	nextReport := slackProgressEvery
+	for {
+		params.Limit = slackPageSize
+		if limit > 0 && limit-len(conversation) < slackPageSize {
+			params.Limit = limit - len(conversation)
+		}
+
+		var history *slack.GetConversationHistoryResponse
+		err = s.retry(func() (err error) {
+			history, err = s.api.GetConversationHistory(params)
+			return err
+		})
+		if err != nil {
+			return nil, s.partialFetchError(len(conversation), err)
+		}
+		conversation = append(conversation, history.Messages...)
+		if len(conversation) >= nextReport {
+			s.reportProgress(fmt.Sprintf("Got %d messages so far...", len(conversation)))
+			nextReport += slackProgressEvery
+		}
+
+		params.Cursor = history.ResponseMetaData.NextCursor
+		if !history.HasMore || len(params.Cursor) == 0 || (limit > 0 && len(conversation) >= limit) {
+			return conversation, nil
+		}
+	}
+}
+
+func (s *SlackBridge) partialFetchError(fetched int, err error) error {
+	if fetched == 0 {
+		return err
+	}
+	return fmt.Errorf("got %d messages, then Slack stopped giving us any more: %w", fetched, err)
+}
+
+// Slack rate limits history pretty hard. Wait as long as it tells us to, or
+// a little longer every time if it's just having a bad day.
+func (s *SlackBridge) retry(call func() error) (err error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = call()
+		if err == nil || attempt >= slackMaxRetries {
+			return err
+		}
+
+		var rateLimited *slack.RateLimitedError
+		var statusErr slack.StatusCodeError
+		if errors.As(err, &rateLimited) {
+			log.Printf("Slack rate limited us, waiting %s\n", rateLimited.RetryAfter)
+			time.Sleep(rateLimited.RetryAfter)
+		} else if errors.As(err, &statusErr) && statusErr.Retryable() {
+			log.Printf("Slack returned %s, waiting %s\n", statusErr.Status, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		} else {
+			return err
+		}
+	}
+}
+
+func (s *SlackBridge) reportProgress(text string) {
+	if s.progress != nil {
+		s.progress(text)
+	}
+}
+
+// The newest messages in a channel (not counting replies in threads), oldest
+// first. Leave oldestTS empty for no limit on how far back, and limit 0 for no
+// limit on how many.
+func (s *SlackBridge) getRecent(channelID string, oldestTS string, limit int) (thread Thread, err error) {
+	conversation, err := s.getHistoryPages(&slack.GetConversationHistoryParameters{
+		ChannelID: channelID,
+		Oldest:    oldestTS,
+	}, limit)
+	if err != nil {
+		return Thread{}, err
+	}
+	for i, j := 0, len(conversation)-1; i < j; i, j = i+1, j-1 {
+		conversation[i], conversation[j] = conversation[j], conversation[i]
+	}
+
+	thread, err = s.conversationToThread(conversation)
+	thread.Channel = s.getChannelName(channelID)
+	return thread, err
+}
+
+// Whatever "/grab config" set up for the channel, for when nobody said where
+// a grab goes
+func (s *SlackBridge) channelDefaults(channelID string, thread Thread, articleTitle string, sectionTitle string) (string, string) {
+	if len(articleTitle) > 0 {
+		return articleTitle, sectionTitle
+	}
+	settings, err := selectChannelSettings(db, s.instance.GrabID, channelID)
+	if err != nil {
+		log.Println("Could not get channel settings: ", err)
+		return articleTitle, sectionTitle
+	}
+	placeholders := strings.NewReplacer(
+		"{channel}", thread.Channel,
+		"{date}", thread.Timestamp.Format("2006-01-02"),
+	)
+	if len(sectionTitle) == 0 {
+		sectionTitle = placeholders.Replace(settings.DefaultSection)
+	}
+	return placeholders.Replace(settings.DefaultArticle), sectionTitle
+}
+
+const slackDefaultGrabReaction = "floppy_disk"
+
+func (s *SlackBridge) grabReaction() string {
+	if len(s.instance.SlackGrabReaction) > 0 {
+		return s.instance.SlackGrabReaction
+	}
+	return slackDefaultGrabReaction
+}
+
+func (s *SlackBridge) grabReactionUsers() (users []string) {
+	for _, user := range strings.Split(s.instance.SlackGrabReactionUsers, ",") {
+		if len(user) > 0 {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+func (s *SlackBridge) canGrabWithReaction(userID string) bool {
+	users := s.grabReactionUsers()
+	return len(users) == 0 || slices.Contains(users, userID)
+}
+
+// ":Floppy_Disk::skin-tone-2:" is just floppy_disk
+func (s *SlackBridge) reactionName(reaction string) string {
+	reaction = strings.ToLower(strings.Trim(strings.TrimSpace(reaction), ":"))
+	name, _, _ := strings.Cut(reaction, "::")
+	return name
+}
+
+func (s *SlackBridge) isWorkspaceAdmin(userID string) bool {
+	user, err := s.api.GetUserInfo(userID)
+	if err != nil {
+		log.Println("Could not get user info: ", err)
+		return false
+	}
+	return user.IsAdmin || user.IsOwner
+}
+
+// Everybody's "yesterday" is different, so go by their time zone
+func (s *SlackBridge) getUserLocation(userID string) *time.Location {
+	user, err := s.api.GetUserInfo(userID)
+	if err != nil {
+		return time.UTC
 	}
-	conversation, _, _, err = s.api.GetConversationReplies(&params)
+	location, err := time.LoadLocation(user.TZ)
 	if err != nil {
-		return conversation, err
+		return time.UTC
+	}
+	return location
+}
+
+var slackSinceDurationRegex = regexp.MustCompile(`^(\d+)([mhdw])$`)
+
+// "2h", "3d", "yesterday", "09:30", "2024-05-01", or "2024-05-01 14:00",
+// and then whatever's left over
+func (s *SlackBridge) parseSince(args string, location *time.Location, now time.Time) (since time.Time, rest string, err error) {
+	now = now.In(location)
+	words := strings.Fields(args)
+	if len(words) == 0 {
+		return since, "", fmt.Errorf("Since when?")
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	rest = strings.Join(words[1:], " ")
+
+	if match := slackSinceDurationRegex.FindStringSubmatch(words[0]); match != nil {
+		count, _ := strconv.Atoi(match[1])
+		unit := map[string]time.Duration{"m": time.Minute, "h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[match[2]]
+		return now.Add(-time.Duration(count) * unit), rest, nil
+	}
+	switch strings.ToLower(words[0]) {
+	case "today":
+		return today, rest, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), rest, nil
+	}
+	if clock, err := time.ParseInLocation("15:04", words[0], location); err == nil {
+		return today.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute), rest, nil
+	}
+	if len(words) > 1 {
+		if since, err = time.ParseInLocation("2006-01-02 15:04", words[0]+" "+words[1], location); err == nil {
+			return since, strings.Join(words[2:], " "), nil
+		}
+	}
+	if since, err = time.ParseInLocation("2006-01-02", words[0], location); err == nil {
+		return since, rest, nil
+	}
+	return since, "", fmt.Errorf("I don't know when %s is.", words[0])
+}
+
+func (s *SlackBridge) timeToSlackTS(t time.Time) string {
+	return fmt.Sprintf("%d.000000", t.Unix())
+}
+
+// Names are nicer than IDs, but not worth failing over
+func (s *SlackBridge) getChannelName(channelID string) string {
+	channel, err := s.api.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: channelID})
+	if err != nil || len(channel.Name) == 0 {
+		return channelID
 	}
-	return conversation, nil
+	return channel.Name
 }
 
 func (s *SlackBridge) getFile(file slack.File) (path string, err error) {
@@ -325,6 +1050,31 @@ func (s *SlackBridge) generateRangeTitleFormRequest(channelID string, threadTS s
 	return modalRequest
 }
 
+func (s *SlackBridge) generateForgeTitleFormRequest(user string) slack.ModalViewRequest {
+	modalRequest := s.generateTitleFormRequest("", "", user)
+
+	// Issue Link
+	issueLinkText := slack.NewTextBlockObject("plain_text", "Enter Issue, Pull Request, or Discussion Link", false, false)
+	issueLinkPlaceholder := slack.NewTextBlockObject("plain_text", "https://github.com/owner/repo/issues/1", false, false)
+	issueLinkElement := slack.NewPlainTextInputBlockElement(issueLinkPlaceholder, "issueLink")
+	issueLink := slack.NewInputBlock("Issue Link", issueLinkText, nil, issueLinkElement)
+
+	blocks := slack.Blocks{
+		BlockSet: []slack.Block{
+			modalRequest.Blocks.BlockSet[0],
+			issueLink,
+		},
+	}
+	for _, b := range modalRequest.Blocks.BlockSet[1:] {
+		blocks.BlockSet = append(blocks.BlockSet, b)
+	}
+	modalRequest.Blocks = blocks
+
+	modalRequest.Title = slack.NewTextBlockObject("plain_text", "Grab an issue", false, false)
+
+	return modalRequest
+}
+
 func (s *SlackBridge) generateTitleFormRequest(channelID string, threadTS string, user string) slack.ModalViewRequest {
 	// Create a ModalViewRequest with a header and two inputs
 	titleText := slack.NewTextBlockObject("plain_text", "Grab a thread", false, false)
@@ -377,6 +1127,18 @@ func (s *SlackBridge) generateTitleFormRequest(channelID string, threadTS string
 		},
 	}
 
+	// On BookStack, the title is just the page, and it goes wherever they pick
+	if len(s.instance.BookStackURL) > 0 {
+		articleTitle.Label = slack.NewTextBlockObject("plain_text", "Enter Page Title", false, false)
+		blocks.BlockSet = []slack.Block{messageText, s.generateBookStackSelect(), articleTitle, sectionTitle, clobberBox}
+	}
+
+	// And on Outline, it goes in whichever collection they pick
+	if len(s.instance.OutlineURL) > 0 {
+		articleTitle.Label = slack.NewTextBlockObject("plain_text", "Enter Document Title", false, false)
+		blocks.BlockSet = []slack.Block{messageText, s.generateOutlineSelect(), articleTitle, sectionTitle, clobberBox}
+	}
+
 	var modalRequest slack.ModalViewRequest
 	modalRequest.Type = slack.ViewType("modal")
 	modalRequest.Title = titleText
@@ -387,6 +1149,107 @@ func (s *SlackBridge) generateTitleFormRequest(channelID string, threadTS string
 	return modalRequest
 }
 
+// Slack asks for the books once the modal's open (see suggestBookStackLocations),
+// so a big or slow BookStack can't stop it from opening.
+func (s *SlackBridge) generateBookStackSelect() (block *slack.InputBlock) {
+	bookText := slack.NewTextBlockObject("plain_text", "Pick a Book and Chapter", false, false)
+	bookPlaceholder := slack.NewTextBlockObject("plain_text", "Book", false, false)
+	bookElement := slack.NewOptionsSelectBlockElement("external_select", bookPlaceholder, "book")
+	minQueryLength := 0
+	bookElement.MinQueryLength = &minQueryLength
+	block = slack.NewInputBlock("Book", bookText, nil, bookElement)
+	block.Optional = true
+	return block
+}
+
+// Leave it blank for the default collection. Like books, the collections
+// get loaded once the modal's open.
+func (s *SlackBridge) generateOutlineSelect() (block *slack.InputBlock) {
+	collectionText := slack.NewTextBlockObject("plain_text", "Pick a Collection", false, false)
+	collectionPlaceholder := slack.NewTextBlockObject("plain_text", "Collection", false, false)
+	collectionElement := slack.NewOptionsSelectBlockElement("external_select", collectionPlaceholder, "collection")
+	minQueryLength := 0
+	collectionElement.MinQueryLength = &minQueryLength
+	block = slack.NewInputBlock("Collection", collectionText, nil, collectionElement)
+	block.Optional = true
+	return block
+}
+
+func (s *SlackBridge) newOption(value string, text string) *slack.OptionBlockObject {
+	return slack.NewOptionBlockObject(value, slack.NewTextBlockObject("plain_text", s.truncate(text, 75), false, false), nil)
+}
+
+const slackMentionUsage = "Try `@Grab`, `@Grab to Article`, or `@Grab to Article / Section --overwrite`."
+
+// Mentions look like "<@U123> to Article / Section --overwrite", and so does
+// the end of "/grab last 10 to Article / Section". Everything is optional.
+// Sections are split off with a spaced out slash, so titles can still be paths.
+func (s *SlackBridge) parseDestination(text string) (articleTitle string, sectionTitle string, clobber bool, err error) {
+	var words []string
+	for _, word := range strings.Fields(html.UnescapeString(text)) {
+		if strings.HasPrefix(word, "<@") && strings.HasSuffix(word, ">") {
+			continue
+		}
+		// Slack likes to turn "--" into an em dash
+		flag := strings.TrimPrefix(word, "—")
+		if flag == word {
+			flag = strings.TrimPrefix(word, "--")
+		}
+		if flag != word {
+			if flag != "overwrite" {
+				return "", "", false, fmt.Errorf("I don't know what %s means.", word)
+			}
+			clobber = true
+			continue
+		}
+		words = append(words, word)
+	}
+
+	if len(words) > 0 && strings.EqualFold(words[0], "to") {
+		words = words[1:]
+		if len(words) == 0 {
+			return "", "", false, fmt.Errorf("To where?")
+		}
+	}
+
+	for i, word := range words {
+		if word == "/" {
+			articleTitle = strings.Join(words[:i], " ")
+			sectionTitle = strings.Join(words[i+1:], " ")
+			if articleTitle == "" || sectionTitle == "" {
+				return "", "", false, fmt.Errorf("I need both an article and a section, like `Article / Section`.")
+			}
+			return articleTitle, sectionTitle, clobber, nil
+		}
+	}
+	return strings.Join(words, " "), "", clobber, nil
+}
+
+func (s *SlackBridge) replyInThread(channelID string, threadTS string, text string) (err error) {
+	_, _, err = s.api.PostMessage(
+		channelID,
+		slack.MsgOptionTS(threadTS),
+		slack.MsgOptionText(text, false),
+	)
+	return err
+}
+
+// SLACK_API_URL points us somewhere other than Slack, like a fake one
+func slackAPIOptions() (options []slack.Option) {
+	if apiURL := os.Getenv("SLACK_API_URL"); apiURL != "" {
+		options = append(options, slack.OptionAPIURL(strings.TrimSuffix(apiURL, "/")+"/"))
+	}
+	return options
+}
+
+// Slack is picky about how long things are
+func (s *SlackBridge) truncate(text string, length int) string {
+	if len([]rune(text)) <= length {
+		return text
+	}
+	return string([]rune(text)[:length-1]) + "…"
+}
+
 // REALLY SHITTY parser from ChatGPT. I spent some time fucking around with the
 // Blocks and have concluded that writing a parser for that shit is a whole other
 // project in and of itself. Maybe someday. For now, my shit will probably be
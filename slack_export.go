@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// A Slack workspace export is a ZIP with channels.json, users.json, and a
+// directory per channel full of one JSON file per day. None of it needs the
+// Slack API to read.
+type SlackExport struct {
+	archive  *zip.ReadCloser
+	channels []SlackExportChannel
+	users    map[string]string
+	client   *http.Client
+}
+
+type SlackExportChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type SlackExportUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+}
+
+// A thread pulled out of the export, and where it goes on the wiki. Files
+// don't get downloaded until we actually turn it into a Thread.
+type SlackExportThread struct {
+	Key       string // Stable name for resuming, "<channel>/<ts>"
+	Channel   string
+	Section   string
+	Timestamp time.Time
+	messages  []slack.Message
+}
+
+var slackExportMentionRegex = regexp.MustCompile(`<@([A-Z0-9]+)(\|[^>]*)?>`)
+
+func OpenSlackExport(zipPath string) (e *SlackExport, err error) {
+	e = &SlackExport{
+		users:  map[string]string{},
+		client: &http.Client{Timeout: time.Second * 30},
+	}
+	e.archive, err = zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.readJSON("channels.json", &e.channels)
+	if err != nil {
+		e.archive.Close()
+		return nil, fmt.Errorf("could not read channels.json: %s", err)
+	}
+
+	var users []SlackExportUser
+	err = e.readJSON("users.json", &users)
+	if err != nil {
+		e.archive.Close()
+		return nil, fmt.Errorf("could not read users.json: %s", err)
+	}
+	for _, user := range users {
+		e.users[user.ID] = user.Name
+	}
+
+	return e, nil
+}
+
+func (e *SlackExport) Close() error {
+	return e.archive.Close()
+}
+
+// Rebuild every thread in a channel. Replies get stitched back onto their
+// parents, and anything that wasn't in a thread gets lumped together by day.
+func (e *SlackExport) getThreads(channel string) (threads []SlackExportThread, err error) {
+	conversation, err := e.getChannelMessages(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	threadMessages := map[string][]slack.Message{}
+	dayMessages := map[string][]slack.Message{}
+	for _, message := range conversation {
+		// Channel joins, topic changes, etc aren't interesting
+		if message.SubType != "" && message.SubType != "thread_broadcast" && message.SubType != "file_share" {
+			continue
+		}
+		if message.ThreadTimestamp != "" {
+			threadMessages[message.ThreadTimestamp] = append(threadMessages[message.ThreadTimestamp], message)
+		} else {
+			day := e.tsToTime(message.Timestamp).Format("2006-01-02")
+			dayMessages[day] = append(dayMessages[day], message)
+		}
+	}
+
+	for threadTS, messages := range threadMessages {
+		e.sortMessages(messages)
+		title := Thread{Messages: []Message{{Text: (&SlackBridge{}).mrkdwnToMarkdown(e.resolveMentions(messages[0].Text))}}}
+		threads = append(threads, SlackExportThread{
+			Key:       channel + "/" + threadTS,
+			Channel:   channel,
+			Section:   title.getTitle(),
+			Timestamp: e.tsToTime(messages[0].Timestamp),
+			messages:  messages,
+		})
+	}
+	for day, messages := range dayMessages {
+		e.sortMessages(messages)
+		threads = append(threads, SlackExportThread{
+			Key:       channel + "/" + day,
+			Channel:   channel,
+			Section:   day,
+			Timestamp: e.tsToTime(messages[0].Timestamp),
+			messages:  messages,
+		})
+	}
+
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i].Timestamp.Before(threads[j].Timestamp)
+	})
+	return threads, nil
+}
+
+// Like SlackBridge.conversationToThread, but with users from users.json
+// instead of GetUserInfo.
+func (e *SlackExport) conversationToThread(conversation []slack.Message) (thread Thread) {
+	thread.Timestamp = e.tsToTime(conversation[0].Timestamp)
+
+	s := SlackBridge{}
+	for _, message := range conversation {
+		m := Message{}
+		m.Timestamp = e.tsToTime(message.Timestamp)
+		m.Author = e.users[message.User]
+		if m.Author == "" {
+			m.Author = message.Username
+		}
+		m.Text = s.mrkdwnToMarkdown(e.resolveMentions(message.Text))
+
+		for _, attachment := range message.Attachments {
+			if attachment.Text != "" {
+				m.Text += "\n\n```" + attachment.Text + "```"
+			}
+		}
+
+		// Exports link files with a token baked into the URL. If it's expired,
+		// so be it.
+		for _, file := range message.Files {
+			path, err := e.getFile(file)
+			if err != nil {
+				log.Println("Could not save file: ", err)
+				continue
+			}
+			m.Files = append(m.Files, path)
+		}
+
+		thread.Messages = append(thread.Messages, m)
+	}
+	return thread
+}
+
+// Utility Functions
+
+// Slack timestamps are all the same length, so sorting the strings works
+func (e *SlackExport) sortMessages(conversation []slack.Message) {
+	sort.Slice(conversation, func(i, j int) bool {
+		return conversation[i].Timestamp < conversation[j].Timestamp
+	})
+}
+
+func (e *SlackExport) getChannelMessages(channel string) (conversation []slack.Message, err error) {
+	found := false
+	for _, file := range e.archive.File {
+		if path.Dir(file.Name) != channel || path.Ext(file.Name) != ".json" {
+			continue
+		}
+		found = true
+
+		var day []slack.Message
+		err = e.readJSON(file.Name, &day)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %s", file.Name, err)
+		}
+		conversation = append(conversation, day...)
+	}
+	if !found {
+		return nil, fmt.Errorf("no messages for channel %s in export", channel)
+	}
+	return conversation, nil
+}
+
+func (e *SlackExport) getFile(file slack.File) (path string, err error) {
+	if file.URLPrivateDownload == "" {
+		return "", fmt.Errorf("no download link for %s", file.Name)
+	}
+	rsp, err := e.client.Get(file.URLPrivateDownload)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || strings.HasPrefix(rsp.Header.Get("Content-Type"), "text/html") {
+		return "", fmt.Errorf("could not download %s: %s", file.Name, rsp.Status)
+	}
+	return saveTempFile(rsp.Body, file.Filetype)
+}
+
+func (e *SlackExport) resolveMentions(text string) string {
+	return slackExportMentionRegex.ReplaceAllStringFunc(text, func(mention string) string {
+		userID := slackExportMentionRegex.FindStringSubmatch(mention)[1]
+		if name, ok := e.users[userID]; ok {
+			return "@" + name
+		}
+		return mention
+	})
+}
+
+func (e *SlackExport) tsToTime(ts string) time.Time {
+	return (&SlackBridge{}).slackTSToTime(ts)
+}
+
+func (e *SlackExport) readJSON(name string, result interface{}) error {
+	file, err := e.archive.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	contents, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, result)
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"slices"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/slack-go/slack"
@@ -28,18 +30,25 @@ const (
 	AppendThreadCancel  = "append_thread_transcript_cancel"
 	// Shortcut for Grabbing a range of messages
 	AppendRange = "append_range"
+	// Shortcut for Grabbing an issue, PR, or discussion from a forge
+	GrabForge = "grab_forge"
+	// Modal from "/grab config"
+	ChannelConfig = "channel_config"
 )
 
-// Middleware to verify integrity of API calls from Slack
+// Middleware to verify integrity of API calls from Slack. Anything that fails
+// stops here, so nothing behind it ever sees an unsigned request.
 func signatureVerification(c *gin.Context) {
 	verifier, err := slack.NewSecretsVerifier(c.Request.Header, os.Getenv("SIGNATURE_SECRET"))
 	if err != nil {
 		c.String(http.StatusBadRequest, "error initializing signature verifier: %s", err.Error())
+		c.Abort()
 		return
 	}
 	bodyBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "error reading request body: %s", err.Error())
+		c.Abort()
 		return
 	}
 	bodyBytesCopy := make([]byte, len(bodyBytes))
@@ -47,10 +56,12 @@ func signatureVerification(c *gin.Context) {
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytesCopy))
 	if _, err = verifier.Write(bodyBytes); err != nil {
 		c.String(http.StatusInternalServerError, "error writing request body bytes for verification: %s", err.Error())
+		c.Abort()
 		return
 	}
 	if err = verifier.Ensure(); err != nil {
 		c.String(http.StatusUnauthorized, "error verifying slack signature: %s", err.Error())
+		c.Abort()
 		return
 	}
 	c.Next()
@@ -59,14 +70,9 @@ func signatureVerification(c *gin.Context) {
 // Register a user with Grab. Get Slack credentials and Wiki credentials
 func installResp() func(c *gin.Context) {
 	return func(c *gin.Context) {
-		_, errExists := c.GetQuery("error")
-		if errExists {
-			c.String(http.StatusOK, "error installing app")
-			return
-		}
-		code, codeExists := c.GetQuery("code")
-		if !codeExists {
-			c.String(http.StatusBadRequest, "missing mandatory 'code' query parameter")
+		code := c.PostForm("code")
+		if code == "" {
+			c.String(http.StatusBadRequest, "missing mandatory 'code' form field")
 			return
 		}
 		resp, err := slack.GetOAuthV2Response(http.DefaultClient,
@@ -87,16 +93,14 @@ func installResp() func(c *gin.Context) {
 		instance.GrabID = uuid.New().String()
 		instance.SlackTeamID = resp.Team.ID
 		instance.SlackAccessToken = resp.AccessToken
-		instance.MediaWikiUname = c.Query("mediaWikiUname")
-		instance.MediaWikiPword = c.Query("mediaWikiPword")
-		instance.MediaWikiURL = c.Query("mediaWikiURL")
+		setWikiCredentials(instance, c.PostForm)
 
 		err = insertInstance(db, instance)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "error storing slack access token: %s", err.Error())
 			return
 		}
-		c.Redirect(http.StatusFound, fmt.Sprintf("slack://app?team=%s&id=%s&tab=about", resp.Team.ID, resp.AppID))
+		installedPage(c, instance, "Grab is in your Slack workspace.", fmt.Sprintf("slack://app?team=%s&id=%s&tab=about", resp.Team.ID, resp.AppID))
 	}
 }
 
@@ -126,25 +130,11 @@ func eventResp() func(c *gin.Context) {
 		case slackevents.AppRateLimited:
 			c.String(http.StatusOK, "ack")
 		case slackevents.CallbackEvent:
-			ce, ok := event.Data.(*slackevents.EventsAPICallbackEvent)
-			if !ok {
-				c.String(http.StatusBadRequest, "invalid callback event payload sent from slack")
-				return
-			}
-			ie := &slackevents.EventsAPIInnerEvent{}
-			if err = json.Unmarshal(*ce.InnerEvent, ie); err != nil {
-				c.String(http.StatusBadRequest, "invalid inner event payload sent from slack: %s", err.Error())
-				return
-			}
-			switch ie.Type {
-			case string(slackevents.AppUninstalled):
-				log.Printf("App uninstalled from %s.\n", event.TeamID)
-				err = deleteInstance(db, event.TeamID)
-				if err != nil {
-					c.String(http.StatusInternalServerError, "error handling app uninstallation")
-				}
-			default:
-				c.String(http.StatusBadRequest, "no handler for event of given type")
+			err = handleSlackEvent(event)
+			if errors.Is(err, errNoSlackHandler) {
+				c.String(http.StatusBadRequest, err.Error())
+			} else if err != nil {
+				c.String(http.StatusInternalServerError, "error handling %s event: %s", event.InnerEvent.Type, err.Error())
 			}
 		default:
 			c.String(http.StatusBadRequest, "invalid event type sent from slack")
@@ -162,45 +152,179 @@ func interactionResp() func(c *gin.Context) {
 			return
 		}
 
-		fmt.Println(payload.Type)
+		// Menus that load their options come in here too, and want them back
+		if payload.Type == slack.InteractionTypeBlockSuggestion {
+			response, err := handleSlackSuggestion(payload)
+			if err != nil {
+				log.Println("Error handling block_suggestion: ", err)
+				c.JSON(http.StatusOK, slack.OptionsResponse{Options: []*slack.OptionBlockObject{}})
+				return
+			}
+			c.JSON(http.StatusOK, response)
+			return
+		}
 
-		// If it's not a modal action, we don't care.
-		validPayloads := []string{"shortcut", "view_submission", "message_action"}
-		if slices.Contains(validPayloads, string(payload.Type)) == false {
-			log.Println("Invalid payload type: ", payload.Type)
-			c.String(http.StatusBadRequest, "Invalid payload type: %s", payload.Type)
+		err = handleSlackInteraction(payload, func() { c.String(http.StatusOK, "") })
+		if errors.Is(err, errNoSlackHandler) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+// Slash commands get an answer right away, even if it's an error, so that
+// whoever ran it sees something
+func commandResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		command, err := slack.SlashCommandParse(c.Request)
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading slack command payload: %s", err.Error())
 			return
 		}
 
-		// Pull credentials out of DB
-		var instance Instance
-		instance, err = selectInstanceByTeamID(db, payload.User.TeamID)
+		response, err := handleSlackCommand(command)
 		if err != nil {
-			log.Println("Could not get credentials from DB", err)
-			c.String(http.StatusInternalServerError, "error reading slack access token: %s", err.Error())
+			response = fmt.Sprintf("Something went wrong: %s", err)
 		}
+		if len(response) == 0 {
+			c.String(http.StatusOK, "")
+			return
+		}
+		c.JSON(http.StatusOK, &slack.Msg{ResponseType: slack.ResponseTypeEphemeral, Text: response})
+	}
+}
 
-		s := NewSlackBridge(instance)
+// Everything below here doesn't care whether it came in over HTTP or Socket
+// Mode (see slack_socket.go)
+
+var errNoSlackHandler = errors.New("no handler for event of given type")
+
+func handleSlackEvent(event slackevents.EventsAPIEvent) (err error) {
+	switch event.InnerEvent.Type {
+	case string(slackevents.AppUninstalled):
+		log.Printf("App uninstalled from %s.\n", event.TeamID)
+		err = deleteInstance(db, event.TeamID)
+		if err != nil {
+			return fmt.Errorf("error handling app uninstallation: %w", err)
+		}
+		return nil
+	case string(slackevents.AppMention):
+		mention, ok := event.InnerEvent.Data.(*slackevents.AppMentionEvent)
+		if !ok {
+			return fmt.Errorf("invalid app_mention payload sent from slack")
+		}
+		instance, err := selectInstanceByTeamID(db, event.TeamID)
+		if err != nil {
+			return fmt.Errorf("error reading slack access token: %w", err)
+		}
 
-		switch payload.Type {
-		case "message_action":
-			err := s.handleMessageAction(payload)
+		// Grabbing takes longer than Slack will wait for us to answer
+		go func() {
+			s := NewSlackBridge(instance)
+			err := s.handleAppMention(mention)
 			if err != nil {
-				fmt.Printf("Error handling message_action: %s", err)
-				c.String(http.StatusInternalServerError, "Error handling message_action: %s", err.Error())
+				log.Println("Error handling app_mention: ", err)
 			}
-		case "shortcut":
-			err := s.handleShortcut(payload)
+		}()
+		return nil
+	case string(slackevents.ReactionAdded):
+		reaction, ok := event.InnerEvent.Data.(*slackevents.ReactionAddedEvent)
+		if !ok {
+			return fmt.Errorf("invalid reaction_added payload sent from slack")
+		}
+		instance, err := selectInstanceByTeamID(db, event.TeamID)
+		if err != nil {
+			return fmt.Errorf("error reading slack access token: %w", err)
+		}
+
+		go func() {
+			s := NewSlackBridge(instance)
+			err := s.handleReactionAdded(reaction)
 			if err != nil {
-				fmt.Printf("Error handling message_action: %s", err)
-				c.String(http.StatusInternalServerError, "Error handling message_action: %s", err.Error())
+				log.Println("Error handling reaction_added: ", err)
 			}
-		case "view_submission":
-			err := s.handleViewSubmission(c, payload, instance)
+		}()
+		return nil
+	default:
+		return errNoSlackHandler
+	}
+}
+
+func handleSlackCommand(command slack.SlashCommand) (response string, err error) {
+	if command.Command != "/grab" {
+		return "", fmt.Errorf("%w: %s", errNoSlackHandler, command.Command)
+	}
+	instance, err := selectInstanceByTeamID(db, command.TeamID)
+	if err != nil {
+		log.Println("Could not get credentials from DB", err)
+		return "", fmt.Errorf("error reading slack access token: %w", err)
+	}
+	s := NewSlackBridge(instance)
+	return s.handleGrabCommand(command)
+}
+
+func handleSlackSuggestion(payload slack.InteractionCallback) (response interface{}, err error) {
+	instance, err := selectInstanceByTeamID(db, payload.User.TeamID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading slack access token: %w", err)
+	}
+	s := NewSlackBridge(instance)
+	return s.handleBlockSuggestion(payload)
+}
+
+// ack gets called once Slack can stop waiting on us, unless something goes
+// wrong. Then it's up to whoever called this.
+func handleSlackInteraction(payload slack.InteractionCallback, ack func()) (err error) {
+	// Submissions ack early, so the rest don't need to
+	var ackOnce sync.Once
+	ackOnly := ack
+	ack = func() { ackOnce.Do(ackOnly) }
+
+	// If it's not a modal action, we don't care.
+	validPayloads := []string{"shortcut", "view_submission", "message_action"}
+	if slices.Contains(validPayloads, string(payload.Type)) == false {
+		log.Println("Invalid payload type: ", payload.Type)
+		return fmt.Errorf("%w: %s", errNoSlackHandler, payload.Type)
+	}
+
+	// Pull credentials out of DB
+	instance, err := selectInstanceByTeamID(db, payload.User.TeamID)
+	if err != nil {
+		log.Println("Could not get credentials from DB", err)
+		return fmt.Errorf("error reading slack access token: %w", err)
+	}
+
+	s := NewSlackBridge(instance)
+
+	switch payload.Type {
+	case "message_action":
+		err = s.handleMessageAction(payload)
+		if err != nil {
+			log.Println("Error handling message_action: ", err)
+			return fmt.Errorf("Error handling message_action: %w", err)
+		}
+	case "shortcut":
+		err = s.handleShortcut(payload)
+		if err != nil {
+			log.Println("Error handling shortcut: ", err)
+			return fmt.Errorf("Error handling shortcut: %w", err)
+		}
+	case "view_submission":
+		if payload.View.CallbackID == ChannelConfig {
+			err = s.handleChannelConfigSubmission(payload)
 			if err != nil {
-				fmt.Printf("Error handling view_submission: %s", err)
-				c.String(http.StatusInternalServerError, "Error handling view_submission: %s", err.Error())
+				log.Println("Error handling channel config: ", err)
+				return fmt.Errorf("Error handling channel config: %w", err)
 			}
+			break
+		}
+		err = s.handleViewSubmission(payload, instance, ack)
+		if err != nil {
+			log.Println("Error handling view_submission: ", err)
+			return fmt.Errorf("Error handling view_submission: %w", err)
 		}
 	}
+	ack()
+	return nil
 }
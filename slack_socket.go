@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// Socket Mode, for running Grab somewhere Slack can't reach. Instead of Slack
+// calling /slack/event/handle and /slack/interaction/handle, we open a
+// websocket to Slack and it sends everything down that. Turn it on with an
+// app-level token (with connections:write) in SLACK_APP_TOKEN.
+func startSlackSocketMode() {
+	appToken := os.Getenv("SLACK_APP_TOKEN")
+	if appToken == "" {
+		return
+	}
+
+	// The bot token is per workspace, so it comes from the DB like always.
+	// Opening the socket only needs the app token.
+	api := slack.New("", append(slackAPIOptions(), slack.OptionAppLevelToken(appToken))...)
+	client := socketmode.New(api)
+	go handleSlackSocketEvents(client)
+	go runSlackSocketMode(client)
+}
+
+// Run reconnects when Slack asks it to, but gives up if it can't. We don't.
+func runSlackSocketMode(client *socketmode.Client) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := client.Run()
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Slack Socket Mode disconnected, retrying in %s: %s\n", backoff, err)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func handleSlackSocketEvents(client *socketmode.Client) {
+	for evt := range client.Events {
+		switch evt.Type {
+		case socketmode.EventTypeConnecting:
+			log.Println("Connecting to Slack with Socket Mode...")
+		case socketmode.EventTypeConnected:
+			log.Println("Connected to Slack with Socket Mode")
+		case socketmode.EventTypeConnectionError, socketmode.EventTypeInvalidAuth:
+			log.Println("Slack Socket Mode connection failed: ", evt.Data)
+		case socketmode.EventTypeEventsAPI:
+			event, ok := evt.Data.(slackevents.EventsAPIEvent)
+			if !ok {
+				log.Println("Invalid event payload from Slack: ", evt.Data)
+				continue
+			}
+			// Nothing goes back for events, so don't keep Slack waiting
+			client.Ack(*evt.Request)
+			go func() {
+				err := handleSlackEvent(event)
+				if err != nil {
+					log.Printf("Error handling %s event: %s\n", event.InnerEvent.Type, err)
+				}
+			}()
+		case socketmode.EventTypeInteractive:
+			payload, ok := evt.Data.(slack.InteractionCallback)
+			if !ok {
+				log.Println("Invalid interaction payload from Slack: ", evt.Data)
+				continue
+			}
+			request := *evt.Request
+			if payload.Type == slack.InteractionTypeBlockSuggestion {
+				go func() {
+					response, err := handleSlackSuggestion(payload)
+					if err != nil {
+						log.Println("Error handling block_suggestion: ", err)
+						response = slack.OptionsResponse{Options: []*slack.OptionBlockObject{}}
+					}
+					client.Ack(request, response)
+				}()
+				continue
+			}
+			go func() {
+				var ackOnce sync.Once
+				ack := func() { ackOnce.Do(func() { client.Ack(request) }) }
+				err := handleSlackInteraction(payload, ack)
+				if err != nil {
+					log.Println("Error handling interaction: ", err)
+				}
+				ack()
+			}()
+		case socketmode.EventTypeSlashCommand:
+			command, ok := evt.Data.(slack.SlashCommand)
+			if !ok {
+				log.Println("Invalid slash command payload from Slack: ", evt.Data)
+				continue
+			}
+			request := *evt.Request
+			go func() {
+				response, err := handleSlackCommand(command)
+				if err != nil {
+					log.Println("Error handling slash command: ", err)
+					response = fmt.Sprintf("Something went wrong: %s", err)
+				}
+				if len(response) == 0 {
+					client.Ack(request)
+					return
+				}
+				client.Ack(request, &slack.Msg{ResponseType: slack.ResponseTypeEphemeral, Text: response})
+			}()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// Nothing is listening on port 1, so every query fails right away
+func useUnreachableDB(t *testing.T) {
+	old := db
+	pgdb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN("postgres://grab@127.0.0.1:1/grab?sslmode=disable")))
+	db = bun.NewDB(pgdb, pgdialect.New())
+	t.Cleanup(func() {
+		db.Close()
+		db = old
+	})
+}
+
+// Connects Grab to a local websocket that plays Slack's part, and returns a
+// function that sends it an envelope and waits for the ack
+func connectSlackSocket(t *testing.T) func(envelope map[string]interface{}) socketmode.Response {
+	envelopes := make(chan map[string]interface{})
+	acks := make(chan socketmode.Response)
+
+	var server *httptest.Server
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/apps.connections.open":
+			if r.Header.Get("Authorization") != "Bearer xapp-test" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": "invalid_auth"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"ok":  true,
+				"url": "ws" + strings.TrimPrefix(server.URL, "http") + "/link",
+			})
+		case "/link":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.WriteJSON(map[string]interface{}{"type": "hello", "num_connections": 1})
+			go func() {
+				for {
+					var ack socketmode.Response
+					if conn.ReadJSON(&ack) != nil {
+						return
+					}
+					acks <- ack
+				}
+			}()
+			for {
+				select {
+				case envelope := <-envelopes:
+					if conn.WriteJSON(envelope) != nil {
+						return
+					}
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("SLACK_API_URL", server.URL+"/api/")
+
+	api := slack.New("", append(slackAPIOptions(), slack.OptionAppLevelToken("xapp-test"))...)
+	client := socketmode.New(api)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go handleSlackSocketEvents(client)
+	go client.RunContext(ctx)
+
+	return func(envelope map[string]interface{}) socketmode.Response {
+		t.Helper()
+		select {
+		case envelopes <- envelope:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Grab never connected to the socket")
+		}
+		select {
+		case ack := <-acks:
+			return ack
+		case <-time.After(5 * time.Second):
+			t.Fatalf("envelope %s was never acked", envelope["envelope_id"])
+		}
+		return socketmode.Response{}
+	}
+}
+
+func TestSlackSocketMode(t *testing.T) {
+	useUnreachableDB(t)
+	send := connectSlackSocket(t)
+
+	tests := []struct {
+		name    string
+		kind    string
+		payload interface{}
+		// What Slack should get back with the ack, if anything
+		check func(payload map[string]interface{}) bool
+	}{
+		{
+			name:    "event",
+			kind:    "events_api",
+			payload: map[string]interface{}{"type": "event_callback", "team_id": "T1", "event": map[string]string{"type": "app_uninstalled"}},
+		},
+		{
+			name:    "unhandled interaction",
+			kind:    "interactive",
+			payload: slack.InteractionCallback{Type: slack.InteractionTypeBlockActions, User: slack.User{TeamID: "T1"}},
+		},
+		{
+			// The handler fails without a database, and Slack still hears back
+			name:    "shortcut",
+			kind:    "interactive",
+			payload: slack.InteractionCallback{Type: slack.InteractionTypeShortcut, CallbackID: "grab", User: slack.User{TeamID: "T1"}},
+		},
+		{
+			// Menus get an answer they can show, even if it's empty
+			name:    "options",
+			kind:    "interactive",
+			payload: slack.InteractionCallback{Type: slack.InteractionTypeBlockSuggestion, ActionID: "book", User: slack.User{TeamID: "T1"}},
+			check: func(payload map[string]interface{}) bool {
+				options, _ := payload["options"].([]interface{})
+				return len(options) == 0
+			},
+		},
+		{
+			name:    "slash command",
+			kind:    "slash_commands",
+			payload: slack.SlashCommand{Command: "/grab", TeamID: "T1"},
+			// Whoever ran it gets told it didn't work
+			check: func(payload map[string]interface{}) bool {
+				text, _ := payload["text"].(string)
+				return payload["response_type"] == slack.ResponseTypeEphemeral && strings.HasPrefix(text, "Something went wrong")
+			},
+		},
+	}
+	for _, test := range tests {
+		ack := send(map[string]interface{}{
+			"envelope_id":              test.name,
+			"type":                     test.kind,
+			"payload":                  test.payload,
+			"accepts_response_payload": true,
+		})
+		if ack.EnvelopeID != test.name {
+			t.Errorf("%s: acked the wrong envelope: %+v", test.name, ack)
+			continue
+		}
+		payload, _ := ack.Payload.(map[string]interface{})
+		if test.check == nil && ack.Payload != nil {
+			t.Errorf("%s: expected a bare ack, got %+v", test.name, ack.Payload)
+		}
+		if test.check != nil && (payload == nil || !test.check(payload)) {
+			t.Errorf("%s: unexpected response %+v", test.name, ack.Payload)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Teams doesn't let bots read conversations, so we go through Microsoft Graph
+// for that. Replies go back through the Bot Framework connector.
+const (
+	teamsDefaultGraphURL    = "https://graph.microsoft.com/v1.0"
+	teamsDefaultLoginURL    = "https://login.microsoftonline.com"
+	teamsBotFrameworkTenant = "botframework.com"
+	teamsGraphScope         = "https://graph.microsoft.com/.default"
+	teamsBotFrameworkScope  = "https://api.botframework.com/.default"
+)
+
+type TeamsBridge struct {
+	client      *http.Client
+	graphURL    string
+	loginURL    string
+	tenantID    string
+	appID       string
+	appPassword string
+}
+
+// Tokens last about an hour, so hang on to them between requests
+var microsoftTokens = map[string]microsoftToken{}
+var microsoftTokensLock sync.Mutex
+
+type microsoftToken struct {
+	value   string
+	expires time.Time
+}
+
+type TeamsChatMessage struct {
+	ID              string    `json:"id"`
+	ReplyToID       string    `json:"replyToId"`
+	MessageType     string    `json:"messageType"`
+	CreatedDateTime time.Time `json:"createdDateTime"`
+	From            struct {
+		User *struct {
+			ID          string `json:"id"`
+			DisplayName string `json:"displayName"`
+		} `json:"user"`
+		Application *struct {
+			ID          string `json:"id"`
+			DisplayName string `json:"displayName"`
+		} `json:"application"`
+	} `json:"from"`
+	Body struct {
+		ContentType string `json:"contentType"`
+		Content     string `json:"content"`
+	} `json:"body"`
+	Attachments []struct {
+		ContentType string `json:"contentType"`
+		ContentURL  string `json:"contentUrl"`
+		Name        string `json:"name"`
+	} `json:"attachments"`
+}
+
+// Inline images show up as <img src=".../hostedContents/<id>/$value">
+var teamsHostedContentRegex = regexp.MustCompile(`<img[^>]+src="([^"]+/hostedContents/[^"]+)"[^>]*>`)
+
+func NewTeamsBridge(instance Instance) (t TeamsBridge) {
+	t.client = &http.Client{Timeout: time.Second * 30}
+	t.graphURL = os.Getenv("TEAMS_GRAPH_URL")
+	if t.graphURL == "" {
+		t.graphURL = teamsDefaultGraphURL
+	}
+	t.loginURL = os.Getenv("TEAMS_LOGIN_URL")
+	if t.loginURL == "" {
+		t.loginURL = teamsDefaultLoginURL
+	}
+	t.tenantID = instance.TeamsTenantID
+	t.appID = os.Getenv("TEAMS_APP_ID")
+	t.appPassword = os.Getenv("TEAMS_APP_PASSWORD")
+	return t
+}
+
+// A Teams reply chain is a root channel message and its replies. The channel
+// ID has to come with the team's group ID, since that's how Graph finds it,
+// so it's "<teamID>/<channelID>".
+func (t *TeamsBridge) getThread(channelID string, threadID string) (thread Thread, err error) {
+	teamID, channel, ok := strings.Cut(channelID, "/")
+	if !ok {
+		return Thread{}, fmt.Errorf("invalid teams channel: %s", channelID)
+	}
+	endpoint := fmt.Sprintf("/teams/%s/channels/%s/messages/%s", url.PathEscape(teamID), url.PathEscape(channel), url.PathEscape(threadID))
+
+	var root TeamsChatMessage
+	err = t.graphRequest(http.MethodGet, t.graphURL+endpoint, &root)
+	if err != nil {
+		return Thread{}, err
+	}
+	conversation := []TeamsChatMessage{root}
+
+	// Graph hands these back newest first, a page at a time
+	var replies []TeamsChatMessage
+	next := t.graphURL + endpoint + "/replies?$top=50"
+	for next != "" {
+		var page struct {
+			Value    []TeamsChatMessage `json:"value"`
+			NextLink string             `json:"@odata.nextLink"`
+		}
+		err = t.graphRequest(http.MethodGet, next, &page)
+		if err != nil {
+			return Thread{}, err
+		}
+		replies = append(replies, page.Value...)
+		next = page.NextLink
+	}
+	for i := len(replies) - 1; i >= 0; i-- {
+		conversation = append(conversation, replies[i])
+	}
+
+	return t.conversationToThread(conversation)
+}
+
+func (t *TeamsBridge) conversationToThread(conversation []TeamsChatMessage) (thread Thread, err error) {
+	// The root message is when this party started
+	thread.Timestamp = conversation[0].CreatedDateTime
+
+	for _, message := range conversation {
+		// Don't include messages from Grab (or any other bot), or system
+		// messages about people joining and such.
+		if message.MessageType != "message" || message.From.User == nil {
+			continue
+		}
+
+		m := Message{}
+		m.Timestamp = message.CreatedDateTime
+		m.Author = message.From.User.DisplayName
+
+		// Pull inline images out of the HTML before we convert it
+		content := message.Body.Content
+		for _, img := range teamsHostedContentRegex.FindAllStringSubmatch(content, -1) {
+			// Our token only goes to Graph, whatever the message says
+			if !t.isGraphURL(img[1]) {
+				continue
+			}
+			path, err := t.getFile(img[1])
+			if err != nil {
+				log.Println("Could not save file: ", err)
+				continue
+			}
+			m.Files = append(m.Files, path)
+			content = strings.Replace(content, img[0], "", 1)
+		}
+
+		if message.Body.ContentType == "html" {
+			m.Text, err = pandocConvert(content, "html", "markdown")
+			if err != nil {
+				log.Println("Warning: Failed to convert Teams HTML to markdown: ", err)
+				m.Text = content
+			}
+		} else {
+			m.Text = content
+		}
+		m.Text = strings.TrimSpace(m.Text)
+
+		// Files shared in the channel live in SharePoint. Link them, at least.
+		for _, attachment := range message.Attachments {
+			if attachment.ContentType == "reference" {
+				m.Text += fmt.Sprintf("\n\n[%s](%s)", attachment.Name, attachment.ContentURL)
+			}
+		}
+
+		thread.Messages = append(thread.Messages, m)
+	}
+
+	return thread, nil
+}
+
+// Utility Functions
+
+func (t *TeamsBridge) getFile(fileURL string) (path string, err error) {
+	token, err := t.getToken(t.tenantID, teamsGraphScope)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rsp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting file from Teams: %s", rsp.Status)
+	}
+
+	// Hosted contents are (almost) always pictures
+	extension := "png"
+	switch rsp.Header.Get("Content-Type") {
+	case "image/jpeg":
+		extension = "jpg"
+	case "image/gif":
+		extension = "gif"
+	}
+	return saveTempFile(rsp.Body, extension)
+}
+
+func (t *TeamsBridge) isGraphURL(link string) bool {
+	graph, err := url.Parse(t.graphURL)
+	if err != nil {
+		return false
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return parsed.Scheme == graph.Scheme && parsed.Host == graph.Host
+}
+
+// Reply to an activity through the Bot Framework connector
+func (t *TeamsBridge) replyToActivity(activity TeamsActivity, reply map[string]interface{}) (err error) {
+	token, err := t.getToken(teamsBotFrameworkTenant, teamsBotFrameworkScope)
+	if err != nil {
+		return err
+	}
+
+	reply["type"] = "message"
+	reply["replyToId"] = activity.ID
+	reply["conversation"] = activity.Conversation
+	reply["recipient"] = activity.From
+	reply["from"] = activity.Recipient
+
+	bodyBytes, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/v3/conversations/%s/activities", strings.TrimSuffix(activity.ServiceURL, "/"), url.PathEscape(activity.Conversation.ID))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		responseBody, _ := io.ReadAll(rsp.Body)
+		return fmt.Errorf("bot framework returned %s: %s", rsp.Status, string(responseBody))
+	}
+	return nil
+}
+
+// Client credentials flow. Graph tokens are per-tenant, Bot Framework tokens
+// are not.
+func (t *TeamsBridge) getToken(tenantID string, scope string) (token string, err error) {
+	return getMicrosoftToken(t.client, t.loginURL, tenantID, t.appID, t.appPassword, scope)
+}
+
+// Anything that talks to Microsoft (SharePoint too) logs in the same way
+func getMicrosoftToken(client *http.Client, loginURL string, tenantID string, clientID string, clientSecret string, scope string) (token string, err error) {
+	microsoftTokensLock.Lock()
+	defer microsoftTokensLock.Unlock()
+
+	// Tenant and client IDs aren't secret, so anybody could put in someone
+	// else's. Only whoever has the secret gets the token that goes with it,
+	// and only from the login server that gave it out.
+	secretSum := sha256.Sum256([]byte(clientSecret))
+	key := loginURL + " " + tenantID + " " + clientID + " " + hex.EncodeToString(secretSum[:]) + " " + scope
+	if cached, ok := microsoftTokens[key]; ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"scope":         {scope},
+	}
+	rsp, err := client.PostForm(fmt.Sprintf("%s/%s/oauth2/v2.0/token", loginURL, tenantID), form)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not get token for %s: %s", scope, rsp.Status)
+	}
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", err
+	}
+
+	// Give ourselves a minute of slack so we don't use a token as it dies
+	microsoftTokens[key] = microsoftToken{
+		value:   tokenResponse.AccessToken,
+		expires: time.Now().Add(time.Duration(tokenResponse.ExpiresIn-60) * time.Second),
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+func (t *TeamsBridge) graphRequest(method string, endpoint string, result interface{}) (err error) {
+	token, err := t.getToken(t.tenantID, teamsGraphScope)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rsp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("graph returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	return json.Unmarshal(responseBody, result)
+}
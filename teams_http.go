@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+)
+
+type TeamsChannelAccount struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	AADObjectID string `json:"aadObjectId,omitempty"`
+}
+
+// A Bot Framework activity. We only fill in what we use.
+type TeamsActivity struct {
+	Type         string              `json:"type"`
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Text         string              `json:"text"`
+	ServiceURL   string              `json:"serviceUrl"`
+	From         TeamsChannelAccount `json:"from"`
+	Recipient    TeamsChannelAccount `json:"recipient"`
+	Conversation struct {
+		ID               string `json:"id"`
+		ConversationType string `json:"conversationType"`
+		TenantID         string `json:"tenantId"`
+	} `json:"conversation"`
+	ChannelData struct {
+		Tenant struct {
+			ID string `json:"id"`
+		} `json:"tenant"`
+		Team struct {
+			ID         string `json:"id"`
+			AADGroupID string `json:"aadGroupId"`
+		} `json:"team"`
+		Channel struct {
+			ID string `json:"id"`
+		} `json:"channel"`
+	} `json:"channelData"`
+	Value struct {
+		CommandID      string `json:"commandId"`
+		MessagePayload struct {
+			ID        string `json:"id"`
+			ReplyToID string `json:"replyToId"`
+		} `json:"messagePayload"`
+		Data struct {
+			ArticleTitle string `json:"articleTitle"`
+			SectionTitle string `json:"sectionTitle"`
+			Clobber      string `json:"clobber"`
+		} `json:"data"`
+	} `json:"value"`
+}
+
+// The command ID from the Teams app manifest
+const TeamsGrabConversation = "grabConversation"
+
+// Anything that can tell us whether a request really came from Teams. The
+// real thing checks Bot Framework JWTs, outgoing webhooks use HMAC, and tests
+// can swap in whatever they like.
+type TeamsVerifier interface {
+	verify(r *http.Request, body []byte) error
+}
+
+var teamsVerifier TeamsVerifier
+
+// Pick a verifier based on how Grab is hooked up to Teams
+func newTeamsVerifier() TeamsVerifier {
+	if secret := os.Getenv("TEAMS_HMAC_SECRET"); secret != "" {
+		return &TeamsHMACVerifier{secret: secret}
+	}
+	metadataURL := os.Getenv("TEAMS_OPENID_METADATA_URL")
+	if metadataURL == "" {
+		metadataURL = "https://login.botframework.com/v1/.well-known/openidconfiguration"
+	}
+	return &TeamsJWTVerifier{
+		client:      &http.Client{Timeout: time.Second * 10},
+		metadataURL: metadataURL,
+		issuer:      "https://api.botframework.com",
+		audience:    os.Getenv("TEAMS_APP_ID"),
+	}
+}
+
+// Middleware to verify integrity of activities from Teams
+func teamsSignatureVerification(c *gin.Context) {
+	bodyBytes, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error reading request body"})
+		return
+	}
+	if err = teamsVerifier.verify(c.Request, bodyBytes); err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("error verifying teams request: %s", err)})
+		return
+	}
+	c.Set(gin.BodyBytesKey, bodyBytes)
+	c.Next()
+}
+
+// Outgoing webhooks sign the body with a shared secret
+type TeamsHMACVerifier struct {
+	secret string
+}
+
+func (v *TeamsHMACVerifier) verify(r *http.Request, body []byte) error {
+	key, err := base64.StdEncoding.DecodeString(v.secret)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	expected := "HMAC " + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get("Authorization")), []byte(expected)) {
+		return errors.New("invalid hmac signature")
+	}
+	return nil
+}
+
+// Bot Framework signs a JWT with one of the keys it publishes
+type TeamsJWTVerifier struct {
+	client      *http.Client
+	metadataURL string
+	issuer      string
+	audience    string
+
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+	keysTried   time.Time
+	keysLock    sync.Mutex
+}
+
+// Anyone can send us a token with a made up kid, so don't go back to Bot
+// Framework for every one of them
+const teamsKeyRefetchInterval = 5 * time.Minute
+
+func (v *TeamsJWTVerifier) verify(r *http.Request, body []byte) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return errors.New("missing bearer token")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := v.decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unexpected signing algorithm %s", header.Alg)
+	}
+
+	key, err := v.getKey(header.Kid)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return errors.New("invalid token signature")
+	}
+
+	var claims struct {
+		Issuer     string `json:"iss"`
+		Audience   string `json:"aud"`
+		Expires    int64  `json:"exp"`
+		NotBefore  int64  `json:"nbf"`
+		ServiceURL string `json:"serviceurl"`
+	}
+	if err = v.decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+
+	// Allow a few minutes of clock skew
+	now := time.Now()
+	skew := 5 * time.Minute
+	if claims.Issuer != v.issuer || claims.Audience != v.audience {
+		return errors.New("token is not for us")
+	}
+	if now.After(time.Unix(claims.Expires, 0).Add(skew)) || now.Before(time.Unix(claims.NotBefore, 0).Add(-skew)) {
+		return errors.New("token is expired")
+	}
+
+	// Make sure we'd be replying to the same place that sent this
+	var activity struct {
+		ServiceURL string `json:"serviceUrl"`
+	}
+	if err = json.Unmarshal(body, &activity); err != nil {
+		return err
+	}
+	if claims.ServiceURL != "" && claims.ServiceURL != activity.ServiceURL {
+		return errors.New("service url does not match token")
+	}
+	return nil
+}
+
+func (v *TeamsJWTVerifier) decodeSegment(segment string, result interface{}) error {
+	segmentBytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(segmentBytes, result)
+}
+
+// The keys rotate, so refetch them once a day or whenever we see one we
+// don't know.
+func (v *TeamsJWTVerifier) getKey(kid string) (*rsa.PublicKey, error) {
+	v.keysLock.Lock()
+	defer v.keysLock.Unlock()
+
+	key, ok := v.keys[kid]
+	if ok && time.Since(v.keysFetched) < 24*time.Hour {
+		return key, nil
+	}
+	if time.Since(v.keysTried) < teamsKeyRefetchInterval {
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %s", kid)
+		}
+		return key, nil
+	}
+	v.keysTried = time.Now()
+
+	var metadata struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(v.metadataURL, &metadata); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(metadata.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	v.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		v.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	v.keysFetched = time.Now()
+
+	key, ok = v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	return key, nil
+}
+
+func (v *TeamsJWTVerifier) getJSON(url string, result interface{}) error {
+	rsp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not get %s: %s", url, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(result)
+}
+
+// Teams apps get installed by an admin, who then tells us where their wiki
+// is. Anybody could say they're any tenant, so the tenant only gets hooked up
+// once someone in it sends Grab the link code, which Teams signs for us.
+func teamsInstallResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		instance := new(Instance)
+		instance.GrabID = uuid.New().String()
+		instance.TeamsLinkCode = uuid.New().String()
+		setWikiCredentials(instance, c.PostForm)
+
+		err := insertInstance(db, instance)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error storing teams tenant: %s", err.Error())
+			return
+		}
+		installedPage(c, instance, fmt.Sprintf("Almost there! In Teams, send Grab a message saying: link %s", instance.TeamsLinkCode), "")
+	}
+}
+
+func teamsActivityResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var activity TeamsActivity
+		err := c.ShouldBindBodyWith(&activity, binding.JSON)
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading teams activity: %s", err.Error())
+			return
+		}
+
+		// We only care about the message extension, and link codes. Everything
+		// else (people joining, the bot getting installed) gets a polite nod.
+		if activity.Type == "message" {
+			handleTeamsLink(activity)
+			c.Status(http.StatusOK)
+			return
+		}
+		if activity.Type != "invoke" {
+			c.Status(http.StatusOK)
+			return
+		}
+
+		// Pull credentials out of DB
+		instance, err := selectInstanceByTeamsTenantID(db, activity.ChannelData.Tenant.ID)
+		if err != nil {
+			log.Println("Could not get credentials from DB", err)
+			c.String(http.StatusInternalServerError, "error reading teams tenant: %s", err.Error())
+			return
+		}
+
+		t := NewTeamsBridge(instance)
+
+		switch activity.Name {
+		case "composeExtension/fetchTask":
+			t.handleFetchTask(c, activity)
+		case "composeExtension/submitAction":
+			t.handleSubmitAction(c, activity, instance)
+		default:
+			c.String(http.StatusBadRequest, "Invalid invoke: %s", activity.Name)
+		}
+	}
+}
+
+// Interaction Handlers
+
+// "link <code>" (after an @Grab, in a channel) hooks up whichever tenant it
+// came from to the install that code belongs to
+func handleTeamsLink(activity TeamsActivity) {
+	words := strings.Fields(activity.Text)
+	index := slices.IndexFunc(words, func(word string) bool { return strings.EqualFold(word, "link") })
+	if index < 0 || index+1 >= len(words) {
+		return
+	}
+	tenantID := activity.ChannelData.Tenant.ID
+	if tenantID == "" {
+		tenantID = activity.Conversation.TenantID
+	}
+
+	instance, err := selectInstanceByTeamsLinkCode(db, words[index+1])
+	text := "Grab is ready! Use 'Grab conversation' from the ... menu on any channel message."
+	if err != nil || tenantID == "" {
+		text = "I don't know that link code. Fill out the install form again to get a new one."
+	} else if err = linkTeamsTenant(db, instance.GrabID, tenantID); err != nil {
+		log.Println("Could not link Teams tenant: ", err)
+		text = fmt.Sprintf("Could not link your tenant: %s", err)
+	}
+
+	t := NewTeamsBridge(instance)
+	go func() {
+		err := t.replyToActivity(activity, map[string]interface{}{"text": text})
+		if err != nil {
+			log.Println("Could not respond to Teams link: ", err)
+		}
+	}()
+}
+
+func (t *TeamsBridge) handleFetchTask(c *gin.Context, activity TeamsActivity) {
+	if activity.Value.CommandID != TeamsGrabConversation {
+		c.String(http.StatusBadRequest, "Invalid command: %s", activity.Value.CommandID)
+		return
+	}
+
+	// Graph can only find reply chains in channels
+	if activity.ChannelData.Channel.ID == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"task": gin.H{"type": "message", "value": "'Grab conversation' only works in channels!"},
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"task": gin.H{
+			"type": "continue",
+			"value": gin.H{
+				"title": "Grab a conversation",
+				"card":  t.generateTitleFormCard(),
+			},
+		},
+	})
+}
+
+func (t *TeamsBridge) handleSubmitAction(c *gin.Context, activity TeamsActivity, instance Instance) {
+	channelID := activity.ChannelData.Team.AADGroupID + "/" + activity.ChannelData.Channel.ID
+	threadID := activity.Value.MessagePayload.ReplyToID
+	if threadID == "" {
+		threadID = activity.Value.MessagePayload.ID
+	}
+	data := activity.Value.Data
+
+	// Close the form now, and let them know how it went in the thread
+	c.JSON(http.StatusOK, gin.H{})
+
+	go func() {
+		url, err := archiveThread(t, instance, channelID, threadID, data.ArticleTitle, data.SectionTitle, data.Clobber == "true")
+		var reply map[string]interface{}
+		if err != nil {
+			log.Println("Error grabbing Teams conversation: ", err)
+			reply = map[string]interface{}{"text": fmt.Sprintf("Could not save article: %s", err)}
+		} else {
+			reply = map[string]interface{}{
+				"attachments": []interface{}{t.generateSavedCard(url)},
+			}
+		}
+		err = t.replyToActivity(activity, reply)
+		if err != nil {
+			log.Println("Could not respond to Teams action: ", err)
+		}
+	}()
+}
+
+// Same form as generateTitleFormRequest, but as an adaptive card
+func (t *TeamsBridge) generateTitleFormCard() gin.H {
+	return gin.H{
+		"contentType": "application/vnd.microsoft.card.adaptive",
+		"content": gin.H{
+			"type":    "AdaptiveCard",
+			"version": "1.4",
+			"body": []gin.H{
+				{"type": "TextBlock", "wrap": true, "text": "Saving thread transcript! Please provide some article info. You can specify existing articles and sections, or come up with new ones."},
+				{"type": "Input.Text", "id": "articleTitle", "label": "Enter Article Title", "placeholder": "Article Title"},
+				{"type": "Input.Text", "id": "sectionTitle", "label": "Enter Section Title", "placeholder": "Section Title"},
+				{"type": "Input.Toggle", "id": "clobber", "title": "Overwrite existing content", "valueOn": "true", "valueOff": "false"},
+				{"type": "TextBlock", "wrap": true, "isSubtle": true, "text": "By selecting this, any data already present under the provided article/section will be ERASED."},
+			},
+			"actions": []gin.H{
+				{"type": "Action.Submit", "title": "Submit"},
+			},
+		},
+	}
+}
+
+func (t *TeamsBridge) generateSavedCard(url string) gin.H {
+	return gin.H{
+		"contentType": "application/vnd.microsoft.card.adaptive",
+		"content": gin.H{
+			"type":    "AdaptiveCard",
+			"version": "1.4",
+			"body": []gin.H{
+				{"type": "TextBlock", "wrap": true, "text": "Article saved!"},
+			},
+			"actions": []gin.H{
+				{"type": "Action.OpenUrl", "title": "Open in wiki", "url": url},
+			},
+		},
+	}
+}
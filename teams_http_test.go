@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Only lets through requests that say they're allowed
+type fakeTeamsVerifier struct{}
+
+func (v fakeTeamsVerifier) verify(r *http.Request, body []byte) error {
+	if r.Header.Get("Authorization") != "let me in" {
+		return errors.New("nope")
+	}
+	return nil
+}
+
+func TestTeamsSignatureVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := teamsVerifier
+	teamsVerifier = fakeTeamsVerifier{}
+	t.Cleanup(func() { teamsVerifier = old })
+
+	var reached string
+	app := gin.New()
+	app.Use(teamsSignatureVerification)
+	app.POST("/teams/api/messages", func(c *gin.Context) {
+		var activity TeamsActivity
+		if c.ShouldBindBodyWith(&activity, binding.JSON) == nil {
+			reached = activity.Type
+		}
+		c.Status(http.StatusOK)
+	})
+
+	for _, auth := range []string{"let me in", "please"} {
+		reached = ""
+		req := httptest.NewRequest(http.MethodPost, "/teams/api/messages", strings.NewReader(`{"type":"message"}`))
+		req.Header.Set("Authorization", auth)
+		rsp := httptest.NewRecorder()
+		app.ServeHTTP(rsp, req)
+
+		if auth == "let me in" && (rsp.Code != http.StatusOK || reached != "message") {
+			t.Errorf("verified request didn't get through with its body: %d %q", rsp.Code, reached)
+		}
+		if auth == "please" && (rsp.Code != http.StatusUnauthorized || reached != "") {
+			t.Errorf("unverified request got through: %d %q", rsp.Code, reached)
+		}
+	}
+}
+
+func TestTeamsHMACVerifier(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("shared secret"))
+	v := &TeamsHMACVerifier{secret: secret}
+	body := []byte(`{"type":"message"}`)
+
+	mac := hmac.New(sha256.New, []byte("shared secret"))
+	mac.Write(body)
+	req := httptest.NewRequest(http.MethodPost, "/teams/api/messages", nil)
+	req.Header.Set("Authorization", "HMAC "+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	if err := v.verify(req, body); err != nil {
+		t.Errorf("valid signature rejected: %s", err)
+	}
+	if err := v.verify(req, []byte(`{"type":"invoke"}`)); err == nil {
+		t.Error("signature accepted for a different body")
+	}
+}
+
+// Publishes one key the way Bot Framework does, and signs tokens with it
+type fakeBotFramework struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// How many times Grab went looking for keys
+	fetches int32
+}
+
+func newFakeBotFramework(t *testing.T) *fakeBotFramework {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeBotFramework{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openidconfiguration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": f.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeBotFramework) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestTeamsJWTVerifier(t *testing.T) {
+	f := newFakeBotFramework(t)
+	t.Setenv("TEAMS_HMAC_SECRET", "")
+	t.Setenv("TEAMS_OPENID_METADATA_URL", f.server.URL+"/openidconfiguration")
+	t.Setenv("TEAMS_APP_ID", "grab")
+	v := newTeamsVerifier()
+
+	body := []byte(`{"type":"message","serviceUrl":"https://smba.trafficmanager.net/amer/"}`)
+	now := time.Now()
+	valid := map[string]interface{}{
+		"iss":        "https://api.botframework.com",
+		"aud":        "grab",
+		"exp":        now.Add(time.Hour).Unix(),
+		"nbf":        now.Unix(),
+		"serviceurl": "https://smba.trafficmanager.net/amer/",
+	}
+	// Someone else's claims, under our signature
+	tamper := func(token string, changes map[string]interface{}) string {
+		parts := strings.Split(token, ".")
+		payload, _ := json.Marshal(changes)
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		result := map[string]interface{}{}
+		for k, v := range valid {
+			result[k] = v
+		}
+		for k, v := range changes {
+			result[k] = v
+		}
+		return result
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", f.sign(t, valid), true},
+		{"someone else's app", f.sign(t, claims(map[string]interface{}{"aud": "not-grab"})), false},
+		{"wrong issuer", f.sign(t, claims(map[string]interface{}{"iss": "https://example.com"})), false},
+		{"expired", f.sign(t, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), false},
+		{"other service url", f.sign(t, claims(map[string]interface{}{"serviceurl": "https://example.com/"})), false},
+		{"tampered", tamper(f.sign(t, claims(map[string]interface{}{"aud": "not-grab"})), valid), false},
+		{"unsigned", "", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/teams/api/messages", nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		err := v.verify(req, body)
+		if test.ok && err != nil {
+			t.Errorf("%s: rejected: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestTeamsJWTVerifierUnknownKeys(t *testing.T) {
+	f := newFakeBotFramework(t)
+	v := &TeamsJWTVerifier{
+		client:      f.server.Client(),
+		metadataURL: f.server.URL + "/openidconfiguration",
+	}
+
+	if _, err := v.getKey("key1"); err != nil {
+		t.Fatal(err)
+	}
+	// Made up kids don't send us back to Bot Framework every time
+	for i := 0; i < 10; i++ {
+		if _, err := v.getKey("made-up"); err == nil {
+			t.Fatal("found a key that doesn't exist")
+		}
+	}
+	if _, err := v.getKey("key1"); err != nil {
+		t.Error(err)
+	}
+	if fetches := atomic.LoadInt32(&f.fetches); fetches != 1 {
+		t.Errorf("expected one fetch, got %d", fetches)
+	}
+
+	// Keys do get rolled, so it looks again once it's been a while
+	v.keysTried = v.keysTried.Add(-teamsKeyRefetchInterval)
+	v.getKey("made-up")
+	if fetches := atomic.LoadInt32(&f.fetches); fetches != 2 {
+		t.Errorf("expected a second fetch, got %d", fetches)
+	}
+}
+
+func TestTeamsFetchTask(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	teams := NewTeamsBridge(Instance{})
+
+	fetch := func(channelID string) (task map[string]interface{}) {
+		var activity TeamsActivity
+		activity.Value.CommandID = TeamsGrabConversation
+		activity.ChannelData.Channel.ID = channelID
+
+		rsp := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rsp)
+		teams.handleFetchTask(c, activity)
+
+		var body struct {
+			Task map[string]interface{} `json:"task"`
+		}
+		if err := json.Unmarshal(rsp.Body.Bytes(), &body); err != nil {
+			t.Fatalf("bad fetchTask response %q: %s", rsp.Body.String(), err)
+		}
+		return body.Task
+	}
+
+	// In a channel, they get the title form
+	task := fetch("19:channel@thread.tacv2")
+	value, _ := task["value"].(map[string]interface{})
+	card, _ := value["card"].(map[string]interface{})
+	if task["type"] != "continue" || card["contentType"] != "application/vnd.microsoft.card.adaptive" {
+		t.Errorf("expected the title form card, got %+v", task)
+	}
+
+	// Anywhere else, they get told why not
+	task = fetch("")
+	if task["type"] != "message" {
+		t.Errorf("expected a message outside of channels, got %+v", task)
+	}
+}
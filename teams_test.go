@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func teamsMessage(id string, author string, content string, minute int) TeamsChatMessage {
+	message := TeamsChatMessage{ID: id, MessageType: "message"}
+	message.CreatedDateTime = time.Date(2024, 1, 1, 9, minute, 0, 0, time.UTC)
+	message.From.User = &struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"displayName"`
+	}{ID: author, DisplayName: author}
+	message.Body.ContentType = "text"
+	message.Body.Content = content
+	return message
+}
+
+func TestTeamsGetThread(t *testing.T) {
+	os.MkdirAll("/tmp/grab", 0777)
+
+	// Somewhere our Graph token shouldn't go
+	var leaked bool
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("Authorization") != ""
+	}))
+	defer elsewhere.Close()
+	lure := `<img src="` + elsewhere.URL + `/hostedContents/1/$value">`
+
+	var server *httptest.Server
+	messages := "/graph/teams/team/channels/channel/messages/root"
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/login/tenant/oauth2/v2.0/token" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "graph token", "expires_in": 3600})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer graph token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		root := teamsMessage("root", "Alice", "Is prod down?", 0)
+		first := teamsMessage("first", "Bob", "Looks like it", 1)
+		bot := teamsMessage("bot", "", "Beep", 2)
+		bot.From.User = nil
+		screenshot := teamsMessage("screenshot", "Alice", `Here: <img src="`+server.URL+messages+`/hostedContents/1/$value">`, 3)
+		runbook := teamsMessage("runbook", "Bob", "Following the runbook"+lure, 4)
+		runbook.Attachments = append(runbook.Attachments, struct {
+			ContentType string `json:"contentType"`
+			ContentURL  string `json:"contentUrl"`
+			Name        string `json:"name"`
+		}{ContentType: "reference", ContentURL: "https://contoso.sharepoint.com/runbook.docx", Name: "runbook.docx"})
+
+		// Replies come newest first, and over two pages
+		switch {
+		case r.URL.Path == messages:
+			json.NewEncoder(w).Encode(root)
+		case r.URL.Path == messages+"/replies" && r.URL.Query().Get("page") == "":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"value":           []TeamsChatMessage{runbook, screenshot},
+				"@odata.nextLink": server.URL + messages + "/replies?page=2",
+			})
+		case r.URL.Path == messages+"/replies":
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": []TeamsChatMessage{bot, first}})
+		case r.URL.Path == messages+"/hostedContents/1/$value":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("not really a jpeg"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("TEAMS_GRAPH_URL", server.URL+"/graph")
+	t.Setenv("TEAMS_LOGIN_URL", server.URL+"/login")
+
+	teams := NewTeamsBridge(Instance{TeamsTenantID: "tenant"})
+	thread, err := teams.getThread("team/channel", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Oldest first, and nothing from bots
+	expected := []Message{
+		{Author: "Alice", Text: "Is prod down?"},
+		{Author: "Bob", Text: "Looks like it"},
+		{Author: "Alice", Text: "Here:"},
+		{Author: "Bob", Text: "Following the runbook" + lure + "\n\n[runbook.docx](https://contoso.sharepoint.com/runbook.docx)"},
+	}
+	if len(thread.Messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %+v", len(expected), thread.Messages)
+	}
+	for i, msg := range thread.Messages {
+		if msg.Author != expected[i].Author || msg.Text != expected[i].Text {
+			t.Errorf("message %d: expected %s: %q, got %s: %q", i, expected[i].Author, expected[i].Text, msg.Author, msg.Text)
+		}
+	}
+	if !thread.Timestamp.Equal(time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("thread should start with its root message, got %s", thread.Timestamp)
+	}
+
+	// The inline image got pulled out into a file
+	files := thread.Messages[2].Files
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".jpg") {
+		t.Fatalf("expected one jpg, got %v", files)
+	}
+	defer os.Remove(files[0])
+	contents, _ := os.ReadFile(files[0])
+	if string(contents) != "not really a jpeg" {
+		t.Errorf("unexpected file contents %q", contents)
+	}
+
+	if leaked || len(thread.Messages[3].Files) != 0 {
+		t.Error("fetched an image from somewhere other than Graph")
+	}
+
+	if _, err = teams.getThread("channel", "root"); err == nil {
+		t.Error("got a thread without a team ID")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Telegram bots can't read chat history, so the bot squirrels away every
+// message it sees (see TelegramMessage), and threads get rebuilt from that.
+// Point TELEGRAM_API_URL somewhere else to use a local Bot API server.
+const telegramDefaultAPIURL = "https://api.telegram.org"
+
+type TelegramBridge struct {
+	client      *http.Client
+	apiURL      string
+	botToken    string
+	botUsername string
+	grabID      string
+}
+
+// Where the copies of everything the bots have seen live, and how updates
+// find out which bot they're for
+type TelegramStore interface {
+	instanceBySecret(secret string) (instance Instance, err error)
+	saveMessage(message *TelegramMessage) (err error)
+	message(grabID string, chatID int64, messageID int64) (message TelegramMessage, err error)
+	messages(grabID string, chatID int64, topicID int64, since time.Time) (messages []TelegramMessage, err error)
+}
+
+var telegramStore TelegramStore = TelegramDBStore{}
+
+type TelegramDBStore struct{}
+
+func (TelegramDBStore) instanceBySecret(secret string) (Instance, error) {
+	return selectInstanceByTelegramSecret(db, secret)
+}
+
+func (TelegramDBStore) saveMessage(message *TelegramMessage) error {
+	return upsertTelegramMessage(db, message)
+}
+
+func (TelegramDBStore) message(grabID string, chatID int64, messageID int64) (TelegramMessage, error) {
+	return selectTelegramMessage(db, grabID, chatID, messageID)
+}
+
+func (TelegramDBStore) messages(grabID string, chatID int64, topicID int64, since time.Time) ([]TelegramMessage, error) {
+	return selectTelegramMessages(db, grabID, chatID, topicID, since)
+}
+
+type TelegramUser struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+type TelegramChat struct {
+	ID      int64 `json:"id"`
+	IsForum bool  `json:"is_forum"`
+}
+
+type TelegramPhotoSize struct {
+	FileID string `json:"file_id"`
+	Width  int    `json:"width"`
+}
+
+type TelegramMessageUpdate struct {
+	MessageID       int64                  `json:"message_id"`
+	MessageThreadID int64                  `json:"message_thread_id"`
+	IsTopicMessage  bool                   `json:"is_topic_message"`
+	From            *TelegramUser          `json:"from"`
+	Chat            TelegramChat           `json:"chat"`
+	Date            int64                  `json:"date"`
+	Text            string                 `json:"text"`
+	Caption         string                 `json:"caption"`
+	ReplyToMessage  *TelegramMessageUpdate `json:"reply_to_message"`
+	Photo           []TelegramPhotoSize    `json:"photo"`
+	Document        *struct {
+		FileID   string `json:"file_id"`
+		FileName string `json:"file_name"`
+	} `json:"document"`
+	ForumTopicCreated *struct {
+		Name string `json:"name"`
+	} `json:"forum_topic_created"`
+}
+
+type TelegramUpdate struct {
+	UpdateID      int64                  `json:"update_id"`
+	Message       *TelegramMessageUpdate `json:"message"`
+	EditedMessage *TelegramMessageUpdate `json:"edited_message"`
+}
+
+func NewTelegramBridge(instance Instance) (t TelegramBridge) {
+	t.client = &http.Client{Timeout: time.Second * 30}
+	t.apiURL = strings.TrimSuffix(os.Getenv("TELEGRAM_API_URL"), "/")
+	if t.apiURL == "" {
+		t.apiURL = telegramDefaultAPIURL
+	}
+	t.botToken = instance.TelegramBotToken
+	t.botUsername = instance.TelegramBotUsername
+	t.grabID = instance.GrabID
+	return t
+}
+
+// Threads are either a reply chain, as "reply/<message ID>" with the first
+// message in the chain, or a whole forum topic, as "topic/<topic ID>".
+func (t *TelegramBridge) getThread(channelID string, threadID string) (thread Thread, err error) {
+	chatID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return Thread{}, fmt.Errorf("invalid telegram chat: %s", channelID)
+	}
+	kind, id, _ := strings.Cut(threadID, "/")
+	messageID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Thread{}, fmt.Errorf("invalid telegram thread: %s", threadID)
+	}
+
+	var conversation []TelegramMessage
+	switch kind {
+	case "topic":
+		conversation, err = telegramStore.messages(t.grabID, chatID, messageID, time.Time{})
+	case "reply":
+		conversation, err = t.getReplyChain(chatID, messageID)
+	default:
+		return Thread{}, fmt.Errorf("invalid telegram thread: %s", threadID)
+	}
+	if err != nil {
+		return Thread{}, err
+	}
+
+	return t.conversationToThread(conversation)
+}
+
+func (t *TelegramBridge) conversationToThread(conversation []TelegramMessage) (thread Thread, err error) {
+	for _, message := range conversation {
+		// Topics start with a service message, which is just the name
+		if message.TopicName != "" {
+			continue
+		}
+		if len(thread.Messages) == 0 {
+			thread.Timestamp = message.Date
+		}
+
+		m := Message{}
+		m.Timestamp = message.Date
+		m.Author = message.Author
+		m.Text = message.Text
+
+		if message.FileID != "" {
+			path, err := t.getFile(message.FileID, message.FileName)
+			if err != nil {
+				log.Println("Could not save file: ", err)
+			} else {
+				m.Files = append(m.Files, path)
+			}
+		}
+
+		thread.Messages = append(thread.Messages, m)
+	}
+
+	return thread, nil
+}
+
+// Keep whatever Telegram sends us, so we can put threads back together later.
+func (t *TelegramBridge) saveMessage(update TelegramMessageUpdate) (err error) {
+	// Don't include Grab (or any other bot), or people asking Grab to do things
+	if update.From == nil || update.From.IsBot || strings.HasPrefix(update.Text, "/") {
+		return nil
+	}
+
+	message := TelegramMessage{
+		GrabID:    t.grabID,
+		ChatID:    update.Chat.ID,
+		MessageID: update.MessageID,
+		Author:    t.displayName(*update.From),
+		Date:      time.Unix(update.Date, 0),
+		Text:      update.Text,
+	}
+	if update.IsTopicMessage {
+		message.TopicID = update.MessageThreadID
+	}
+	if update.ReplyToMessage != nil {
+		message.ReplyToID = update.ReplyToMessage.MessageID
+	}
+	if update.ForumTopicCreated != nil {
+		message.TopicID = update.MessageID
+		message.TopicName = update.ForumTopicCreated.Name
+	}
+
+	if update.Caption != "" {
+		message.Text = update.Caption
+	}
+	// Telegram sends every size of a photo. Take the biggest.
+	for _, photo := range update.Photo {
+		message.FileID = photo.FileID
+		message.FileName = "photo.jpg"
+	}
+	if update.Document != nil {
+		message.FileID = update.Document.FileID
+		message.FileName = update.Document.FileName
+	}
+
+	if message.Text == "" && message.FileID == "" && message.TopicName == "" {
+		return nil
+	}
+	return telegramStore.saveMessage(&message)
+}
+
+// Utility Functions
+
+// Walk up the replies to find where the chain started, then take everything
+// that hangs off of it.
+func (t *TelegramBridge) getReplyChain(chatID int64, messageID int64) (conversation []TelegramMessage, err error) {
+	root, err := telegramStore.message(t.grabID, chatID, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("grab hasn't seen that message (it only knows about messages sent after it joined, with privacy mode off)")
+	}
+	seen := map[int64]bool{}
+	for root.ReplyToID != 0 && root.ReplyToID != root.TopicID && !seen[root.MessageID] {
+		seen[root.MessageID] = true
+		parent, err := telegramStore.message(t.grabID, chatID, root.ReplyToID)
+		if err != nil {
+			break
+		}
+		root = parent
+	}
+
+	candidates, err := telegramStore.messages(t.grabID, chatID, root.TopicID, root.Date)
+	if err != nil {
+		return nil, err
+	}
+	inChain := map[int64]bool{root.MessageID: true}
+	for _, message := range candidates {
+		if message.MessageID == root.MessageID || inChain[message.ReplyToID] {
+			inChain[message.MessageID] = true
+			conversation = append(conversation, message)
+		}
+	}
+	return conversation, nil
+}
+
+func (t *TelegramBridge) getTopicName(chatID int64, topicID int64) string {
+	message, err := telegramStore.message(t.grabID, chatID, topicID)
+	if err != nil {
+		return ""
+	}
+	return message.TopicName
+}
+
+func (t *TelegramBridge) displayName(user TelegramUser) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if name == "" {
+		name = user.Username
+	}
+	return name
+}
+
+// Files come in two steps. getFile tells us where it is, then we download it.
+func (t *TelegramBridge) getFile(fileID string, fileName string) (path string, err error) {
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	err = t.request("getFile", map[string]interface{}{"file_id": fileID}, &file)
+	if err != nil {
+		return "", err
+	}
+
+	rsp, err := t.client.Get(fmt.Sprintf("%s/file/bot%s/%s", t.apiURL, t.botToken, file.FilePath))
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting file from Telegram: %s", rsp.Status)
+	}
+
+	extension := strings.TrimPrefix(filepath.Ext(fileName), ".")
+	if extension == "" {
+		extension = strings.TrimPrefix(filepath.Ext(file.FilePath), ".")
+	}
+	return saveTempFile(rsp.Body, extension)
+}
+
+// Reply to a message, in whatever topic it was in
+func (t *TelegramBridge) sendReply(chatID int64, topicID int64, replyTo int64, text string) (err error) {
+	body := map[string]interface{}{
+		"chat_id": chatID,
+		"text":    text,
+		"reply_parameters": map[string]interface{}{
+			"message_id":                  replyTo,
+			"allow_sending_without_reply": true,
+		},
+	}
+	if topicID != 0 {
+		body["message_thread_id"] = topicID
+	}
+	return t.request("sendMessage", body, nil)
+}
+
+// Tell Telegram where to send updates. The secret comes back in a header on
+// every update, which is how we know it's really Telegram, and who it's for.
+func (t *TelegramBridge) setWebhook(secret string) (err error) {
+	body := map[string]interface{}{
+		"url":             strings.TrimSuffix(os.Getenv("GRAB_URL"), "/") + "/telegram/webhook/handle",
+		"secret_token":    secret,
+		"allowed_updates": []string{"message", "edited_message"},
+	}
+	return t.request("setWebhook", body, nil)
+}
+
+// Every Bot API method is a POST to /bot<token>/<method>, and everything comes
+// back wrapped in {"ok": ..., "result": ...}
+func (t *TelegramBridge) request(method string, body interface{}, result interface{}) (err error) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/bot%s/%s", t.apiURL, t.botToken, url.PathEscape(method))
+	rsp, err := t.client.Post(endpoint, "application/json", bytes.NewReader(bodyBytes))
+	if err != nil {
+		// Don't go logging the bot token
+		return fmt.Errorf("could not reach telegram for %s", method)
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return fmt.Errorf("telegram returned %s", rsp.Status)
+	}
+	if !response.OK {
+		return fmt.Errorf("telegram returned %s: %s", rsp.Status, response.Description)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Reply "/grab" to a message to save its reply chain, or say it in a forum
+// topic to save the whole topic. "/grab Article / Section" picks where it goes.
+const telegramGrabCommand = "/grab"
+
+// Telegram has no app install flow. Someone makes a bot with @BotFather and
+// gives us its token, and we point its webhook at ourselves.
+func telegramInstallResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		instance := new(Instance)
+		instance.GrabID = uuid.New().String()
+		instance.TelegramBotToken = c.PostForm("botToken")
+		instance.TelegramWebhookSecret = uuid.New().String()
+		setWikiCredentials(instance, c.PostForm)
+
+		// Make sure the token actually works before we save it
+		t := NewTelegramBridge(*instance)
+		var me TelegramUser
+		err := t.request("getMe", map[string]interface{}{}, &me)
+		if err != nil {
+			c.HTML(http.StatusOK, "error.html", gin.H{
+				"SlackError": "Could not log in to Telegram",
+				"ErrorDesc":  err.Error(),
+			})
+			return
+		}
+
+		instance.TelegramBotUsername = me.Username
+
+		err = insertInstance(db, instance)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error storing telegram bot token: %s", err.Error())
+			return
+		}
+
+		err = t.setWebhook(instance.TelegramWebhookSecret)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error setting telegram webhook: %s", err.Error())
+			return
+		}
+		installedPage(c, instance, fmt.Sprintf("Grab is running as @%s. Add it to a group, then reply '%s' to a message.", me.Username, telegramGrabCommand), "")
+	}
+}
+
+func telegramUpdateResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		// The secret we gave Telegram is the only thing proving this came
+		// from Telegram, and it's also how we know who's asking.
+		secret := c.GetHeader("X-Telegram-Bot-Api-Secret-Token")
+		instance, err := telegramStore.instanceBySecret(secret)
+		if err != nil || secret == "" {
+			c.String(http.StatusUnauthorized, "invalid telegram secret token")
+			return
+		}
+
+		var update TelegramUpdate
+		err = c.ShouldBindJSON(&update)
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading telegram update: %s", err.Error())
+			return
+		}
+
+		message := update.Message
+		if message == nil {
+			message = update.EditedMessage
+		}
+		if message == nil {
+			c.String(http.StatusOK, "")
+			return
+		}
+
+		t := NewTelegramBridge(instance)
+		err = t.saveMessage(*message)
+		if err != nil {
+			log.Println("Could not save Telegram message: ", err)
+		}
+
+		// Telegram retries anything that takes too long, so ACK first
+		c.String(http.StatusOK, "")
+
+		if update.Message != nil && t.isGrabCommand(message.Text) {
+			go t.handleGrabCommand(instance, *message)
+		}
+	}
+}
+
+// Event Handlers
+
+func (t *TelegramBridge) handleGrabCommand(instance Instance, message TelegramMessageUpdate) {
+	var topicID int64
+	if message.IsTopicMessage {
+		topicID = message.MessageThreadID
+	}
+
+	// Replying to a message grabs its reply chain. In a topic, everything
+	// is technically a reply to the start of the topic, so that means the
+	// whole topic.
+	var threadID string
+	switch {
+	case message.ReplyToMessage != nil && message.ReplyToMessage.MessageID != topicID:
+		threadID = fmt.Sprintf("reply/%d", message.ReplyToMessage.MessageID)
+	case topicID != 0:
+		threadID = fmt.Sprintf("topic/%d", topicID)
+	default:
+		err := t.sendReply(message.Chat.ID, topicID, message.MessageID, fmt.Sprintf("Reply '%s' to a message to save it!", telegramGrabCommand))
+		if err != nil {
+			log.Println("Could not respond to Telegram command: ", err)
+		}
+		return
+	}
+
+	// Strip "/grab" or "/grab@GrabBot" off the front
+	_, args, _ := strings.Cut(strings.TrimSpace(message.Text), " ")
+	articleTitle, sectionTitle, _ := strings.Cut(args, "/")
+	articleTitle = strings.TrimSpace(articleTitle)
+	sectionTitle = strings.TrimSpace(sectionTitle)
+	if articleTitle == "" && topicID != 0 {
+		articleTitle = t.getTopicName(message.Chat.ID, topicID)
+	}
+
+	url, err := archiveThread(t, instance, strconv.FormatInt(message.Chat.ID, 10), threadID, articleTitle, sectionTitle, false)
+	responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+	if err != nil {
+		log.Println("Error grabbing Telegram thread: ", err)
+		responseData = fmt.Sprintf("Could not save article: %s", err)
+	}
+
+	err = t.sendReply(message.Chat.ID, topicID, message.MessageID, responseData)
+	if err != nil {
+		log.Println("Could not respond to Telegram command: ", err)
+	}
+}
+
+// In groups with more than one bot, commands come as "/grab@GrabBot". Only
+// answer the ones for us.
+func (t *TelegramBridge) isGrabCommand(text string) bool {
+	command, _, _ := strings.Cut(strings.TrimSpace(text), " ")
+	command, bot, addressed := strings.Cut(command, "@")
+	if addressed && (t.botUsername == "" || !strings.EqualFold(bot, t.botUsername)) {
+		return false
+	}
+	return command == telegramGrabCommand
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What the database would be doing, for one bot
+type fakeTelegramStore struct {
+	instance Instance
+	lock     sync.Mutex
+	saved    map[int64]TelegramMessage
+}
+
+func (s *fakeTelegramStore) instanceBySecret(secret string) (Instance, error) {
+	if secret != s.instance.TelegramWebhookSecret {
+		return Instance{}, errors.New("no rows in result set")
+	}
+	return s.instance, nil
+}
+
+func (s *fakeTelegramStore) saveMessage(message *TelegramMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.saved[message.MessageID] = *message
+	return nil
+}
+
+func (s *fakeTelegramStore) message(grabID string, chatID int64, messageID int64) (TelegramMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	message, ok := s.saved[messageID]
+	if !ok || message.GrabID != grabID || message.ChatID != chatID {
+		return TelegramMessage{}, errors.New("no rows in result set")
+	}
+	return message, nil
+}
+
+func (s *fakeTelegramStore) messages(grabID string, chatID int64, topicID int64, since time.Time) (messages []TelegramMessage, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, message := range s.saved {
+		if message.GrabID == grabID && message.ChatID == chatID && message.TopicID == topicID && !message.Date.Before(since) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Date.Equal(messages[j].Date) {
+			return messages[i].MessageID < messages[j].MessageID
+		}
+		return messages[i].Date.Before(messages[j].Date)
+	})
+	return messages, nil
+}
+
+func telegramUpdate(id int64, name string, text string, replyTo int64) TelegramUpdate {
+	message := &TelegramMessageUpdate{
+		MessageID: id,
+		From:      &TelegramUser{ID: id, FirstName: name},
+		Chat:      TelegramChat{ID: -100},
+		Date:      time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC).Unix() + id,
+		Text:      text,
+	}
+	if replyTo != 0 {
+		message.ReplyToMessage = &TelegramMessageUpdate{MessageID: replyTo}
+	}
+	return TelegramUpdate{UpdateID: id, Message: message}
+}
+
+func TestTelegramGrab(t *testing.T) {
+	os.MkdirAll("/tmp/grab", 0777)
+	useUnreachableDB(t)
+	vault := t.TempDir()
+	t.Setenv("OBSIDIAN_VAULT_PATH", vault)
+
+	// The Bot API, with one picture on it
+	replies := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/botbot-token/getFile":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["file_id"] != "photo-id" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "description": "Bad Request: invalid file_id"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": map[string]string{"file_path": "photos/file_1.jpg"}})
+		case "/file/botbot-token/photos/file_1.jpg":
+			w.Write([]byte("\x89PNG\r\n\x1a\nnot really a png"))
+		case "/botbot-token/sendMessage":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			replies <- body
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": map[string]interface{}{}})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "description": "Not Found"})
+		}
+	}))
+	defer server.Close()
+	t.Setenv("TELEGRAM_API_URL", server.URL)
+
+	instance := Instance{GrabID: "grab-id", TelegramBotToken: "bot-token", TelegramBotUsername: "GrabBot", TelegramWebhookSecret: "webhook-secret"}
+	store := &fakeTelegramStore{instance: instance, saved: map[int64]TelegramMessage{}}
+	old := telegramStore
+	telegramStore = store
+	defer func() { telegramStore = old }()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/telegram/webhook/handle", telegramUpdateResp())
+	send := func(secret string, update TelegramUpdate) int {
+		body, _ := json.Marshal(update)
+		req := httptest.NewRequest(http.MethodPost, "/telegram/webhook/handle", bytes.NewReader(body))
+		if secret != "" {
+			req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Only Telegram knows the secret, and it's how we know whose bot it is
+	for _, secret := range []string{"", "someone else's secret"} {
+		if code := send(secret, telegramUpdate(99, "Mallory", "hello", 0)); code != http.StatusUnauthorized {
+			t.Errorf("secret %q: expected 401, got %d", secret, code)
+		}
+	}
+	if len(store.saved) != 0 {
+		t.Fatal("saved a message without the right secret")
+	}
+
+	// 1 <- 2 <- 3, and 1 <- 5. 4 is somebody talking about something else.
+	photo := telegramUpdate(2, "Bob", "", 1)
+	photo.Message.Caption = "Looks like it"
+	photo.Message.Photo = []TelegramPhotoSize{{FileID: "thumbnail-id", Width: 90}, {FileID: "photo-id", Width: 1280}}
+	updates := []TelegramUpdate{
+		telegramUpdate(1, "Alice", "Is prod down?", 0),
+		photo,
+		telegramUpdate(3, "Carol", "Since when?", 2),
+		telegramUpdate(4, "Dave", "Lunch?", 0),
+		telegramUpdate(5, "Alice", "Back up now", 1),
+	}
+	for _, update := range updates {
+		if code := send("webhook-secret", update); code != http.StatusOK {
+			t.Fatalf("message %d: expected 200, got %d", update.Message.MessageID, code)
+		}
+	}
+
+	// Someone else's bot doesn't get an answer from us
+	send("webhook-secret", telegramUpdate(6, "Carol", "/grab@OtherBot", 3))
+	select {
+	case reply := <-replies:
+		t.Fatalf("answered a command for another bot: %+v", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	send("webhook-secret", telegramUpdate(7, "Carol", "/grab@GrabBot Outage / Tuesday", 3))
+	select {
+	case reply := <-replies:
+		text, _ := reply["text"].(string)
+		replyTo, _ := reply["reply_parameters"].(map[string]interface{})
+		if !strings.HasPrefix(text, "Article saved!") || replyTo["message_id"] != float64(7) {
+			t.Fatalf("unexpected reply %+v", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("never heard back about the grab")
+	}
+
+	note, err := os.ReadFile(filepath.Join(vault, "grab-id", "Outage.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := string(note)
+	last := 0
+	for _, line := range []string{"**Alice**: Is prod down?", "**Bob**: Looks like it", "![[", "**Carol**: Since when?", "**Alice**: Back up now"} {
+		i := strings.Index(transcript, line)
+		if i < last {
+			t.Errorf("%q missing or out of order:\n%s", line, transcript)
+		}
+		last = i
+	}
+	if !strings.Contains(transcript, "## Tuesday") || strings.Contains(transcript, "Lunch?") || strings.Contains(transcript, "/grab") {
+		t.Errorf("unexpected transcript:\n%s", transcript)
+	}
+}
+
+func TestTelegramTopic(t *testing.T) {
+	instance := Instance{GrabID: "grab-id"}
+	store := &fakeTelegramStore{instance: instance, saved: map[int64]TelegramMessage{}}
+	old := telegramStore
+	telegramStore = store
+	defer func() { telegramStore = old }()
+
+	// Everything in a topic is a reply to the message that started it
+	tg := NewTelegramBridge(instance)
+	inTopic := func(update TelegramUpdate, topicID int64) TelegramMessageUpdate {
+		update.Message.Chat.IsForum = true
+		update.Message.IsTopicMessage = true
+		update.Message.MessageThreadID = topicID
+		return *update.Message
+	}
+	created := inTopic(telegramUpdate(10, "Alice", "", 0), 10)
+	created.ForumTopicCreated = &struct {
+		Name string `json:"name"`
+	}{Name: "Outage"}
+	for _, message := range []TelegramMessageUpdate{
+		created,
+		inTopic(telegramUpdate(11, "Alice", "Is prod down?", 10), 10),
+		inTopic(telegramUpdate(12, "Bob", "Some other topic", 20), 20),
+		inTopic(telegramUpdate(13, "Bob", "Looks like it", 10), 10),
+		inTopic(telegramUpdate(14, "Carol", "It was DNS", 11), 10),
+	} {
+		if err := tg.saveMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if name := tg.getTopicName(-100, 10); name != "Outage" {
+		t.Errorf("expected the topic's name, got %q", name)
+	}
+
+	thread, err := tg.getThread("-100", "topic/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Message{
+		{Author: "Alice", Text: "Is prod down?"},
+		{Author: "Bob", Text: "Looks like it"},
+		{Author: "Carol", Text: "It was DNS"},
+	}
+	if len(thread.Messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %+v", len(expected), thread.Messages)
+	}
+	for i, msg := range thread.Messages {
+		if msg.Author != expected[i].Author || msg.Text != expected[i].Text {
+			t.Errorf("message %d: expected %s: %q, got %s: %q", i, expected[i].Author, expected[i].Text, msg.Author, msg.Text)
+		}
+	}
+
+	// A reply chain inside a topic stops at the topic
+	chain, err := tg.getReplyChain(-100, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].MessageID != 11 || chain[1].MessageID != 14 {
+		t.Errorf("expected 11 and 14, got %+v", chain)
+	}
+}
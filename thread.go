@@ -1,9 +1,13 @@
 package main
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Thread struct {
 	Timestamp time.Time
+	Channel   string // Whatever the chat calls where this happened, if it knows
 	Messages  []Message
 }
 
@@ -11,6 +15,9 @@ func (t *Thread) getTitle() string {
 	var title string
 	title = t.Messages[0].Text
 
+	// Titles can't have newlines, so just use the first line
+	title, _, _ = strings.Cut(title, "\n")
+
 	// Truncate the first message to 32 characters
 	if len(title) > 32 {
 		title = title[0:32]
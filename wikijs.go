@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Wiki.js 2.x does everything over GraphQL, except uploads, which go to /u.
+// Titles are page paths, like /slack/general/thread-title.
+const wikiJSLocale = "en"
+
+// Everything we upload goes in this asset folder
+const wikiJSAssetFolder = "grab"
+
+// What Wiki.js says when a page isn't there
+const wikiJSPageNotFound = 6003
+
+// Letters, numbers, dashes, underscores, and dots. Wiki.js won't take much
+// else in a path.
+var wikiJSUnsafePathRegex = regexp.MustCompile(`[^\p{L}\p{N}_.-]+`)
+
+type WikiJSBridge struct {
+	client *http.Client
+	url    string
+	token  string
+
+	// Looked up the first time we upload something
+	assetFolderID *int
+}
+
+type WikiJSPage struct {
+	ID      int    `json:"id"`
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// Mutations don't error, they tell you how it went
+type WikiJSResponseResult struct {
+	Succeeded bool   `json:"succeeded"`
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+}
+
+type WikiJSError struct {
+	Message    string `json:"message"`
+	Extensions struct {
+		Exception struct {
+			Code int `json:"code"`
+		} `json:"exception"`
+	} `json:"extensions"`
+}
+
+func (e WikiJSError) Error() string {
+	return "wiki.js error: " + e.Message
+}
+
+func NewWikiJSBridge(instance Instance) (wiki WikiJSBridge, err error) {
+	wiki.client = &http.Client{Timeout: time.Second * 30}
+	wiki.url = strings.TrimSuffix(instance.WikiJSURL, "/")
+	wiki.token = instance.WikiJSToken
+
+	// Make sure the API key works
+	var result struct {
+		Pages struct {
+			List []WikiJSPage `json:"list"`
+		} `json:"pages"`
+	}
+	err = wiki.request(`query { pages { list(limit: 1) { id } } }`, nil, &result)
+	if err != nil {
+		return WikiJSBridge{}, err
+	}
+	return wiki, nil
+}
+
+func (w *WikiJSBridge) generateTranscript(thread Thread) (transcript string) {
+	timeLayout := "2006-01-02 at 15:04"
+	transcriptBegin := thread.Timestamp.Format(timeLayout)
+	currentTime := time.Now().Format(timeLayout)
+
+	transcript += "Transcript generated at " + currentTime + ".\n\n"
+	transcript += "Conversation begins at " + transcriptBegin + ".\n\n"
+
+	for _, m := range thread.Messages {
+		transcript += "**" + m.Author + "**: " + strings.TrimSpace(m.Text) + "\n\n"
+
+		for _, path := range m.Files {
+			mtype, err := mimetype.DetectFile(path)
+			if err != nil {
+				log.Println("Could not detect mime type: ", err)
+				continue
+			}
+
+			if strings.Contains(mtype.String(), "image") {
+				assetPath, err := w.uploadImage(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Could not upload image: ", err)
+					continue
+				}
+				transcript += fmt.Sprintf("![](%s)\n\n", assetPath)
+			} else if strings.Contains(mtype.String(), "text") {
+				fileContents, err := os.ReadFile(path)
+				os.Remove(path)
+				if err != nil {
+					log.Println("Error reading file: ", err)
+					continue
+				}
+				transcript += "```\n" + string(fileContents) + "\n```\n\n"
+			}
+		}
+	}
+
+	return transcript
+}
+
+// Titles are paths. The last bit of the path is what the page gets called.
+// Sections are markdown headings, and work the same as they do on MediaWiki.
+func (w *WikiJSBridge) uploadArticle(title string, section string, transcript string, clobber bool) (pageURL string, err error) {
+	path, pageTitle := w.splitTitle(title)
+	if path == "" {
+		return "", fmt.Errorf("invalid wiki.js path: %s", title)
+	}
+
+	page, found, err := w.getPage(path)
+	if err != nil {
+		return "", err
+	}
+
+	body := mergeMarkdownSection(page.Content, section, transcript, clobber)
+
+	var result struct {
+		Pages map[string]struct {
+			ResponseResult WikiJSResponseResult `json:"responseResult"`
+		} `json:"pages"`
+	}
+	if found {
+		err = w.request(`mutation ($id: Int!, $content: String!) {
+			pages { update(id: $id, content: $content, isPublished: true) {
+				responseResult { succeeded errorCode message }
+			} }
+		}`, map[string]interface{}{"id": page.ID, "content": body}, &result)
+	} else {
+		err = w.request(`mutation ($content: String!, $path: String!, $title: String!, $locale: String!) {
+			pages { create(content: $content, description: "", editor: "markdown", isPublished: true, isPrivate: false, locale: $locale, path: $path, tags: [], title: $title) {
+				responseResult { succeeded errorCode message }
+			} }
+		}`, map[string]interface{}{"content": body, "path": path, "title": pageTitle, "locale": wikiJSLocale}, &result)
+	}
+	if err != nil {
+		log.Println("Failed to make edit: ", err)
+		return "", err
+	}
+	for _, mutation := range result.Pages {
+		if !mutation.ResponseResult.Succeeded {
+			log.Println("Failed to make edit: ", mutation.ResponseResult.Message)
+			return "", fmt.Errorf("wiki.js could not save %s: %s", path, mutation.ResponseResult.Message)
+		}
+	}
+
+	return w.pageURL(path), nil
+}
+
+// Assets don't belong to a page, so these can go up right away
+func (w *WikiJSBridge) uploadImage(path string) (assetPath string, err error) {
+	folderID, err := w.getAssetFolder()
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Wiki.js wants the folder first, as JSON, under the same name as the file
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("mediaUpload", fmt.Sprintf(`{"folderId":%d}`, folderID))
+	fw, err := writer.CreateFormFile("mediaUpload", filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(fw, file)
+	if err != nil {
+		return "", err
+	}
+	writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, w.url+"/u", body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+w.token)
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		responseBody, _ := io.ReadAll(rsp.Body)
+		return "", fmt.Errorf("wiki.js returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	return "/" + wikiJSAssetFolder + "/" + filepath.Base(path), nil
+}
+
+// Utility Functions
+
+// "/Slack/general/Thread Title" goes at slack/general/thread-title, and is
+// called "Thread Title". Anything that means something in a URL (like "?" or
+// "#") is left out of the path, but stays in the title.
+func (w *WikiJSBridge) splitTitle(title string) (path string, pageTitle string) {
+	var parts []string
+	for _, part := range strings.Split(title, "/") {
+		part = strings.TrimSpace(part)
+		slug := wikiJSUnsafePathRegex.ReplaceAllString(strings.ToLower(strings.Join(strings.Fields(part), "-")), "")
+		if slug == "" || slug == "." || slug == ".." {
+			continue
+		}
+		pageTitle = part
+		parts = append(parts, slug)
+	}
+	return strings.Join(parts, "/"), pageTitle
+}
+
+func (w *WikiJSBridge) pageURL(path string) string {
+	var escaped []string
+	for _, part := range strings.Split(path, "/") {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	return w.url + "/" + strings.Join(escaped, "/")
+}
+
+func (w *WikiJSBridge) getPage(path string) (page WikiJSPage, found bool, err error) {
+	var result struct {
+		Pages struct {
+			SingleByPath *WikiJSPage `json:"singleByPath"`
+		} `json:"pages"`
+	}
+	err = w.request(`query ($path: String!, $locale: String!) {
+		pages { singleByPath(path: $path, locale: $locale) { id path title content } }
+	}`, map[string]interface{}{"path": path, "locale": wikiJSLocale}, &result)
+
+	var wikiErr WikiJSError
+	if errors.As(err, &wikiErr) && wikiErr.Extensions.Exception.Code == wikiJSPageNotFound {
+		return page, false, nil
+	}
+	if err != nil {
+		return page, false, err
+	}
+	if result.Pages.SingleByPath == nil {
+		return page, false, nil
+	}
+	return *result.Pages.SingleByPath, true, nil
+}
+
+// Find our asset folder, and make it if it isn't there
+func (w *WikiJSBridge) getAssetFolder() (folderID int, err error) {
+	if w.assetFolderID != nil {
+		return *w.assetFolderID, nil
+	}
+
+	var folders struct {
+		Assets struct {
+			Folders []struct {
+				ID   int    `json:"id"`
+				Slug string `json:"slug"`
+			} `json:"folders"`
+		} `json:"assets"`
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		err = w.request(`query { assets { folders(parentFolderId: 0) { id slug } } }`, nil, &folders)
+		if err != nil {
+			return 0, err
+		}
+		for _, folder := range folders.Assets.Folders {
+			if folder.Slug == wikiJSAssetFolder {
+				w.assetFolderID = &folder.ID
+				return folder.ID, nil
+			}
+		}
+
+		var created struct {
+			Assets struct {
+				CreateFolder struct {
+					ResponseResult WikiJSResponseResult `json:"responseResult"`
+				} `json:"createFolder"`
+			} `json:"assets"`
+		}
+		err = w.request(`mutation ($slug: String!) {
+			assets { createFolder(parentFolderId: 0, slug: $slug) { responseResult { succeeded errorCode message } } }
+		}`, map[string]interface{}{"slug": wikiJSAssetFolder}, &created)
+		if err != nil {
+			return 0, err
+		}
+		if !created.Assets.CreateFolder.ResponseResult.Succeeded {
+			return 0, fmt.Errorf("could not make wiki.js asset folder: %s", created.Assets.CreateFolder.ResponseResult.Message)
+		}
+	}
+	return 0, fmt.Errorf("could not find wiki.js asset folder %s", wikiJSAssetFolder)
+}
+
+func (w *WikiJSBridge) request(query string, variables map[string]interface{}, result interface{}) (err error) {
+	bodyBytes, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url+"/graphql", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+w.token)
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wiki.js returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []WikiJSError   `json:"errors"`
+	}
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return err
+	}
+	if len(response.Errors) > 0 {
+		return response.Errors[0]
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Data, result)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ZulipBridge struct {
+	client   *http.Client
+	url      string
+	botEmail string
+	apiKey   string
+
+	// Who's asking Grab to save, and how they'd @-mention it, so we can leave
+	// that out
+	botName   string
+	commandID int
+}
+
+type ZulipMessage struct {
+	ID             int    `json:"id"`
+	SenderEmail    string `json:"sender_email"`
+	SenderFullName string `json:"sender_full_name"`
+	Content        string `json:"content"`
+	Timestamp      int64  `json:"timestamp"`
+	StreamID       int    `json:"stream_id"`
+	Subject        string `json:"subject"`
+	Type           string `json:"type"`
+	// For stream messages, this is the stream name. For DMs it's a list of
+	// people, which we don't handle.
+	DisplayRecipient interface{} `json:"display_recipient"`
+}
+
+// Uploads show up in messages as [name](/user_uploads/...)
+var zulipUploadRegex = regexp.MustCompile(`\[([^\]]*)\]\((/user_uploads/[^)]+)\)`)
+
+func NewZulipBridge(instance Instance) (z ZulipBridge) {
+	z.client = &http.Client{Timeout: time.Second * 30}
+	z.url = strings.TrimSuffix(instance.ZulipURL, "/")
+	z.botEmail = instance.ZulipBotEmail
+	z.apiKey = instance.ZulipAPIKey
+	return z
+}
+
+// A Zulip "thread" is a whole topic, so the channel is the stream and the
+// thread is the topic name.
+func (z *ZulipBridge) getThread(stream string, topic string) (thread Thread, err error) {
+	conversation, err := z.getTopicMessages(stream, topic)
+	if err != nil {
+		return Thread{}, err
+	}
+	return z.conversationToThread(conversation)
+}
+
+func (z *ZulipBridge) conversationToThread(conversation []ZulipMessage) (thread Thread, err error) {
+	if len(conversation) == 0 {
+		return Thread{}, fmt.Errorf("no messages in topic")
+	}
+
+	// The first message in the topic is when this party started
+	thread.Timestamp = time.Unix(conversation[0].Timestamp, 0)
+
+	for _, message := range conversation {
+		// Don't include messages from Grab or that are talking to Grab.
+		if message.SenderEmail == z.botEmail || message.ID == z.commandID || z.isGrabCommand(message.Content) {
+			continue
+		}
+
+		m := Message{}
+		m.Timestamp = time.Unix(message.Timestamp, 0)
+		m.Author = message.SenderFullName
+		m.Text = message.Content
+
+		// Pull down anything that got uploaded, and drop the link since it
+		// won't mean anything on the wiki
+		for _, upload := range zulipUploadRegex.FindAllStringSubmatch(message.Content, -1) {
+			path, err := z.getFile(upload[2])
+			if err != nil {
+				log.Println("Could not save file: ", err)
+				continue
+			}
+			m.Files = append(m.Files, path)
+			m.Text = strings.Replace(m.Text, upload[0], upload[1], 1)
+		}
+
+		thread.Messages = append(thread.Messages, m)
+	}
+
+	return thread, nil
+}
+
+// Utility Functions
+
+// Walk the topic from the beginning, a page at a time
+func (z *ZulipBridge) getTopicMessages(stream string, topic string) (conversation []ZulipMessage, err error) {
+	narrow, err := json.Marshal([]map[string]string{
+		{"operator": "stream", "operand": stream},
+		{"operator": "topic", "operand": topic},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	anchor := "oldest"
+	includeAnchor := "true"
+	for {
+		query := url.Values{
+			"anchor":         {anchor},
+			"include_anchor": {includeAnchor},
+			"num_before":     {"0"},
+			"num_after":      {"1000"},
+			"narrow":         {string(narrow)},
+			"apply_markdown": {"false"},
+		}
+
+		var page struct {
+			Messages    []ZulipMessage `json:"messages"`
+			FoundNewest bool           `json:"found_newest"`
+		}
+		err = z.request(http.MethodGet, "/api/v1/messages?"+query.Encode(), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		conversation = append(conversation, page.Messages...)
+		if page.FoundNewest || len(page.Messages) == 0 {
+			break
+		}
+		anchor = strconv.Itoa(page.Messages[len(page.Messages)-1].ID)
+		includeAnchor = "false"
+	}
+	return conversation, nil
+}
+
+// Zulip won't hand over uploads to the API directly. It gives us a temporary
+// link instead.
+func (z *ZulipBridge) getFile(uploadPath string) (path string, err error) {
+	var upload struct {
+		URL string `json:"url"`
+	}
+	err = z.request(http.MethodGet, "/api/v1"+uploadPath, nil, &upload)
+	if err != nil {
+		return "", err
+	}
+
+	rsp, err := z.client.Get(z.url + upload.URL)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting file from Zulip: %s", rsp.Status)
+	}
+
+	extension := strings.TrimPrefix(filepath.Ext(uploadPath), ".")
+	return saveTempFile(rsp.Body, extension)
+}
+
+func (z *ZulipBridge) sendStreamMessage(streamID int, topic string, content string) (err error) {
+	form := url.Values{
+		"type":    {"stream"},
+		"to":      {strconv.Itoa(streamID)},
+		"topic":   {topic},
+		"content": {content},
+	}
+	return z.request(http.MethodPost, "/api/v1/messages", form, nil)
+}
+
+// Anything that starts with an @-mention of the bot and "save". Without the
+// mention, it's just somebody saying "save".
+func (z *ZulipBridge) isGrabCommand(content string) bool {
+	content = strings.TrimSpace(content)
+	if z.botName == "" || !strings.HasPrefix(content, "@**") {
+		return false
+	}
+	end := strings.Index(content[3:], "**")
+	if end < 0 {
+		return false
+	}
+	// Mentions can have the user ID on the end, like @**Grab|12**
+	name, _, _ := strings.Cut(content[3:3+end], "|")
+	if !strings.EqualFold(name, z.botName) {
+		return false
+	}
+	_, ok := z.parseCommand(content)
+	return ok
+}
+
+// Strip the @-mention off the front, and see if what's left is a save command
+func (z *ZulipBridge) parseCommand(content string) (args string, ok bool) {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "@**") {
+		end := strings.Index(content[3:], "**")
+		if end < 0 {
+			return "", false
+		}
+		content = strings.TrimSpace(content[3+end+2:])
+	}
+	if !strings.HasPrefix(strings.ToLower(content), "save") {
+		return "", false
+	}
+	return strings.TrimSpace(content[len("save"):]), true
+}
+
+func (z *ZulipBridge) request(method string, endpoint string, form url.Values, result interface{}) (err error) {
+	var reqBody io.Reader
+	if form != nil {
+		reqBody = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, z.url+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(z.botEmail, z.apiKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	rsp, err := z.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	responseBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("zulip returned %s: %s", rsp.Status, string(responseBody))
+	}
+
+	if result != nil {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
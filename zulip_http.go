@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// What Zulip sends to an outgoing webhook bot
+type ZulipOutgoingWebhook struct {
+	BotEmail    string       `json:"bot_email"`
+	BotFullName string       `json:"bot_full_name"`
+	Data        string       `json:"data"`
+	Token       string       `json:"token"`
+	Trigger     string       `json:"trigger"`
+	Message     ZulipMessage `json:"message"`
+}
+
+// Zulip has no app install flow. An admin makes an outgoing webhook bot and
+// gives us its keys.
+func zulipInstallResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		instance := new(Instance)
+		instance.GrabID = uuid.New().String()
+		instance.ZulipURL = c.PostForm("zulipURL")
+		instance.ZulipBotEmail = c.PostForm("botEmail")
+		instance.ZulipAPIKey = c.PostForm("apiKey")
+		instance.ZulipWebhookToken = c.PostForm("webhookToken")
+		setWikiCredentials(instance, c.PostForm)
+
+		err := insertInstance(db, instance)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "error storing zulip credentials: %s", err.Error())
+			return
+		}
+		installedPage(c, instance, "Grab is ready! Say '@Grab save' in any topic.", "")
+	}
+}
+
+func zulipEventResp() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var payload ZulipOutgoingWebhook
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading zulip payload: %s", err.Error())
+			return
+		}
+
+		// The token is the only thing proving this came from Zulip, and it's
+		// also how we know who's asking.
+		instance, err := selectInstanceByZulipToken(db, payload.Token)
+		if err != nil || payload.Token == "" {
+			c.String(http.StatusUnauthorized, "invalid zulip webhook token")
+			return
+		}
+
+		z := NewZulipBridge(instance)
+		z.botName = payload.BotFullName
+		z.commandID = payload.Message.ID
+
+		stream, isStream := payload.Message.DisplayRecipient.(string)
+		if payload.Message.Type != "stream" || !isStream {
+			c.JSON(http.StatusOK, gin.H{"content": "Grab only works inside stream topics!"})
+			return
+		}
+
+		args, ok := z.parseCommand(payload.Data)
+		if !ok {
+			c.JSON(http.StatusOK, gin.H{"content": "Say `@Grab save` to save this topic to the wiki, or `@Grab save Article / Section` to pick where it goes."})
+			return
+		}
+
+		// The stream is the article and the topic is the section, unless
+		// we're told otherwise
+		articleTitle := stream
+		sectionTitle := payload.Message.Subject
+		if args != "" {
+			article, section, hasSection := strings.Cut(args, "/")
+			articleTitle = strings.TrimSpace(article)
+			if hasSection {
+				sectionTitle = strings.TrimSpace(section)
+			}
+		}
+
+		// Zulip gives up on us pretty quickly, so answer now and post the
+		// link once we have it.
+		c.JSON(http.StatusOK, gin.H{"response_not_required": true})
+
+		go func() {
+			url, err := archiveThread(&z, instance, stream, payload.Message.Subject, articleTitle, sectionTitle, false)
+			responseData := fmt.Sprintf("Article saved! You can find it at: %s", url)
+			if err != nil {
+				log.Println("Error grabbing Zulip topic: ", err)
+				responseData = fmt.Sprintf("Could not save article: %s", err)
+			}
+			err = z.sendStreamMessage(payload.Message.StreamID, payload.Message.Subject, responseData)
+			if err != nil {
+				log.Println("Could not respond to Zulip command: ", err)
+			}
+		}()
+	}
+}